@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/ginuerzh/gost"
@@ -286,6 +287,68 @@ func parseHosts(s string) *gost.Hosts {
 	return hosts
 }
 
+// parseIPProtocols parses the comma separated list of IP protocol numbers, the invalid ones are ignored.
+func parseIPProtocols(s string) (protos []int) {
+	for _, s := range strings.Split(s, ",") {
+		if proto, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && proto >= 0 && proto <= 255 {
+			protos = append(protos, proto)
+		}
+	}
+	return
+}
+
+// parseVLANs parses the comma separated list of VLAN IDs, the invalid entries are kept as 0
+// so they are rejected by the tun handler rather than widening the filter.
+func parseVLANs(s string) (ids []int) {
+	for _, s := range strings.Split(s, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, _ := strconv.Atoi(s)
+		ids = append(ids, id)
+	}
+	return
+}
+
+// parseTunStaticRoutes parses the comma separated list of CIDR=IP:port,
+// the entries without '=' are ignored, the others are validated by the tun handler.
+func parseTunStaticRoutes(s string) map[string]string {
+	routes := make(map[string]string)
+	for _, s := range strings.Split(s, ",") {
+		ss := strings.SplitN(s, "=", 2)
+		if len(ss) == 2 {
+			routes[strings.TrimSpace(ss[0])] = strings.TrimSpace(ss[1])
+		}
+	}
+	return routes
+}
+
+// parseCPUs parses the comma separated list of CPU IDs, the invalid entries are kept as -1
+// so they are rejected by the tun handler.
+func parseCPUs(s string) (cpus []int) {
+	for _, s := range strings.Split(s, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		cpu, err := strconv.Atoi(s)
+		if err != nil {
+			cpu = -1
+		}
+		cpus = append(cpus, cpu)
+	}
+	return
+}
+
+// parseListenAddrs parses the comma separated list of host:port, the empty entries are ignored.
+func parseListenAddrs(s string) (addrs []string) {
+	for _, s := range strings.Split(s, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+	return
+}
+
 func parseIPRoutes(s string) (routes []gost.IPRoute) {
 	if s == "" {
 		return
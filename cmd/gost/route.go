@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"os"
@@ -369,6 +370,119 @@ func (r *route) GenRouters() ([]router, error) {
 			}
 		}
 
+		tunCfg := gost.TunConfig{
+			Name:                 node.Get("name"),
+			Addr:                 node.Get("net"),
+			Peer:                 node.Get("peer"),
+			MTU:                  node.GetInt("mtu"),
+			MTU4:                 node.GetInt("mtu4"),
+			MTU6:                 node.GetInt("mtu6"),
+			IgnoreDF:             node.Get("honor_df") != "" && !node.GetBool("honor_df"), // DF is honored by default
+			BufferSize:           node.GetInt("buffer_size"),
+			UDPBatch:             node.GetInt("udp_batch"),
+			PrewarmBuffers:       node.GetInt("prewarm_buffers"),
+			MinPacketSize:        node.GetInt("min_packet_size"),
+			CreateRetries:        node.GetInt("create_retries"),
+			UpScript:             node.Get("up"),
+			DownScript:           node.Get("down"),
+			IgnoreUpScriptError:  node.GetBool("up_ignore_error"),
+			AutoInnerMTU:         node.GetBool("auto_mtu"),
+			OuterMTU:             node.GetInt("outer_mtu"),
+			AdaptiveMTU:          node.GetBool("adaptive_mtu"),
+			RoutePersist:         node.GetBool("route_persist"),
+			MTUAdjustWindow:      node.GetDuration("mtu_window"),
+			Routes:               tunRoutes,
+			Gateway:              node.Get("gw"),
+			OuterDSCP:            node.GetInt("dscp"),
+			PreserveTOS:          node.GetBool("preserve_tos"),
+			SNAT:                 node.Get("snat"),
+			AutoNAT:              node.GetBool("nat"),
+			NATInterface:         node.Get("nat_iface"),
+			EnableIPForward:      node.GetBool("ip_forward"),
+			RestoreIPForward:     node.GetBool("restore_ip_forward"),
+			DPDInterval:          node.GetDuration("dpd"),
+			DPDMaxMiss:           node.GetInt("dpd_max_miss"),
+			PeerIdleTimeout:      node.GetDuration("peer_idle"),
+			AnnounceTimeout:      node.GetDuration("announce_timeout"),
+			MeasureLatency:       node.GetBool("latency"),
+			MaxPeers:             node.GetInt("max_peers"),
+			AllowedProtocols:     parseIPProtocols(node.Get("protocols")),
+			StrictIPLength:       node.GetBool("strict_ip_length"),
+			StrictRouting:        node.GetBool("strict_routing"),
+			WriteQueue:           node.GetInt("write_queue"),
+			PerPeerQueue:         node.GetInt("peer_queue"),
+			InlineWrite:          node.GetBool("inline_write"),
+			SendRetry:            node.GetDuration("send_retry"),
+			MaxMemory:            int64(node.GetInt("max_memory")),
+			LockThreads:          node.GetBool("lock_threads"),
+			ThreadPriority:       node.GetInt("thread_priority"),
+			CPUAffinity:          parseCPUs(node.Get("cpus")),
+			MaxParseErrors:       node.GetInt("max_parse_errors"),
+			ParseErrorWindow:     node.GetDuration("parse_error_window"),
+			ParseErrorTeardown:   node.GetBool("parse_error_teardown"),
+			DecryptFloodTeardown: node.GetBool("decrypt_flood_teardown"),
+			NoRouteAction:        gost.TunNoRouteAction(node.Get("noroute")),
+			DuplicateIPPolicy:    gost.TunDuplicateIPPolicy(node.Get("dup_ip_policy")),
+			DuplicateIPWindow:    node.GetDuration("dup_ip_window"),
+			DefaultPeer:          node.Get("default_peer"),
+			PendingBuffer:        node.GetInt("pending_buffer"),
+			PendingTimeout:       node.GetDuration("pending_timeout"),
+			AllowBroadcast:       node.GetBool("broadcast"),
+			ClearHeader:          node.GetBool("clear_header"),
+			SessionID:            node.GetBool("session_id"),
+			StaticPeer:           node.Get("static_peer"),
+			StaticRoutes:         parseTunStaticRoutes(node.Get("static_route")),
+			ListenAddrs:          parseListenAddrs(node.Get("listen")),
+			Obfs:                 gost.TunObfs(node.Get("obfs")),
+			RunAsUser:            node.Get("user"),
+			Owner:                node.Get("owner"),
+			Group:                node.Get("group"),
+			GroupAccess:          node.GetBool("group_access"),
+			Persist:              node.GetBool("persist"),
+			MultiQueue:           node.GetBool("multiqueue"),
+			ReusePort:            node.GetBool("reuseport"),
+			ReuseExisting:        node.GetBool("reuse"),
+			Alias:                node.Get("alias"),
+			RespondPing:          node.GetBool("ping"),
+			DecrementTTL:         node.GetBool("decrement_ttl"),
+			CompleteChecksums:    node.GetBool("complete_checksums"),
+			LoopDetect:           node.GetInt("loop_detect"),
+			LoopWindow:           node.GetDuration("loop_window"),
+			DNSForward:           node.Get("dns_forward"),
+			RemoteSRV:            node.Get("srv"),
+			SourcePortRange:      node.Get("source_ports"),
+			RemoteSRVInterval:    node.GetDuration("srv_interval"),
+			Padding:              node.GetInt("padding"),
+			StatsEndpoint:        node.Get("stats"),
+			StatsInterval:        node.GetDuration("stats_interval"),
+			AdminSocket:          node.Get("admin"),
+			DebugHTTP:            node.Get("debug_http"),
+			DebugHTTPWrite:       node.GetBool("debug_http_write"),
+			SummaryInterval:      node.GetDuration("summary"),
+			ExitGracePeriod:      node.GetDuration("exit_grace"),
+			Upstream: gost.TunDirectionConfig{
+				SockBuffer: node.GetInt("up_sockbuf"),
+				Queue:      node.GetInt("up_queue"),
+			},
+			Downstream: gost.TunDirectionConfig{
+				SockBuffer: node.GetInt("down_sockbuf"),
+				Queue:      node.GetInt("down_queue"),
+			},
+		}
+		if node.Protocol == "tun" && node.User != nil {
+			tunCfg.Cipher = node.User.Username()
+		}
+		tapCfg := gost.TapConfig{
+			Name:                  node.Get("name"),
+			Addr:                  node.Get("net"),
+			MTU:                   node.GetInt("mtu"),
+			Routes:                strings.Split(node.Get("route"), ","),
+			Gateway:               node.Get("gw"),
+			Bridge:                node.Get("bridge"),
+			AllowedVLANs:          parseVLANs(node.Get("vlans")),
+			DropUnknownEtherTypes: node.GetBool("drop_unknown_ethertypes"),
+		}
+
 		var ln gost.Listener
 		switch node.Transport {
 		case "tls":
@@ -477,24 +591,9 @@ func (r *route) GenRouters() ([]router, error) {
 		case "otls":
 			ln, err = gost.ObfsTLSListener(node.Addr)
 		case "tun":
-			cfg := gost.TunConfig{
-				Name:    node.Get("name"),
-				Addr:    node.Get("net"),
-				Peer:    node.Get("peer"),
-				MTU:     node.GetInt("mtu"),
-				Routes:  tunRoutes,
-				Gateway: node.Get("gw"),
-			}
-			ln, err = gost.TunListener(cfg)
+			ln, err = gost.TunListener(tunCfg)
 		case "tap":
-			cfg := gost.TapConfig{
-				Name:    node.Get("name"),
-				Addr:    node.Get("net"),
-				MTU:     node.GetInt("mtu"),
-				Routes:  strings.Split(node.Get("route"), ","),
-				Gateway: node.Get("gw"),
-			}
-			ln, err = gost.TapListener(cfg)
+			ln, err = gost.TapListener(tapCfg)
 		case "ftcp":
 			ln, err = gost.FakeTCPListener(
 				node.Addr,
@@ -621,7 +720,13 @@ func (r *route) GenRouters() ([]router, error) {
 			gost.IPsHandlerOption(ips),
 			gost.TCPModeHandlerOption(node.GetBool("tcp")),
 			gost.IPRoutesHandlerOption(tunRoutes...),
+			gost.TunConfigHandlerOption(tunCfg),
+			gost.TapConfigHandlerOption(tapCfg),
 		)
+		// tear down the tun device cleanly on Ctrl-C, if enabled.
+		if c, ok := handler.(io.Closer); ok && node.Protocol == "tun" && node.GetBool("signal_teardown") {
+			gost.HandleTunSignals(c)
+		}
 
 		rt := router{
 			node:     node,
@@ -42,6 +42,8 @@ type HandlerOptions struct {
 	IPs           []string
 	TCPMode       bool
 	IPRoutes      []IPRoute
+	TunConfig     TunConfig
+	TapConfig     TapConfig
 }
 
 // HandlerOption allows a common way to set handler options.
@@ -211,6 +213,20 @@ func IPRoutesHandlerOption(routes ...IPRoute) HandlerOption {
 	}
 }
 
+// TunConfigHandlerOption sets the tun device config for tun tunnel.
+func TunConfigHandlerOption(cfg TunConfig) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.TunConfig = cfg
+	}
+}
+
+// TapConfigHandlerOption sets the tap device config for tap tunnel.
+func TapConfigHandlerOption(cfg TapConfig) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.TapConfig = cfg
+	}
+}
+
 type autoHandler struct {
 	options *HandlerOptions
 }
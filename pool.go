@@ -0,0 +1,22 @@
+//go:build !poolcheck
+// +build !poolcheck
+
+package gost
+
+import "sync"
+
+// bufferPool is a pool of the buffers of the same size.
+// The buffers are checked against misuse when built with the poolcheck tag, see pool_check.go.
+type bufferPool struct {
+	sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		Pool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, size)
+			},
+		},
+	}
+}
@@ -0,0 +1,77 @@
+//go:build poolcheck
+// +build poolcheck
+
+package gost
+
+import (
+	"fmt"
+	"sync"
+)
+
+// poolPoison is the byte filling the buffers in the pool.
+const poolPoison = 0xdb
+
+// bufferPool is the checking pool used by the tests built with the poolcheck tag, e.g.
+//
+//	go test -race -tags poolcheck
+//
+// Unlike sync.Pool, the buffers are reused deterministically (last in, first out), so a misuse
+// shows up in the next Get instead of depending on the GC. It panics if
+//   - a buffer of another size is put, e.g. a buffer of mPool is put into sPool,
+//   - a buffer is put twice,
+//   - a buffer is written after it was put, which is detected by the poison when it is got again.
+//
+// The buffers are poisoned when they are put, so reading a buffer after it was put gets garbage.
+// A buffer of the size not from the pool can be put, like a buffer allocated by make.
+type bufferPool struct {
+	size  int
+	mu    sync.Mutex
+	free  [][]byte
+	owned map[*byte]bool // the buffers got or put, true if the buffer is in the pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		size:  size,
+		owned: make(map[*byte]bool),
+	}
+}
+
+func (p *bufferPool) Get() interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := len(p.free); n > 0 {
+		b := p.free[n-1]
+		p.free = p.free[:n-1]
+		for i, c := range b {
+			if c != poolPoison {
+				panic(fmt.Sprintf("pool: buffer of size %d is written at offset %d after it was put", p.size, i))
+			}
+		}
+		p.owned[&b[0]] = false
+		return b
+	}
+	b := make([]byte, p.size)
+	p.owned[&b[0]] = false
+	return b
+}
+
+func (p *bufferPool) Put(x interface{}) {
+	b := x.([]byte)
+	if len(b) != p.size || cap(b) != p.size {
+		panic(fmt.Sprintf("pool: buffer of len %d and cap %d is put into the pool of size %d", len(b), cap(b), p.size))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.owned[&b[0]] {
+		panic(fmt.Sprintf("pool: buffer of size %d is put twice", p.size))
+	}
+	for i := range b {
+		b[i] = poolPoison
+	}
+	p.owned[&b[0]] = true
+	p.free = append(p.free, b)
+}
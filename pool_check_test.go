@@ -0,0 +1,54 @@
+//go:build poolcheck
+// +build poolcheck
+
+package gost
+
+import "testing"
+
+var bufferPoolCheckTests = []struct {
+	name string
+	fn   func(p *bufferPool)
+	ok   bool
+}{
+	{"reuse", func(p *bufferPool) {
+		b := p.Get().([]byte)
+		b[0] = 1
+		p.Put(b)
+		p.Put(p.Get())
+	}, true},
+	{"foreign buffer", func(p *bufferPool) {
+		p.Put(make([]byte, 16))
+	}, true},
+	{"size mismatch", func(p *bufferPool) {
+		p.Put(make([]byte, 32))
+	}, false},
+	{"sliced buffer", func(p *bufferPool) {
+		p.Put(p.Get().([]byte)[:8])
+	}, false},
+	{"double put", func(p *bufferPool) {
+		b := p.Get().([]byte)
+		p.Put(b)
+		p.Put(b)
+	}, false},
+	{"write after put", func(p *bufferPool) {
+		b := p.Get().([]byte)
+		p.Put(b)
+		b[3] = 1
+		p.Get()
+	}, false},
+}
+
+func TestBufferPoolCheck(t *testing.T) {
+	for i, tc := range bufferPoolCheckTests {
+		ok := func() (ok bool) {
+			defer func() {
+				ok = recover() == nil
+			}()
+			tc.fn(newBufferPool(16))
+			return
+		}()
+		if ok != tc.ok {
+			t.Errorf("#%d %s: ok should be %v", i, tc.name, tc.ok)
+		}
+	}
+}
@@ -2,12 +2,18 @@ package gost
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-log/log"
@@ -47,12 +53,446 @@ type IPRoute struct {
 
 // TunConfig is the config for TUN device.
 type TunConfig struct {
-	Name    string
-	Addr    string
-	Peer    string // peer addr of point-to-point on MacOS
-	MTU     int
-	Routes  []IPRoute
-	Gateway string
+	Name string
+	Addr string
+	// Peer is the peer address of the point-to-point device. When it is set,
+	// the server has a single remote, the peer it received the first packet from,
+	// and the inner addresses of the peer are not learned. The packets from the other peers
+	// are dropped until the remote is removed, e.g. by dead peer detection, or StaticPeer can fix the remote.
+	Peer string
+	MTU  int
+	// BufferSize is the size of the buffer for each packet in flight, a larger packet is truncated.
+	// Default is the larger of 2KB and the MTU plus the cipher overhead. The buffers of 2KB
+	// are shared by the package, a larger size (e.g. for jumbo frames) uses a pool of the handler,
+	// and costs BufferSize bytes for each packet being forwarded.
+	BufferSize int
+	// UDPBatch is the maximum number of the datagrams read from the UDP socket of the tunnel by a syscall
+	// (recvmmsg), which lowers the syscall cost per packet at high packet rates. It is only effective on Linux,
+	// elsewhere a datagram is read at a time. It costs UDPBatch buffers of BufferSize bytes.
+	// Zero or one means a datagram is read at a time.
+	UDPBatch int
+	// PrewarmBuffers is the number of the packet buffers allocated into the pool (the 2KB buffers shared by
+	// the package, or the pool of the handler of BufferSize) as the handler starts, so a burst of traffic
+	// at startup gets the buffers from the pool instead of allocating them on the hot path. It costs PrewarmBuffers
+	// buffers of BufferSize bytes up front, and the buffers left idle in the pool may be released by the GC later
+	// like the others. Zero means the buffers are allocated on demand.
+	PrewarmBuffers int
+	// CreateRetries is the number of retries when the device can not be created on startup,
+	// e.g. the name of the device is briefly taken by the previous process. The delay between
+	// the retries starts at 1 second and doubles up to 8 seconds. Zero means no retry.
+	CreateRetries int
+	// UpScript is the path of the script executed after the device is up, and DownScript is
+	// executed before the device is closed. The name of the device is passed as the argument
+	// and TUN_IFACE environment variable, see runTunScript for other variables.
+	UpScript   string
+	DownScript string
+	// IgnoreUpScriptError continues the startup even if the UpScript fails.
+	IgnoreUpScriptError bool
+	// RunAsUser is the user (name or ID) that the process switches to, with its primary group,
+	// after the device is set up and the tunnel socket is created, as the forwarding does not need
+	// the root privileges. It is the owner of the device by default. Note that the settings undone
+	// on close (e.g. AutoNAT, DownScript) and recreating the socket on a privileged port (e.g. fake TCP)
+	// fail after the privileges are dropped. It is not supported on Windows.
+	RunAsUser string
+	// Owner and Group are the user and group (names or IDs) granted access to the device, so the device
+	// can be opened by an unprivileged user, e.g. to reattach to a persistent device after dropping
+	// privileges. Persist keeps the device after it is closed. MultiQueue creates the device with
+	// multiqueue support, so that other processes can attach more queues to it. They are only supported on Linux.
+	Owner      string
+	Group      string
+	Persist    bool
+	MultiQueue bool
+	// GroupAccess makes the persistent device (Persist or ReuseExisting) usable by the other processes of Group,
+	// so the creation of the device and the forwarding can be split across processes, e.g. a privileged one
+	// setting up the device and unprivileged workers attaching to it. Besides the group of the device,
+	// the tun control device (/dev/net/tun) is made readable and writable by the group if it is not already
+	// accessible to all: it is made group read/write, and it is given to the group if it has no group access,
+	// the group of the control device is never taken from another group. It is only supported on Linux.
+	//
+	// Any process of the group can then attach to the device and read and inject the packets of the tunnel
+	// in plaintext, bypassing the encryption, the filters and the routing of the handler, so the group
+	// must be dedicated to the cooperating processes. The access to the control device alone does not allow
+	// creating or attaching to the other devices, which still requires CAP_NET_ADMIN or their owner or group,
+	// but the change of the control device is kept after the handler stops until the system resets it, e.g. on reboot.
+	GroupAccess bool
+	// ReuseExisting attaches to the existing device of Name configured by another tool (e.g. a persistent
+	// device), instead of creating and configuring one. Addr and MTU are read from the device, so they
+	// can be omitted. It is only supported on Linux.
+	ReuseExisting bool
+	// Alias is the description (ifalias) of the device shown by "ip link show", e.g. to identify
+	// the instance owning the device among many tunnels. It is only supported on Linux.
+	Alias string
+	// MTU4 and MTU6 are the effective MTUs of the IPv4 and IPv6 packets, not greater than the device MTU,
+	// e.g. for a dual-stack tunnel whose IPv6 path is narrower than the IPv4 one. The TCP MSS of the SYN packets
+	// from the tun device is clamped to fit in them, and the larger packets from the tun device are answered with
+	// ICMP packet too big and dropped, except the IPv4 packets without DF, which are fragmented to fit in them.
+	// Zero means the device MTU.
+	MTU4 int
+	MTU6 int
+	// IgnoreDF fragments the large IPv4 packets from the tun device regardless of DF, and DF is cleared
+	// in the fragments, instead of dropping the packets of DF with ICMP fragmentation needed for path MTU discovery.
+	// It is for the hosts behind the tunnel whose path MTU discovery is broken, e.g. by the filtered ICMP.
+	IgnoreDF bool
+	// AutoInnerMTU sets the MTU of the device to OuterMTU minus the overhead of the tunnel
+	// (the outer IP and transport headers in the worst case, and the salt and tag of Cipher),
+	// so that an inner packet always fits in one outer datagram. MTU is ignored when it is set.
+	AutoInnerMTU bool
+	// OuterMTU is the MTU of the path between the peers used by AutoInnerMTU, default is 1500.
+	OuterMTU int
+	// Cipher is the method of the cipher of the tunnel, e.g. "aes-128-gcm", whose salt and tag are
+	// counted in the overhead by AutoInnerMTU. It must be the cipher of the handler if set.
+	// Empty means the cipher is unknown, and the overhead of the largest cipher is counted.
+	Cipher string
+	// AdaptiveMTU lowers the MTU of the device at runtime when the path MTU drops during a session, e.g. the path
+	// changes from WiFi to a VPN. The events of the drop are the ICMP fragmentation needed messages received on
+	// client side from the inner address of the server, which is Peer or Gateway, and the datagrams rejected
+	// by the system as too big (EMSGSIZE), which are dropped. The ICMP messages of the other hosts only
+	// clamp the TCP MSS to their destinations for 10 minutes. The MTU is lowered to the lowest of the events
+	// once 3 events are seen within MTUAdjustWindow (default 10 seconds), and restored after no event in 30 windows. While the MTU is lowered, the larger packets of DF from the peers
+	// are answered with ICMP packet too big, so the peers lower their path MTU too. Changing the MTU of
+	// the device is supported on Linux, macOS and BSD, elsewhere only the MTU of the handler is lowered.
+	AdaptiveMTU     bool
+	MTUAdjustWindow time.Duration
+	Routes          []IPRoute
+	Gateway         string
+	// RoutePersist re-installs Routes and the routes added at runtime once they are removed externally
+	// while the handler is running, e.g. by the kernel when the interface flaps. The changes of the device
+	// are watched by netlink, so it is only supported on Linux.
+	RoutePersist bool
+	// OuterDSCP is the DSCP value (0-63) marked on the outer tunnel datagrams.
+	// It is applied once to the tunnel socket when the tunnel is set up.
+	OuterDSCP int
+	// PreserveTOS copies the ToS of the inner IPv4 packet to the outer datagram.
+	// If OuterDSCP is also set, the fixed OuterDSCP mark takes precedence
+	// and PreserveTOS is ignored. Both mark the ToS of the outer IPv4 datagrams
+	// or the traffic class of the outer IPv6 datagrams, by the address family of the socket.
+	// Only the datagrams of the inner IPv4 packets are marked, the control messages and the inner IPv6
+	// packets are sent unmarked. The mark is set on the socket when it changes, so the packets alternating
+	// the ToS cost a system call each.
+	PreserveTOS bool
+	// SNAT is the IPv4 address that the source of the packets from the peers is translated to
+	// before they are written to the tun device, so the inner addresses of the clients are
+	// not exposed to the network behind the server. It must be an unused address routed to
+	// the tun device (e.g. in the subnet of Addr), but not the address of the device itself,
+	// as the kernel drops packets with a local source address and never routes the return
+	// traffic of a local address to the device. Only TCP, UDP and ICMP echo are translated,
+	// other IPv4 packets are dropped, IPv6 packets are not translated.
+	SNAT string
+	// AutoNAT installs the masquerade rule for the tun network on startup with iptables,
+	// and removes it when the device is closed. It is only supported on Linux.
+	AutoNAT bool
+	// NATInterface is the outgoing (WAN) interface of the masquerade rule,
+	// if it is empty, the traffic of the tun network going out of any interface except the tun device is masqueraded.
+	NATInterface string
+	// EnableIPForward enables IP forwarding of the address family of Addr with sysctl
+	// (net.ipv4.ip_forward or net.ipv6.conf.all.forwarding) on startup, which the server needs to route
+	// the traffic of the clients. It requires root. RestoreIPForward restores the old setting when
+	// the device is closed, it is not restored by default as other services may depend on it.
+	// They are only supported on Linux.
+	EnableIPForward  bool
+	RestoreIPForward bool
+	// DPDInterval is the interval of keepalives sent to each peer for dead peer detection,
+	// zero means dead peer detection is disabled. The peer must be able to reply keepalives.
+	DPDInterval time.Duration
+	// DPDMaxMiss is the number of consecutive missed keepalives after which the peer is considered dead,
+	// and its routes are removed. Default is 3.
+	DPDMaxMiss int
+	// PeerIdleTimeout removes the routes learned on server side from the inner addresses sending no packet in the timeout,
+	// so the addresses of the disconnected clients are not routed to their stale outer addresses.
+	// The peer left without routes is removed as well. Zero means the learned routes never expire.
+	PeerIdleTimeout time.Duration
+	// MeasureLatency carries the send time in the keepalives, so the round-trip time of each peer
+	// is measured when the reply is received, see TunStats.Latency. It requires dead peer detection.
+	// The peers echo the keepalives as is, so it works with the peers not measuring latency.
+	MeasureLatency bool
+	// AnnounceTimeout retries the announcement of the inner address on client side with backoff
+	// until it is acknowledged by the server or the timeout passes, so the server learns the route to
+	// the client over lossy links. Zero means the address is announced once.
+	AnnounceTimeout time.Duration
+	// MaxPeers is the maximum number of inner addresses learned from the peers on server side,
+	// packets from new addresses are dropped once it is reached, until the existing ones are removed
+	// (e.g. by dead peer detection). Zero means no limit.
+	MaxPeers int
+	// DuplicateIPPolicy enables the detection of the inner address claimed by two peers on server side,
+	// which is a conflict if the route of the address changes back to its previous peer within DuplicateIPWindow
+	// (default 10 seconds), so a peer roaming to a new outer address is not taken as a conflict. The conflict is
+	// logged and handled by the policy, until no packet of it is received in the window. Empty means no detection.
+	DuplicateIPPolicy TunDuplicateIPPolicy
+	DuplicateIPWindow time.Duration
+	// NoRouteAction is the action for the packets from the tun device to a destination
+	// without route on server side, default is TunNoRouteDrop. The packets of each action are counted in the stats.
+	NoRouteAction TunNoRouteAction
+	// PendingBuffer is the maximum number of the packets from the tun device to the destinations without route
+	// held on server side, which are sent once the routes to the destinations are learned from the peers,
+	// so the first return packets of a flow racing with the learning of its peer are not dropped.
+	// The packets beyond it are handled by NoRouteAction. Zero means the packets are not held.
+	PendingBuffer int
+	// PendingTimeout is the time the packets are held in PendingBuffer, default is 1 second.
+	PendingTimeout time.Duration
+	// DefaultPeer is the inner address of the peer that the packets without route are sent to
+	// when NoRouteAction is TunNoRouteGateway.
+	DefaultPeer string
+	// AllowBroadcast replicates the broadcast (limited or of the subnet of Addr) and multicast packets
+	// from the tun device to all the known peers on server side, instead of dropping them.
+	AllowBroadcast bool
+	// AllowedProtocols are the IP protocol numbers (IPv6 next header) of the packets from the tun device
+	// that are allowed to be sent to the peers, the others are dropped. Empty means all are allowed.
+	AllowedProtocols []int
+	// StrictIPLength drops the IPv4 packets from the peers with trailing bytes after the total length,
+	// by default they are trimmed. The packets with inconsistent header length or truncated are always dropped.
+	StrictIPLength bool
+	// StrictRouting drops the packets whose forwarding would violate the ownership of the learned routes
+	// on server side, and logs them: the packets from a peer with the source address routed to another peer
+	// (the route is not taken over), the packets from a peer to be relayed back to itself, and the packets
+	// from the tun device to be sent to the peer owning their source address. It is ignored for
+	// the point-to-point peer and the static peer, which own all the addresses.
+	StrictRouting bool
+	// LockThreads pins each forwarding goroutine (reading the device, reading the tunnel connection,
+	// and writing the device) to a dedicated OS thread, so they do not contend with other goroutines
+	// for the threads of the Go scheduler, at the cost of a thread each.
+	// ThreadPriority is the niceness (-20 to 19, lower is higher priority) of the threads, which implies
+	// LockThreads. Zero means the niceness is not changed. It is only supported on Linux, and a negative
+	// niceness requires CAP_SYS_NICE; if it can not be set, a warning is logged and the forwarding goes on.
+	// CPUAffinity are the IDs of the CPUs the threads are bound to, e.g. the CPUs serving the interrupts
+	// of the NIC, which implies LockThreads. It is a performance tuning only supported on Linux, in the same way
+	// as ThreadPriority. Each thread may run on any of the CPUs.
+	// The other goroutines of the handler, e.g. dead peer detection, are not affected.
+	LockThreads    bool
+	ThreadPriority int
+	CPUAffinity    []int
+	// MaxMemory is the budget in bytes of the packets buffered by the handler, in the write queue
+	// (see WriteQueue and PerPeerQueue), the send queue (see Upstream) and the pending buffer (see PendingBuffer), as a safety ceiling
+	// for memory-constrained hosts. A queued packet takes a buffer of the packet buffer size (see BufferSize),
+	// a pending packet takes its size. When the budget is approached the load is shed, the pending packets
+	// first: they are not held beyond 75% of the budget, then the packets to the tun device are dropped.
+	// Zero means no budget.
+	MaxMemory int64
+	// SendRetry is the delay before a packet is sent again to the peer when the send buffer of the tunnel
+	// connection is full, the packet is dropped if it fails again. Zero means the packet is dropped at once.
+	// In both cases the session is kept alive, only the permanent errors, e.g. network unreachable, stop it.
+	SendRetry time.Duration
+	// WriteQueue is the depth of the queue of the packets from the peers to the tun device, which is written
+	// by a dedicated goroutine, so the tunnel connection is drained while the device write is blocked.
+	// The packets are dropped when the queue is full. Default is 256.
+	WriteQueue int
+	// InlineWrite writes the packets from the peers to the tun device directly in the goroutine reading
+	// the tunnel connection instead of the WriteQueue, so a slow device write stalls the reads.
+	InlineWrite bool
+	// Upstream and Downstream tune the buffering of each direction independently for the asymmetric links:
+	// upstream is from the tun device to the peers, downstream is from the peers to the tun device.
+	Upstream   TunDirectionConfig
+	Downstream TunDirectionConfig
+	// MinPacketSize is the minimum length of the packets read from the tun device and the peers,
+	// the shorter packets (runts) are dropped before they are parsed and counted as parse failures.
+	// Default is 20, the length of the IPv4 header.
+	MinPacketSize int
+	// MaxParseErrors is the number of the packets that can not be parsed in ParseErrorWindow, beyond which
+	// the failures are considered persistent, which usually means a misconfiguration (e.g. mismatched cipher
+	// or packet information setting) rather than occasional corruption: a diagnostic is logged instead of
+	// the error of each packet. Zero means no limit, and the error of each packet is logged.
+	MaxParseErrors int
+	// ParseErrorWindow is the window of MaxParseErrors, default is 10 seconds.
+	ParseErrorWindow time.Duration
+	// ParseErrorTeardown tears down the session when MaxParseErrors is exceeded,
+	// the client reconnects, and the server starts over.
+	ParseErrorTeardown bool
+	// DecryptFloodTeardown tears down the session when more than 16 datagrams can not be decrypted
+	// in 10 seconds, which usually means the key of the peers mismatches, instead of only logging a warning.
+	DecryptFloodTeardown bool
+	// PerPeerQueue is the depth of the queue of the packets from each peer to the tun device, the queues
+	// are served in round-robin, so a fast peer can not monopolize the device under contention. The packets
+	// are dropped from the full queue of the peer only. It replaces WriteQueue, and they are mutually exclusive.
+	// Zero means the queue of each peer is not used.
+	PerPeerQueue int
+	// Obfs is the framing of the outer datagrams, e.g. TunObfsSTUN makes the datagrams resemble STUN,
+	// so the tunnel passes the middle boxes dropping or throttling the unknown UDP traffic by the first bytes.
+	// It must be the same on both sides. It is an obfuscation against naive inspection only: the framing
+	// is easily recognized by a closer look, and it adds no security. Default is TunObfsNone.
+	Obfs TunObfs
+	// Transform is the second stage obfuscation of the outer datagrams, e.g. a custom scrambling:
+	// the datagrams are encoded after they are encrypted (before the Obfs framing), and decoded before
+	// they are decrypted. It must be the same on both sides. The expansion of the encoding is not counted
+	// by AutoInnerMTU. Nil means no transform.
+	Transform TunTransform
+	// ClearHeader prepends a cleartext header of the peer ID and the flow hash to each encrypted
+	// datagram, so that a middle box can balance the tunnel traffic by flow, see tunClearHeaderLen.
+	// The receiver drops the datagrams of other peer IDs before decrypting them. It requires encryption
+	// and must be set on both sides. Note that the header is neither encrypted nor authenticated:
+	// it reveals the user (its hash can be checked against a guessed name) and which datagrams belong
+	// to the same inner flow, and it can be altered to mislead the middle box.
+	ClearHeader bool
+	// SessionID prepends the random ID of the client session to each datagram, so the server maps the datagrams
+	// to the peer by the ID instead of the outer address, see tunSessionIDLen. The peer is kept when its outer
+	// address changes, e.g. behind a NAT rewriting the port of each datagram, or as the client migrates to
+	// another network, and the replies are sent to the last outer address of the peer. The ID is kept across
+	// the reconnections of the client. It must be set on both sides. The ID is authenticated by the encryption,
+	// without which the session can be taken over by a datagram with the ID from another address.
+	SessionID bool
+	// RespondPing answers the ICMP echo requests from the peers to the address of the device in the handler,
+	// so the address is a probe target of the tunnel which does not depend on the system network stack.
+	RespondPing bool
+	// DecrementTTL makes the handler a hop of the route like a router, it decrements the TTL (hop limit for IPv6)
+	// of the packets from the tun device before they are sent to the peers. The packets whose TTL would reach zero
+	// are dropped and answered with ICMP time exceeded from the address of the device, so traceroute across
+	// the tunnel shows the tunnel hop.
+	DecrementTTL bool
+	// CompleteChecksums fills the checksums of the IPv4 header and of the TCP and UDP packets from the tun device
+	// which are not valid before they are sent to the peers, e.g. the partial checksums left by the checksum offload
+	// of the system, as the far end rejects them. The fragments and the IPv6 packets with extension headers
+	// are sent unchanged, as their checksums can not be computed from the packet alone.
+	CompleteChecksums bool
+	// LoopDetect is the number of the signatures of the packets recently sent to the peers that are kept
+	// to detect a routing loop, e.g. the packets to the tunnel network routed back into the tunnel by a peer.
+	// The packets received from the peers matching a signature within LoopWindow are dropped and counted
+	// as looped, and the loop is logged, so a misconfiguration does not turn into a packet storm.
+	// The signature is the hash of the IP header, without the TTL and the checksum, and the first bytes of the payload.
+	// Zero disables the detection.
+	LoopDetect int
+	// LoopWindow is the time a signature of LoopDetect is kept, default is 2 seconds.
+	LoopWindow time.Duration
+	// DNSForward is the address (host[:port], the port is 53 by default) of the upstream resolver that
+	// the DNS queries over UDP from the peers to the address of the device are forwarded to, so the address
+	// can be pushed to the clients as their DNS server. The responses are sent back to the peers
+	// in the tunnel, without going through the tun device. Empty means the queries are not intercepted.
+	DNSForward string
+	// RemoteSRV is the DNS SRV record (e.g. _gost._udp.example.com) of the servers on client side,
+	// it takes precedence over the remote address of the node. The servers are tried in the order of priority
+	// (and weight for the same priority), the next one is connected when the current one fails.
+	RemoteSRV string
+	// RemoteSRVInterval is the interval of resolving RemoteSRV again, default is 5 minutes.
+	// The new record is used when the client reconnects.
+	RemoteSRVInterval time.Duration
+	// StaticPeer is the outer address (IP:port) of the only peer on server side. When it is set,
+	// the inner addresses are not learned, all the packets from the tun device are sent to it,
+	// and the datagrams from other addresses are dropped. On client side the peer is always the server.
+	StaticPeer string
+	// StaticRoutes maps the inner destination networks (CIDR) to the outer addresses (IP:port) of the peers
+	// serving them, e.g. {"10.1.0.0/16": "203.0.113.1:8421"}, so that each peer of a site-to-site topology
+	// serves a range of addresses. The packets from the tun device are sent to the peer of the longest
+	// matching network, before the learned routes are looked up, and on client side before they are sent to the server.
+	StaticRoutes map[string]string
+	// Router decides the peer of the IPv4 packets from the tun device by the parsed header, before the
+	// static routes, the learned routes and the server on client side are looked up. It returns the outer
+	// address of the peer and true, nil and true to drop the packet, or false to route the packet as usual.
+	// It is called on the hot path by the goroutine reading the device, once per packet, so it must be fast,
+	// and safe for concurrent use if it is shared by multiple handlers. The header is not used after it returns,
+	// but its Options refers to the packet buffer, so it must not be retained.
+	Router func(*ipv4.Header) (net.Addr, bool)
+	// Padding is the maximum size of the random padding appended to each datagram before it is encrypted,
+	// so the sizes of the datagrams do not reveal the sizes of the inner packets. A packet is not padded
+	// beyond the MTU. It must be set on both sides. It costs extra bandwidth, up to Padding bytes per packet,
+	// and only obscures the sizes: the timing and the volume of the traffic are not hidden,
+	// so it is not a strong defense against traffic analysis on its own. Zero means no padding.
+	Padding int
+	// StatsEndpoint is the UDP address (host:port) that a line of the stats is sent to every StatsInterval,
+	// with the prefix "syslog://" the line is sent as a syslog message. Empty means no stats are sent.
+	StatsEndpoint string
+	// StatsInterval is the interval of the stats sent to StatsEndpoint, default is 60 seconds.
+	StatsInterval time.Duration
+	// SummaryInterval is the interval of the summary logged of the traffic in the interval, in total and
+	// of each active peer, e.g. as a heartbeat of the tunnel less noisy than the per-packet debug logs.
+	// Zero means no summary is logged.
+	SummaryInterval time.Duration
+	// OnPeerChange is called when the state of a peer changes.
+	OnPeerChange func(TunPeerEvent)
+	// OnShutdown is called when a session of the tunnel stops with the reason and the error stopping it,
+	// the error is nil if the handler is closed. On client side a new session is started unless the handler is closed.
+	OnShutdown func(TunShutdownReason, error)
+	// ExitGracePeriod is the time the cleanup is given before the process exits once the handler stops
+	// in the standalone gost: the handler is closed and the device is torn down,
+	// then the process exits with status 0 if the handler stops cleanly, e.g. the tunnel connection reaches EOF,
+	// or 1 for a fatal error, e.g. the device is removed or the config is invalid.
+	// Default is 5 seconds. It is not used when the handler is embedded, e.g. by TunTunnel.
+	ExitGracePeriod time.Duration
+	// ReusePort binds the UDP socket of the tunnel with SO_REUSEPORT, so that multiple server
+	// processes can listen on the same port, and the kernel distributes the datagrams among them.
+	// As the kernel selects the process by the hash of the outer addresses, a peer is always served
+	// by the same process. It is ignored when Transporter is set or the fake TCP is used.
+	ReusePort bool
+	// AdminSocket is the path of the Unix socket serving the line-based admin commands, e.g. to list the peers,
+	// show the stats, add or remove a static route and drop a peer, see serveAdmin for the protocol.
+	// Empty means no admin socket.
+	AdminSocket string
+	// DebugHTTP is the TCP address serving the peers, the stats and the config in JSON over HTTP,
+	// see debugHTTPHandler for the endpoints. The credentials are never served. Empty means no endpoint.
+	DebugHTTP string
+	// DebugHTTPWrite enables the endpoints of DebugHTTP changing the state: drop a peer, add or remove a static route.
+	// They have no authentication, so they only accept the JSON body of Content-Type application/json,
+	// which is not sent by a cross-site request of a web page in the browser of the operator.
+	DebugHTTPWrite bool
+	// Transporter is the carrier of the tunnel, default is UDP.
+	// ConnTunTransporter carries the tunnel over a ready packet connection.
+	// It is ignored when the client specifies a chain.
+	Transporter TunTransporter
+	// SourcePortRange is the range of the ports, e.g. "40000-40099", the client binds the tunnel socket to
+	// instead of an ephemeral port, e.g. for the networks whitelisting the source ports of the tunnel traffic.
+	// The ports are tried until one is bound. It is ignored on server side, with a chain or the fake TCP.
+	SourcePortRange string
+	// ListenAddrs are the local addresses the server binds the tunnel sockets to besides the address of the node,
+	// e.g. of IPv6 or other VIPs, the peers on all the sockets are served by the same handler, and the packets
+	// to a peer are sent on the socket it arrived on. It is ignored on client side.
+	ListenAddrs []string
+}
+
+// TunNoRouteAction is the action for the packets to a destination without route.
+type TunNoRouteAction string
+
+const (
+	// TunNoRouteDrop drops the packets.
+	TunNoRouteDrop TunNoRouteAction = "drop"
+	// TunNoRouteGateway sends the packets to the peer of TunConfig.DefaultPeer.
+	TunNoRouteGateway TunNoRouteAction = "gateway"
+	// TunNoRouteICMP drops the packets and replies ICMP host unreachable to the sender.
+	TunNoRouteICMP TunNoRouteAction = "icmp"
+	// TunNoRouteFlood sends the packets to all the known peers except the one owning the source,
+	// as the last resort for the topologies where the destination is behind an unknown peer.
+	TunNoRouteFlood TunNoRouteAction = "flood"
+)
+
+// TunTransporter is the carrier of tun tunnel,
+// it creates the packet connection used to exchange packets with the peers.
+type TunTransporter interface {
+	// PacketConn creates a packet connection bound to the local address laddr.
+	// raddr is the address of the server on client side, and is empty on server side.
+	PacketConn(laddr, raddr string) (net.PacketConn, error)
+}
+
+type udpTunTransporter struct {
+	reusePort bool
+}
+
+// UDPTunTransporter creates a TunTransporter that carries packets over UDP.
+func UDPTunTransporter() TunTransporter {
+	return &udpTunTransporter{}
+}
+
+// ReusePortUDPTunTransporter creates a TunTransporter that carries packets over UDP,
+// the socket is bound with SO_REUSEPORT, so that multiple processes can share the port.
+func ReusePortUDPTunTransporter() TunTransporter {
+	return &udpTunTransporter{reusePort: true}
+}
+
+func (tr *udpTunTransporter) PacketConn(laddr, raddr string) (net.PacketConn, error) {
+	if tr.reusePort {
+		lc := net.ListenConfig{Control: setReusePort}
+		return lc.ListenPacket(context.Background(), "udp", laddr)
+	}
+	addr, _ := net.ResolveUDPAddr("udp", laddr)
+	return net.ListenUDP("udp", addr)
+}
+
+type fakeTCPTunTransporter struct{}
+
+// FakeTCPTunTransporter creates a TunTransporter that carries packets over fake TCP.
+func FakeTCPTunTransporter() TunTransporter {
+	return &fakeTCPTunTransporter{}
+}
+
+func (tr *fakeTCPTunTransporter) PacketConn(laddr, raddr string) (net.PacketConn, error) {
+	if raddr != "" {
+		return tcpraw.Dial("tcp", raddr)
+	}
+	return tcpraw.Listen("tcp", laddr)
 }
 
 type tunRouteKey [16]byte
@@ -62,27 +502,68 @@ func ipToTunRouteKey(ip net.IP) (key tunRouteKey) {
 	return
 }
 
+// IP returns the inner address of the key, in the 4-byte form for IPv4.
+func (k tunRouteKey) IP() net.IP {
+	ip := net.IP(append([]byte(nil), k[:]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 type tunListener struct {
 	addr   net.Addr
 	conns  chan net.Conn
+	errc   chan error
 	closed chan struct{}
 	config TunConfig
+	mu     sync.Mutex
+	err    error
 }
 
 // TunListener creates a listener for tun tunnel.
 func TunListener(cfg TunConfig) (Listener, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	threads := 1
 	ln := &tunListener{
 		conns:  make(chan net.Conn, threads),
+		errc:   make(chan error, 1),
 		closed: make(chan struct{}),
 		config: cfg,
 	}
 
+	if cfg.AutoInnerMTU && !cfg.ReuseExisting {
+		cfg.MTU = cfg.mtu()
+		log.Logf("[tun] inner MTU: %d, outer MTU: %d, cipher overhead: %d", cfg.MTU, cfg.outerMTU(), cfg.cipherOverhead())
+	}
+
 	for i := 0; i < threads; i++ {
-		conn, ifce, err := createTun(cfg)
+		var conn net.Conn
+		var ifce *net.Interface
+		err := retry(cfg.CreateRetries, tunCreateRetryDelay, func() (err error) {
+			conn, ifce, err = createTun(cfg)
+			return
+		}, func(n int, delay time.Duration, err error) {
+			log.Logf("[tun] create device: %v, retry %d/%d in %s", err, n, cfg.CreateRetries, delay)
+		})
 		if err != nil {
 			return nil, err
 		}
+		if err := runTunUpScript(conn, ifce, cfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if c, ok := conn.(*tunTapConn); ok {
+			c.errFunc = ln.notify
+			// the addresses may be changed by the system or the up script.
+			if err := c.readAddrs(ifce); err != nil {
+				log.Logf("[tun] %s: read addrs: %v", conn.LocalAddr(), err)
+			}
+		}
 		ln.addr = conn.LocalAddr()
 
 		addrs, _ := ifce.Addrs()
@@ -95,16 +576,63 @@ func TunListener(cfg TunConfig) (Listener, error) {
 	return ln, nil
 }
 
+var (
+	tunCreateRetryDelay    = time.Second
+	tunCreateRetryMaxDelay = 8 * time.Second
+)
+
+// retry calls f until it succeeds or it has been retried for retries times,
+// the delay between the retries starts at delay and doubles up to tunCreateRetryMaxDelay.
+// onRetry is called before each retry with the number of the retry and the error of the last call.
+func retry(retries int, delay time.Duration, f func() error, onRetry func(n int, delay time.Duration, err error)) error {
+	for n := 1; ; n++ {
+		err := f()
+		if err == nil || n > retries {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(n, delay, err)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > tunCreateRetryMaxDelay {
+			delay = tunCreateRetryMaxDelay
+		}
+	}
+}
+
+// Accept returns the tun device connection. Once the device has been accepted,
+// Accept blocks until the listener is closed or a fatal error is reported
+// by the device or the tunnel socket bound to it.
 func (l *tunListener) Accept() (net.Conn, error) {
 	select {
 	case conn := <-l.conns:
 		return conn, nil
+	case err := <-l.errc:
+		return nil, &net.OpError{Op: "accept", Net: "tun", Source: nil, Addr: l.addr, Err: err}
 	case <-l.closed:
 	}
 
 	return nil, errors.New("accept on closed listener")
 }
 
+// Err returns the last fatal error reported by the tun device or the tunnel socket.
+func (l *tunListener) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *tunListener) notify(err error) {
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+
+	select {
+	case l.errc <- err:
+	default:
+	}
+}
+
 func (l *tunListener) Addr() net.Addr {
 	return l.addr
 }
@@ -120,9 +648,103 @@ func (l *tunListener) Close() error {
 }
 
 type tunHandler struct {
-	options *HandlerOptions
-	routes  sync.Map
-	chExit  chan struct{}
+	options      *HandlerOptions
+	routes       sync.Map // the *tunRoute learned from the peers by inner address
+	dups         sync.Map // the *tunDupIP of the routes changed, see DuplicateIPPolicy
+	peers        sync.Map
+	chExit       chan struct{}
+	tosConn      *tunTOSConn
+	stats        tunStats
+	mtuWarn      sync.Once
+	truncWarn    sync.Once
+	userOnce     sync.Once
+	embedded     bool // run by TunTunnel, Handle never exits the process
+	nat          *tunNAT
+	defaultPeer  net.IP
+	staticPeer   net.Addr
+	staticRoutes atomic.Value        // *tunPrefixTrie of the peers of staticMap, rebuilt on change
+	staticMu     sync.Mutex          // protects staticMap
+	staticMap    map[string]net.Addr // the peers of the static routes by network
+	gateways     *tunPrefixTrie      // the gateways of IPRoutes
+	srv          *tunSRVRemotes      // the server candidates of RemoteSRV
+	ip           net.IP              // the address of the device
+	dnsInflight  chan struct{}       // the queries of DNSForward being forwarded
+	pending      *tunPending         // the packets of PendingBuffer
+	mem          *tunMemBudget       // the budget of MaxMemory, nil means unlimited
+	ipNet        *net.IPNet
+	pool         *bufferPool
+	protocols    *[256]bool // the allowed protocols, nil means all are allowed
+	user         string
+	sid          atomic.Value // the ID of the session started by Handle
+	p2pPeer      atomic.Value // the remote of point-to-point server
+	nroutes      int32        // number of learned routes
+	routeMu      sync.Mutex   // serializes the changes of the learned routes and nroutes
+	limited      int32        // set when the peer limit is reached
+	clientID     uint64       // the session ID of the client, see TunConfig.SessionID
+	announced    int32        // set when the announcement is acknowledged by the server
+	csumWarned   int32        // set when the incomplete checksums from the device are reported
+	pmtu         int32        // path MTU learned on client side
+	dstPMTU      tunPathMTUs  // path MTUs of the destinations learned on client side
+	mtuAdj       tunMTUAdjuster
+	loops        *tunLoopDetector // the packets sent to the peers of LoopDetect
+	loopWarned   int64            // the time in Unix nanoseconds the loop is last reported
+	closed       chan struct{}
+	mu           sync.Mutex     // protects closed, wg and the running transport
+	wg           sync.WaitGroup // the running transport and its forwarding goroutines
+	tun          net.Conn       // the tun device of the running transport
+	conn         net.PacketConn // the tunnel connection of the running transport
+	decryptMu    sync.Mutex
+	decryptStart time.Time // start of the window of decrypt failures
+	decryptN     int       // decrypt failures in the window
+	parseMu      sync.Mutex
+	parseStart   time.Time // start of the window of parse errors
+	parseN       int       // parse errors in the window
+}
+
+// newTunSessionID returns a short random ID of a session.
+func newTunSessionID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SessionID returns the ID of the session started by Handle, which prefixes the log lines of the session,
+// so the lines of the concurrent tunnels can be told apart. It is empty before Handle is called.
+func (h *tunHandler) SessionID() string {
+	sid, _ := h.sid.Load().(string)
+	return sid
+}
+
+// logf logs the message prefixed by "[tun]" and the ID of the session.
+func (h *tunHandler) logf(format string, args ...interface{}) {
+	if sid := h.SessionID(); sid != "" {
+		log.Logf("[tun] ["+sid+"] "+format, args...)
+		return
+	}
+	log.Logf("[tun] "+format, args...)
+}
+
+// TunMode is the mode of tun handler.
+type TunMode int
+
+const (
+	// TunServerMode is the mode of the handler without remote address,
+	// it learns the routes to the peers from the packets they sent.
+	TunServerMode TunMode = iota
+	// TunClientMode is the mode of the handler with the remote address of the server, which is
+	// the gateway of the client: all the packets from the tun device are sent to the server
+	// regardless of the destination, without looking up any route, and the server routes them onward.
+	TunClientMode
+)
+
+func (m TunMode) String() string {
+	switch m {
+	case TunServerMode:
+		return "server"
+	case TunClientMode:
+		return "client"
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
 }
 
 // TunHandler creates a handler for tun tunnel.
@@ -130,6 +752,7 @@ func TunHandler(opts ...HandlerOption) Handler {
 	h := &tunHandler{
 		options: &HandlerOptions{},
 		chExit:  make(chan struct{}, 1),
+		closed:  make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(h.options)
@@ -138,6 +761,14 @@ func TunHandler(opts ...HandlerOption) Handler {
 	return h
 }
 
+// Mode returns the mode of the handler, it is client mode if the node has a remote address.
+func (h *tunHandler) Mode() TunMode {
+	if h.options.Node.Remote != "" || h.options.TunConfig.RemoteSRV != "" {
+		return TunClientMode
+	}
+	return TunServerMode
+}
+
 func (h *tunHandler) Init(options ...HandlerOption) {
 	if h.options == nil {
 		h.options = &HandlerOptions{}
@@ -148,24 +779,64 @@ func (h *tunHandler) Init(options ...HandlerOption) {
 }
 
 func (h *tunHandler) Handle(conn net.Conn) {
-	defer os.Exit(0)
+	// the error stopping the handler, which decides the exit status of the process.
+	var exitErr error
+	defer func() {
+		if !h.isClosed() && !h.embedded {
+			h.exit(conn, exitErr)
+		}
+	}()
 	defer conn.Close()
+	h.sid.Store(newTunSessionID())
 
 	var err error
 	var raddr net.Addr
-	if addr := h.options.Node.Remote; addr != "" {
+	if addr := h.options.Node.Remote; addr != "" && h.options.TunConfig.RemoteSRV == "" {
 		raddr, err = net.ResolveUDPAddr("udp", addr)
 		if err != nil {
-			log.Logf("[tun] %s: remote addr: %v", conn.LocalAddr(), err)
+			h.logf("%s: remote addr: %v", conn.LocalAddr(), err)
+			exitErr = err
+			return
+		}
+	}
+
+	if c, ok := conn.(*tunTapConn); ok && c.reused != nil {
+		// the effective settings of the reused device.
+		cfg := &h.options.TunConfig
+		cfg.Addr, cfg.MTU, cfg.AutoInnerMTU = c.reused.addr, c.reused.mtu, false
+	}
+	if err := h.initConfig(); err != nil {
+		h.logf("%s: %v", conn.LocalAddr(), err)
+		exitErr = err
+		return
+	}
+	h.logf("%s: %s mode", conn.LocalAddr(), h.Mode())
+	if h.options.TunConfig.AdminSocket != "" {
+		if err := h.listenAdmin(); err != nil {
+			h.logf("%s: admin socket: %v", conn.LocalAddr(), err)
+			exitErr = err
+			return
+		}
+	}
+	if h.options.TunConfig.DebugHTTP != "" {
+		if err := h.listenDebugHTTP(); err != nil {
+			h.logf("%s: debug HTTP: %v", conn.LocalAddr(), err)
+			exitErr = err
 			return
 		}
 	}
 
 	var tempDelay time.Duration
+	var userErr error
 	for {
 		err := func() error {
 			var err error
 			var pc net.PacketConn
+			if h.srv != nil {
+				if raddr, err = h.srv.remote(); err != nil {
+					return err
+				}
+			}
 			// fake tcp mode will be ignored when the client specifies a chain.
 			if raddr != nil && !h.options.Chain.IsEmpty() {
 				cc, err := h.options.Chain.DialContext(context.Background(), "udp", raddr.String())
@@ -176,39 +847,69 @@ func (h *tunHandler) Handle(conn net.Conn) {
 				pc, ok = cc.(net.PacketConn)
 				if !ok {
 					err = errors.New("not a packet connection")
-					log.Logf("[tun] %s - %s: %s", conn.LocalAddr(), raddr, err)
+					h.logf("%s - %s: %s", conn.LocalAddr(), raddr, err)
 					return err
 				}
+			} else if raddr == nil && len(h.options.TunConfig.ListenAddrs) > 0 {
+				laddrs := append([]string{h.options.Node.Addr}, h.options.TunConfig.ListenAddrs...)
+				pc, err = listenTunMux(h.transporter(), laddrs, h.bufferPool())
 			} else {
-				if h.options.TCPMode {
-					if raddr != nil {
-						pc, err = tcpraw.Dial("tcp", raddr.String())
-					} else {
-						pc, err = tcpraw.Listen("tcp", h.options.Node.Addr)
-					}
+				var remote string
+				if raddr != nil {
+					remote = raddr.String()
+				}
+				if raddr != nil && h.options.TunConfig.SourcePortRange != "" {
+					pc, err = h.listenSourcePort(h.transporter(), h.options.Node.Addr, remote)
 				} else {
-					laddr, _ := net.ResolveUDPAddr("udp", h.options.Node.Addr)
-					pc, err = net.ListenUDP("udp", laddr)
+					pc, err = h.transporter().PacketConn(h.options.Node.Addr, remote)
 				}
 			}
 			if err != nil {
 				return err
 			}
 
+			h.initTOS(pc)
+			h.initSockBuffers(pc)
+			pc = h.batchConn(pc)
+			pc = h.sendQueueConn(pc)
 			pc, err = h.initTunnelConn(pc)
 			if err != nil {
 				return err
 			}
 
+			if userErr = h.runAsUser(); userErr != nil {
+				pc.Close()
+				return userErr
+			}
+
 			return h.transportTun(conn, pc, raddr)
 		}()
+		if userErr != nil {
+			h.logf("%s: run as user %s: %v", conn.LocalAddr(), h.options.TunConfig.RunAsUser, userErr)
+			exitErr = userErr
+			return
+		}
+		if err != nil && h.srv != nil && raddr != nil {
+			h.srv.failed(raddr)
+		}
 		if err != nil {
-			log.Logf("[tun] %s: %v", conn.LocalAddr(), err)
+			h.logf("%s: %v", conn.LocalAddr(), err)
+			if r, ok := conn.(errorReporter); ok && isTunFatalError(err) {
+				r.reportError(err)
+			}
+		}
+		exitErr = err
+		if _, ok := h.transporter().(*connTunTransporter); ok && (raddr == nil || h.options.Chain.IsEmpty()) {
+			// the connection of the transporter can not be created again.
+			h.logf("%s: tunnel connection is closed", conn.LocalAddr())
+			return
 		}
 
 		select {
 		case <-h.chExit:
 			return
+		case <-h.closed:
+			return
 		default:
 		}
 
@@ -221,47 +922,1025 @@ func (h *tunHandler) Handle(conn net.Conn) {
 			if max := 6 * time.Second; tempDelay > max {
 				tempDelay = max
 			}
-			time.Sleep(tempDelay)
+			select {
+			case <-time.After(tempDelay):
+			case <-h.closed:
+				return
+			}
 			continue
 		}
-		tempDelay = 0
+		tempDelay = 0
+	}
+}
+
+const defaultTunExitGracePeriod = 5 * time.Second
+
+// exit exits the process once the standalone handler stops by err, with status 0 if it stops cleanly,
+// i.e. err is nil or the tunnel connection reaches EOF, or 1 for the fatal error.
+// The handler and the tun device conn are closed first, so the peers are removed with their callbacks,
+// and the routes, the NAT rules and DownScript of the device are cleaned up, within TunConfig.ExitGracePeriod.
+func (h *tunHandler) exit(conn net.Conn, err error) {
+	grace := h.options.TunConfig.ExitGracePeriod
+	if grace <= 0 {
+		grace = defaultTunExitGracePeriod
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Close()
+		conn.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		h.logf("%s: cleanup is not completed in %s", conn.LocalAddr(), grace)
+	}
+
+	code := 0
+	reason := tunShutdown(err).Reason
+	if err != nil && reason != TunShutdownEOF && reason != TunShutdownCancelled {
+		code = 1
+	}
+	h.logf("%s: %s, exit with status %d", conn.LocalAddr(), reason, code)
+	tunExit(code)
+}
+
+// runAsUser switches to TunConfig.RunAsUser once the tunnel is ready to run.
+func (h *tunHandler) runAsUser() (err error) {
+	name := h.options.TunConfig.RunAsUser
+	if name == "" {
+		return nil
+	}
+	h.userOnce.Do(func() {
+		if err = setUser(name); err == nil {
+			h.logf("run as user %s", name)
+		}
+	})
+	return
+}
+
+// initConfig parses the addresses in TunConfig used by the handler.
+func (h *tunHandler) initConfig() error {
+	cfg := &h.options.TunConfig
+	if addr := cfg.SNAT; addr != "" {
+		ip := net.ParseIP(addr).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid SNAT address %s", addr)
+		}
+		h.nat = newTunNAT(ip)
+	}
+	if size := h.bufferSize(); size > smallBufferSize {
+		h.pool = newBufferPool(size)
+	}
+	prewarmBufferPool(h.bufferPool(), cfg.PrewarmBuffers)
+	if cfg.LoopDetect > 0 {
+		h.loops = newTunLoopDetector(cfg.LoopDetect, cfg.LoopWindow)
+	}
+	if cfg.SessionID && h.Mode() == TunClientMode && h.clientID == 0 {
+		h.clientID = newTunClientID()
+	}
+	if len(cfg.AllowedProtocols) > 0 {
+		h.protocols = new([256]bool)
+		for _, proto := range cfg.AllowedProtocols {
+			if proto < 0 || proto > 255 {
+				return fmt.Errorf("invalid protocol %d", proto)
+			}
+			h.protocols[proto] = true
+		}
+	}
+	if ip, ipNet, err := net.ParseCIDR(cfg.Addr); err == nil {
+		h.ip, h.ipNet = ip, ipNet
+	}
+	if cfg.Cipher != "" && len(h.options.Users) > 0 && h.options.Users[0] != nil {
+		// the MTU of the device is computed by the overhead of cfg.Cipher.
+		method := h.options.Users[0].Username()
+		if n, err := tunCipherOverhead(method); err == nil && n != cfg.cipherOverhead() {
+			return fmt.Errorf("cipher %s mismatches the cipher %s of the tunnel", cfg.Cipher, method)
+		}
+	}
+	h.mem = newTunMemBudget(cfg.MaxMemory)
+	if cfg.PendingBuffer > 0 {
+		h.pending = newTunPending(cfg.PendingBuffer, cfg.PendingTimeout, h.mem)
+	}
+	if cfg.DNSForward != "" {
+		h.dnsInflight = make(chan struct{}, tunDNSMaxInflight)
+	}
+	if addr := cfg.DefaultPeer; addr != "" {
+		if h.defaultPeer = net.ParseIP(addr); h.defaultPeer == nil {
+			return fmt.Errorf("invalid default peer %s", addr)
+		}
+	}
+	if name := cfg.RemoteSRV; name != "" {
+		h.srv = newTunSRVRemotes(name, cfg.RemoteSRVInterval)
+	}
+	for _, route := range h.options.IPRoutes {
+		if route.Dest != nil && route.Gateway != nil {
+			if h.gateways == nil {
+				h.gateways = &tunPrefixTrie{}
+			}
+			h.gateways.insert(route.Dest, route.Gateway)
+		}
+	}
+	for dest, addr := range cfg.StaticRoutes {
+		if err := h.AddStaticRoute(dest, addr); err != nil {
+			return err
+		}
+	}
+	if addr := cfg.StaticPeer; addr != "" {
+		var err error
+		if h.staticPeer, err = net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("invalid static peer %s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+func (h *tunHandler) initTunnelConn(pc net.PacketConn) (net.PacketConn, error) {
+	if h.options.TunConfig.Obfs == TunObfsSTUN {
+		pc = &tunSTUNConn{PacketConn: pc, pool: h.bufferPool()}
+	}
+	if t := h.options.TunConfig.Transform; t != nil {
+		pc = &tunTransformConn{PacketConn: pc, t: t}
+	}
+	if len(h.options.Users) > 0 && h.options.Users[0] != nil {
+		passwd, _ := h.options.Users[0].Password()
+		cipher, err := core.PickCipher(h.options.Users[0].Username(), nil, passwd)
+		if err != nil {
+			return nil, err
+		}
+		raw := &tunRawConn{PacketConn: pc}
+		h.user = h.options.Users[0].Username()
+		c := &tunCipherConn{raw: raw}
+		if h.options.TunConfig.ClearHeader {
+			c.hdr = &tunClearHeaderConn{PacketConn: raw, id: tunPeerID(h.user)}
+			c.PacketConn = cipher.PacketConn(c.hdr)
+		} else {
+			c.PacketConn = cipher.PacketConn(raw)
+		}
+		pc = c
+	} else if h.options.TunConfig.ClearHeader {
+		return nil, errors.New("clear header requires encryption")
+	}
+	if size := h.options.TunConfig.Padding; size > 0 {
+		pc = &tunPaddingConn{PacketConn: pc, max: size, mtu: h.mtu(), pool: h.bufferPool()}
+	}
+	if h.options.TunConfig.SessionID {
+		pc = newTunSessionConn(pc, h.clientID)
+	}
+	return pc, nil
+}
+
+// tunDecryptError is the error of a datagram that can not be decrypted.
+type tunDecryptError struct {
+	err error
+	// mismatch is set on the tunCipherMismatchFailures-th failure of the connection
+	// before any datagram is decrypted, which is likely a misconfiguration rather than a stray datagram.
+	mismatch bool
+}
+
+func (e *tunDecryptError) Error() string {
+	return "decrypt: " + e.err.Error()
+}
+
+// tunRawConn records the error of the last read from the underlying connection of the cipher.
+type tunRawConn struct {
+	net.PacketConn
+	err error
+}
+
+func (c *tunRawConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, c.err = c.PacketConn.ReadFrom(b)
+	return n, addr, c.err
+}
+
+const tunCipherMismatchFailures = 3
+
+// tunCipherConn is the encrypted tunnel connection, the failure of decryption
+// is reported as a *tunDecryptError, so it can be told from the error of the connection.
+type tunCipherConn struct {
+	net.PacketConn
+	raw       *tunRawConn
+	hdr       *tunClearHeaderConn
+	decrypted int32 // set once a datagram is decrypted
+	failures  int32 // the failures before any datagram is decrypted
+}
+
+func (c *tunCipherConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.hdr != nil {
+		return c.hdr.writeFlow(c.PacketConn, b, addr)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *tunCipherConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err == nil {
+		atomic.StoreInt32(&c.decrypted, 1)
+		return
+	}
+	if c.raw.err == nil {
+		e := &tunDecryptError{err: err}
+		if atomic.LoadInt32(&c.decrypted) == 0 &&
+			atomic.AddInt32(&c.failures, 1) == tunCipherMismatchFailures {
+			e.mismatch = true
+		}
+		err = e
+	}
+	return
+}
+
+const (
+	tunDecryptBurst       = 16
+	tunDecryptBurstWindow = 10 * time.Second
+)
+
+var errTunDecryptFlood = errors.New("persistent decrypt failures")
+
+// decryptFailed counts the datagram from addr that can not be decrypted,
+// a diagnostic of the cipher configuration is logged if the first datagrams of the connection all fail,
+// a warning is logged if the failures exceed tunDecryptBurst in tunDecryptBurstWindow,
+// and errTunDecryptFlood is returned to tear down the session if TunConfig.DecryptFloodTeardown is set.
+func (h *tunHandler) decryptFailed(addr net.Addr, err error) error {
+	h.stats.incr(&h.stats.decryptFailed, 1)
+	if Debug {
+		h.logf("%s: %v", addr, err)
+	}
+	if e, ok := err.(*tunDecryptError); ok && e.mismatch {
+		h.logf("%s: encrypted packet could not be decrypted, none is decrypted since the tunnel is set up: "+
+			"verify cipher %s and key match the peer (last error: %v)", addr, h.user, e.err)
+	}
+
+	h.decryptMu.Lock()
+	defer h.decryptMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.decryptStart) > tunDecryptBurstWindow {
+		h.decryptStart = now
+		h.decryptN = 0
+	}
+	h.decryptN++
+	if h.decryptN == tunDecryptBurst {
+		h.logf("%d datagrams can not be decrypted in %s, last from %s: "+
+			"the key of the peers may mismatch", h.decryptN, tunDecryptBurstWindow, addr)
+	}
+	if h.decryptN > tunDecryptBurst && h.options.TunConfig.DecryptFloodTeardown {
+		return errTunDecryptFlood
+	}
+	return nil
+}
+
+const (
+	defaultTunParseErrorWindow = 10 * time.Second
+	defaultTunMinPacketSize    = ipv4.HeaderLen
+)
+
+var (
+	errTunUnknownPacket = errors.New("unknown packet")
+	errTunRunt          = errors.New("packet is too short")
+	errTunParseErrors   = errors.New("persistent parse failures")
+)
+
+// parseFailed handles the packet from addr that can not be parsed, the error is logged
+// until MaxParseErrors is exceeded in ParseErrorWindow, then a diagnostic is logged once for the window,
+// and errTunParseErrors is returned to tear down the session if ParseErrorTeardown is set.
+func (h *tunHandler) parseFailed(addr net.Addr, err error) error {
+	cfg := &h.options.TunConfig
+	if cfg.MaxParseErrors <= 0 {
+		h.logf("%s: %v", addr, err)
+		return nil
+	}
+	window := cfg.ParseErrorWindow
+	if window <= 0 {
+		window = defaultTunParseErrorWindow
+	}
+
+	h.parseMu.Lock()
+	now := time.Now()
+	if now.Sub(h.parseStart) > window {
+		h.parseStart = now
+		h.parseN = 0
+	}
+	h.parseN++
+	n := h.parseN
+	h.parseMu.Unlock()
+
+	if n <= cfg.MaxParseErrors {
+		h.logf("%s: %v", addr, err)
+		return nil
+	}
+	if n == cfg.MaxParseErrors+1 {
+		h.logf("%d packets can not be parsed in %s, last from %s: %v: "+
+			"persistent parse failures, check the cipher and the packet information (PI) settings of both sides",
+			n, window, addr, err)
+	}
+	if cfg.ParseErrorTeardown {
+		return errTunParseErrors
+	}
+	return nil
+}
+
+func (h *tunHandler) minPacketSize() int {
+	if n := h.options.TunConfig.MinPacketSize; n > 0 {
+		return n
+	}
+	return defaultTunMinPacketSize
+}
+
+func (h *tunHandler) transporter() TunTransporter {
+	if tr := h.options.TunConfig.Transporter; tr != nil {
+		return tr
+	}
+	if h.options.TCPMode {
+		return FakeTCPTunTransporter()
+	}
+	if h.options.TunConfig.ReusePort {
+		return ReusePortUDPTunTransporter()
+	}
+	return UDPTunTransporter()
+}
+
+// initTOS sets up the ToS marking of the outer tunnel socket.
+func (h *tunHandler) initTOS(pc net.PacketConn) {
+	h.tosConn = nil
+
+	cfg := &h.options.TunConfig
+	if cfg.OuterDSCP <= 0 && !cfg.PreserveTOS {
+		return
+	}
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		h.logf("%s: ToS marking is only supported on UDP socket", pc.LocalAddr())
+		return
+	}
+	h.tosConn = newTunTOSConn(uc)
+
+	if cfg.OuterDSCP > 0 {
+		if cfg.OuterDSCP > 63 {
+			h.logf("%s: invalid DSCP value %d", pc.LocalAddr(), cfg.OuterDSCP)
+			h.tosConn = nil
+			return
+		}
+		if err := h.tosConn.SetTOS(cfg.OuterDSCP << 2); err != nil {
+			h.logf("%s: set DSCP %d: %v", pc.LocalAddr(), cfg.OuterDSCP, err)
+		}
+		// the fixed mark takes precedence over the inner ToS.
+		h.tosConn = nil
+	}
+}
+
+// tunTOSConn marks the ToS of the outer IPv4 datagrams or the traffic class of the outer IPv6 datagrams
+// by the address family of the socket. Both are marked on the dual-stack socket bound to the unspecified
+// IPv6 address, as the datagrams to the IPv4-mapped addresses are sent as IPv4.
+type tunTOSConn struct {
+	v4  *ipv4.PacketConn
+	v6  *ipv6.PacketConn
+	mu  sync.Mutex // serializes the marking and the writes on the socket, see writeDatagram
+	tos int        // the current mark of the socket
+}
+
+func newTunTOSConn(uc *net.UDPConn) *tunTOSConn {
+	c := &tunTOSConn{}
+	var ip net.IP
+	if addr, ok := uc.LocalAddr().(*net.UDPAddr); ok {
+		ip = addr.IP
+	}
+	if ip == nil || ip.To4() != nil || ip.IsUnspecified() {
+		c.v4 = ipv4.NewPacketConn(uc)
+	}
+	if ip == nil || ip.To4() == nil {
+		c.v6 = ipv6.NewPacketConn(uc)
+	}
+	return c
+}
+
+// SetTOS sets the ToS (or traffic class) of the datagrams sent on the socket,
+// it fails only if none of the address families can be marked.
+func (c *tunTOSConn) SetTOS(tos int) error {
+	var err error
+	marked := false
+	if c.v4 != nil {
+		if err = c.v4.SetTOS(tos); err == nil {
+			marked = true
+		}
+	}
+	if c.v6 != nil {
+		if e := c.v6.SetTrafficClass(tos); e == nil {
+			marked = true
+		} else if err == nil {
+			err = e
+		}
+	}
+	if marked {
+		return nil
+	}
+	return err
+}
+
+// writeDatagram writes b to addr on conn. If the inner ToS is preserved, the datagram is marked by the ToS of
+// the inner IPv4 packet b and the other datagrams, e.g. the control messages, are sent unmarked. The mark is set
+// on the socket, so the writes are serialized with the marking, and it is changed only when it differs from the last one.
+func (h *tunHandler) writeDatagram(conn net.PacketConn, b []byte, addr net.Addr) (int, error) {
+	c := h.tosConn
+	if c == nil {
+		return conn.WriteTo(b, addr)
+	}
+	tos := 0
+	if len(b) >= 20 && waterutil.IsIPv4(b) {
+		tos = int(b[1])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tos != c.tos {
+		if err := c.SetTOS(tos); err != nil {
+			h.logf("%s: set ToS %#x: %v", conn.LocalAddr(), tos, err)
+		}
+		c.tos = tos
+	}
+	return conn.WriteTo(b, addr)
+}
+
+// tunBufferOverhead is the room in the buffer for the salt and tag of the cipher and the framings.
+const tunBufferOverhead = 128
+
+func (h *tunHandler) bufferSize() int {
+	if size := h.options.TunConfig.BufferSize; size > 0 {
+		return size
+	}
+	if size := h.mtu() + tunBufferOverhead; size > smallBufferSize {
+		return size
+	}
+	return smallBufferSize
+}
+
+// bufferPool returns the pool of the packet buffers.
+func (h *tunHandler) bufferPool() *bufferPool {
+	if h.pool != nil {
+		return h.pool
+	}
+	return sPool
+}
+
+// prewarmBufferPool makes n buffers available in the pool p, the buffers already in the pool are counted.
+func prewarmBufferPool(p *bufferPool, n int) {
+	if n <= 0 {
+		return
+	}
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = p.Get().([]byte)
+	}
+	for _, b := range bufs {
+		p.Put(b)
+	}
+}
+
+func (h *tunHandler) mtu() int {
+	if mtu := atomic.LoadInt32(&h.mtuAdj.live); mtu > 0 {
+		return int(mtu)
+	}
+	return h.options.TunConfig.mtu()
+}
+
+// CipherOverhead returns the overhead of the cipher in each datagram counted in the MTU, see TunConfig.Cipher.
+func (h *tunHandler) CipherOverhead() int {
+	return h.options.TunConfig.cipherOverhead()
+}
+
+// checkIPv4Length checks the header length and the total length of the IPv4 packet b received from the peer addr,
+// it returns the length of the packet without the trailing bytes, or false if the packet is malformed.
+func (h *tunHandler) checkIPv4Length(b []byte, addr net.Addr) (int, bool) {
+	hl := ipv4HeaderLen(b)
+	// the total length in the header, ipv4.Header.TotalLen is in the host byte order on some platforms.
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if hl < ipv4.HeaderLen || hl > len(b) || total < hl || total > len(b) ||
+		total < len(b) && h.options.TunConfig.StrictIPLength {
+		h.stats.incr(&h.stats.malformed, 1)
+		if Debug {
+			h.logf("malformed packet from %s: header length %d, total length %d, %d bytes",
+				addr, hl, total, len(b))
+		}
+		return len(b), false
+	}
+	return total, true
+}
+
+// checkMTU counts the packet received from the peer addr that is too large for the tun device,
+// the first one is reported as a misconfiguration of MTU.
+func (h *tunHandler) checkMTU(tun net.Conn, conn net.PacketConn, b []byte, size int, addr net.Addr) {
+	mtu := h.familyMTU(b)
+	if size <= mtu {
+		return
+	}
+	h.stats.incr(&h.stats.mtuExceeded, 1)
+	h.notifyMTU(conn, b, mtu, addr)
+	h.mtuWarn.Do(func() {
+		h.logf("%s: packet size %d exceeds the MTU %d, "+
+			"the MTU of the peers may mismatch, consider raising the MTU",
+			tun.LocalAddr(), size, mtu)
+	})
+}
+
+// truncated checks the packet of n bytes read from addr into the buffer of size bytes,
+// the packet filling up the buffer may be truncated, so it is dropped, and the first one is reported.
+func (h *tunHandler) truncated(addr net.Addr, n, size int) bool {
+	if n < size {
+		return false
+	}
+	h.stats.incr(&h.stats.truncated, 1)
+	h.truncWarn.Do(func() {
+		h.logf("%s: packet may be truncated by the buffer of %d bytes, "+
+			"consider raising the buffer size", addr, size)
+	})
+	return true
+}
+
+// routeOwner returns the peer of the learned route to the inner address ip, or nil if it is unknown.
+func (h *tunHandler) routeOwner(ip net.IP) net.Addr {
+	if v, ok := h.routes.Load(ipToTunRouteKey(ip)); ok {
+		return v.(*tunRoute).addr
+	}
+	return nil
+}
+
+// misrouted counts and logs the packet dropped by StrictRouting.
+func (h *tunHandler) misrouted(format string, v ...interface{}) {
+	h.stats.incr(&h.stats.misrouted, 1)
+	h.logf("strict routing: "+format, v...)
+}
+
+// unknownPeer counts the datagram from addr dropped as it is not from the static peer
+// or the pinned remote of the point-to-point server.
+func (h *tunHandler) unknownPeer(addr net.Addr) {
+	h.stats.incr(&h.stats.unknownPeer, 1)
+	if Debug {
+		h.logf("drop datagram from unknown peer %s", addr)
+	}
+}
+
+// findRouteFor returns the peer of the longest prefix route to dst. The learned routes are host routes,
+// which are the longest prefixes, so they are looked up by the exact address first, then the subnet routes
+// of IPRoutes are matched from the longest prefix to the shortest, until the peer of the gateway is known.
+func (h *tunHandler) findRouteFor(dst net.IP) net.Addr {
+	if v, ok := h.routes.Load(ipToTunRouteKey(dst)); ok {
+		return v.(*tunRoute).addr
+	}
+	if h.gateways == nil {
+		return nil
+	}
+	for _, gw := range h.gateways.matches(dst) {
+		if v, ok := h.routes.Load(ipToTunRouteKey(gw.(net.IP))); ok {
+			return v.(*tunRoute).addr
+		}
+	}
+	return nil
+}
+
+func (h *tunHandler) protocolAllowed(proto int) bool {
+	return h.protocols == nil || proto >= 0 && proto < len(h.protocols) && h.protocols[proto]
+}
+
+// noRoute handles the packet b from the tun device to dst without route according to NoRouteAction,
+// it returns the peer that the packet should be sent to, or nil if the packet is dropped.
+func (h *tunHandler) noRoute(tun net.Conn, conn net.PacketConn, b []byte, src, dst net.IP) (net.Addr, error) {
+	switch h.options.TunConfig.NoRouteAction {
+	case TunNoRouteGateway:
+		if h.defaultPeer != nil {
+			if v, ok := h.routes.Load(ipToTunRouteKey(h.defaultPeer)); ok {
+				h.stats.incr(&h.stats.noRouteGateway, 1)
+				if Debug {
+					h.logf("no route for %s -> %s, send to default peer %s", src, dst, h.defaultPeer)
+				}
+				return v.(*tunRoute).addr, nil
+			}
+		}
+		h.stats.incr(&h.stats.noRouteDropped, 1)
+		h.logf("no route for %s -> %s, default peer %s is unavailable", src, dst, h.defaultPeer)
+	case TunNoRouteFlood:
+		h.stats.incr(&h.stats.noRouteFlooded, 1)
+		if Debug {
+			h.logf("no route for %s -> %s, flood to the peers", src, dst)
+		}
+		return nil, h.broadcast(conn, b, h.routeOwner(src))
+	case TunNoRouteICMP:
+		h.stats.incr(&h.stats.noRouteICMP, 1)
+		var ip net.IP
+		if addr, ok := tun.LocalAddr().(*net.IPAddr); ok {
+			ip = addr.IP
+		}
+		h.logf("no route for %s -> %s, host unreachable", src, dst)
+		if pkt := icmpHostUnreachable(ip, b); pkt != nil {
+			if _, err := tun.Write(pkt); err != nil {
+				h.logf("%s: %v", tun.LocalAddr(), err)
+			}
+		}
+	default:
+		h.stats.incr(&h.stats.noRouteDropped, 1)
+		h.logf("no route for %s -> %s", src, dst)
+	}
+	return nil, nil
+}
+
+// decrementTTL decrements the TTL of the packet b from the tun device, see TunConfig.DecrementTTL.
+// It reports false if the TTL is expired, the packet is dropped and the source is sent ICMP time exceeded.
+func (h *tunHandler) decrementTTL(tun net.Conn, b []byte, src, dst net.IP) bool {
+	if decrementTTL(b) {
+		return true
+	}
+	h.stats.incr(&h.stats.ttlExpired, 1)
+	if Debug {
+		h.logf("TTL expired: %s -> %s, time exceeded", src, dst)
+	}
+	var ip net.IP
+	if addr, ok := tun.LocalAddr().(*net.IPAddr); ok {
+		ip = addr.IP
+	}
+	if pkt := icmpTimeExceeded(ip, b); pkt != nil {
+		if _, err := tun.Write(pkt); err != nil {
+			h.logf("%s: %v", tun.LocalAddr(), err)
+		}
+	}
+	return false
+}
+
+// checksumCompleted counts the packet from the tun device whose checksums are completed, see TunConfig.CompleteChecksums.
+// The first one is reported, as it means the system offloads the checksums of the packets to the device.
+func (h *tunHandler) checksumCompleted(addr net.Addr) {
+	h.stats.incr(&h.stats.checksumFixed, 1)
+	if atomic.CompareAndSwapInt32(&h.csumWarned, 0, 1) {
+		h.logf("%s: the packets have incomplete checksums, likely due to the checksum offload, they are completed", addr)
+	}
+}
+
+// isBroadcast reports whether dst is a multicast, limited broadcast or subnet broadcast address.
+func (h *tunHandler) isBroadcast(dst net.IP) bool {
+	if dst.IsMulticast() {
+		return true
+	}
+	ip := dst.To4()
+	if ip == nil {
+		return false
+	}
+	if ip.Equal(net.IPv4bcast) {
+		return true
+	}
+	if h.ipNet == nil || !h.ipNet.Contains(ip) || len(h.ipNet.Mask) != net.IPv4len {
+		return false
+	}
+	for i := range ip {
+		if ip[i]|h.ipNet.Mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// broadcast sends the packet b to all the known peers.
+func (h *tunHandler) broadcast(conn net.PacketConn, b []byte, except net.Addr) error {
+	var addrs []net.Addr
+	h.peers.Range(func(k, v interface{}) bool {
+		if addr := v.(*tunPeer).addr; except == nil || tunAddrKey(addr) != tunAddrKey(except) {
+			addrs = append(addrs, addr)
+		}
+		return true
+	})
+	for _, addr := range addrs {
+		if err := h.writeTo(conn, b, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTo sends the packet b to the peer addr.
+func (h *tunHandler) writeTo(conn net.PacketConn, b []byte, addr net.Addr) error {
+	n, err := h.sendTo(conn, b, addr)
+	if err != nil {
+		if err == errTunSendDropped {
+			return nil
+		}
+		return tunSocketError(err)
+	}
+	h.countTx(addr, n)
+	return nil
+}
+
+// writeToPeer is writeTo for the known peer, without looking up the peer for counting.
+func (h *tunHandler) writeToPeer(conn net.PacketConn, b []byte, peer *tunPeer) error {
+	n, err := h.sendTo(conn, b, peer.addr)
+	if err != nil {
+		if err == errTunSendDropped {
+			return nil
+		}
+		return tunSocketError(err)
+	}
+	h.stats.count(&peer.tunCounters, false, n)
+	return nil
+}
+
+var errTunSendDropped = errors.New("send buffer is full")
+
+// isTunSendBufferFull reports whether the write error err is the transient condition of the full send buffer,
+// rather than a permanent error, e.g. network unreachable.
+func isTunSendBufferFull(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// sendTo writes the packet b to addr, the packet is retried once after TunConfig.SendRetry if the send buffer is full,
+// it is dropped with errTunSendDropped if the buffer is still full, so the session is kept under egress congestion.
+func (h *tunHandler) sendTo(conn net.PacketConn, b []byte, addr net.Addr) (int, error) {
+	if len(b) > h.familyMTU(b) && h.fragmentable(b) {
+		return h.sendFragments(conn, b, addr)
+	}
+	return h.sendDatagram(conn, b, addr)
+}
+
+// sendDatagram sends b to the peer addr in a datagram.
+func (h *tunHandler) sendDatagram(conn net.PacketConn, b []byte, addr net.Addr) (int, error) {
+	if h.loops != nil {
+		h.loops.sent(b)
+	}
+	n, err := h.writeDatagram(conn, b, addr)
+	if err != nil && h.options.TunConfig.AdaptiveMTU && isTunMessageTooBig(err) {
+		h.stats.incr(&h.stats.mtuExceeded, 1)
+		h.mtuEvent(len(b)-tunMTUStep, "message too long")
+		return 0, errTunSendDropped
+	}
+	if err == nil || !isTunSendBufferFull(err) {
+		return n, err
+	}
+	if d := h.options.TunConfig.SendRetry; d > 0 {
+		time.Sleep(d)
+		if n, err = h.writeDatagram(conn, b, addr); err == nil || !isTunSendBufferFull(err) {
+			return n, err
+		}
+	}
+
+	h.stats.incr(&h.stats.sendDropped, 1)
+	if Debug {
+		h.logf("%s: drop packet to %s: %v", conn.LocalAddr(), addr, err)
+	}
+	return 0, errTunSendDropped
+}
+
+// lockThread locks the calling forwarding goroutine to its OS thread if TunConfig.LockThreads,
+// ThreadPriority or CPUAffinity is set, and sets the priority and the affinity of the thread.
+// The goroutine is never unlocked, so the thread is terminated when the goroutine exits instead of
+// being reused by other goroutines.
+func (h *tunHandler) lockThread() {
+	cfg := &h.options.TunConfig
+	if !cfg.LockThreads && cfg.ThreadPriority == 0 && len(cfg.CPUAffinity) == 0 {
+		return
+	}
+	runtime.LockOSThread()
+	if cfg.ThreadPriority != 0 {
+		if err := setThreadPriority(cfg.ThreadPriority); err != nil {
+			h.logf("set thread priority %d: %v", cfg.ThreadPriority, err)
+		}
+	}
+	if len(cfg.CPUAffinity) > 0 {
+		if err := setThreadAffinity(cfg.CPUAffinity); err != nil {
+			h.logf("set CPU affinity %v: %v", cfg.CPUAffinity, err)
+		}
 	}
 }
 
-func (h *tunHandler) initTunnelConn(pc net.PacketConn) (net.PacketConn, error) {
-	if len(h.options.Users) > 0 && h.options.Users[0] != nil {
-		passwd, _ := h.options.Users[0].Password()
-		cipher, err := core.PickCipher(h.options.Users[0].Username(), nil, passwd)
-		if err != nil {
-			return nil, err
-		}
-		pc = cipher.PacketConn(pc)
+const defaultTunWriteQueue = 256
+
+// writeQueueDepth returns the depth of the WriteQueue, zero means it is not used.
+func (h *tunHandler) writeQueueDepth() int {
+	cfg := &h.options.TunConfig
+	if cfg.InlineWrite || cfg.PerPeerQueue > 0 {
+		return 0
 	}
-	return pc, nil
+	if q := cfg.writeQueue(); q > 0 {
+		return q
+	}
+	return defaultTunWriteQueue
 }
 
-func (h *tunHandler) findRouteFor(dst net.IP) net.Addr {
-	if v, ok := h.routes.Load(ipToTunRouteKey(dst)); ok {
-		return v.(net.Addr)
-	}
-	for _, route := range h.options.IPRoutes {
-		if route.Dest.Contains(dst) && route.Gateway != nil {
-			if v, ok := h.routes.Load(ipToTunRouteKey(route.Gateway)); ok {
-				return v.(net.Addr)
+// writeQueue writes the packets in queue to the tun device until done or the handler is closed,
+// the buffers of the packets are returned to pool.
+func (h *tunHandler) writeQueue(tun net.Conn, queue chan []byte, pool *bufferPool, done <-chan struct{}) error {
+	defer h.releaseQueue(queue, pool)
+	for {
+		select {
+		case b := <-queue:
+			_, err := tun.Write(b)
+			h.mem.release(cap(b))
+			pool.Put(b[:cap(b)])
+			if err != nil {
+				return err
 			}
+		case <-done:
+			return nil
+		case <-h.closed:
+			return nil
 		}
 	}
+}
+
+// Close stops the handler, the tun device and the tunnel connection of the running transport are closed,
+// it waits for the forwarding to stop and then removes all the peers and learned routes.
+// The process is not exited by Handle once the handler is closed.
+func (h *tunHandler) Close() error {
+	h.mu.Lock()
+	select {
+	case <-h.closed:
+		h.mu.Unlock()
+		return nil
+	default:
+		close(h.closed)
+	}
+	tun, conn := h.tun, h.conn
+	h.mu.Unlock()
+
+	// unblock the forwarding goroutines, including the one left by the last transport
+	// which may still be blocked on reading the device.
+	if tun != nil {
+		tun.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	// all the buffers are returned to the pool once the goroutines stop.
+	h.wg.Wait()
+
+	h.peers.Range(func(k, v interface{}) bool {
+		h.removePeer(v.(*tunPeer).addr)
+		return true
+	})
+	// the routes left are learned from the peers no longer known.
+	h.routeMu.Lock()
+	h.routes.Range(func(k, v interface{}) bool {
+		h.routes.Delete(k)
+		return true
+	})
+	atomic.StoreInt32(&h.nroutes, 0)
+	h.routeMu.Unlock()
+	atomic.StoreInt32(&h.limited, 0)
+	h.dups.Range(func(k, v interface{}) bool {
+		h.dups.Delete(k)
+		return true
+	})
 	return nil
 }
 
+func (h *tunHandler) isClosed() bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.Addr) error {
-	errc := make(chan error, 1)
+	h.mu.Lock()
+	if h.isClosed() {
+		h.mu.Unlock()
+		return errors.New("handler is closed")
+	}
+	depth := h.writeQueueDepth()
+	peerDepth := h.options.TunConfig.PerPeerQueue
+	ngo := 2 // the forwarding goroutines
+	if depth > 0 || peerDepth > 0 {
+		ngo++ // the writer of the queue
+	}
+	h.wg.Add(1 + ngo)
+	h.tun, h.conn = tun, conn
+	h.mu.Unlock()
+	defer h.wg.Done()
+	// the connection is not used after the transport stops.
+	defer conn.Close()
+
+	// one for each of the goroutines and the dead peer detection,
+	// so none of them blocks on exit.
+	errc := make(chan error, ngo+1)
+	done := make(chan struct{})
+	defer close(done)
+
+	pool := h.bufferPool()
+
+	var wg sync.WaitGroup
+	wg.Add(ngo)
+
+	// writeTun writes the packet b from the peer addr to the tun device.
+	writeTun := func(b []byte, addr net.Addr) error {
+		_, err := tun.Write(b)
+		return err
+	}
+	if peerDepth > 0 {
+		queue := newTunFairQueue(peerDepth)
+		writeTun = func(b []byte, addr net.Addr) error {
+			bb := pool.Get().([]byte)
+			if !h.mem.reserve(cap(bb), false) {
+				pool.Put(bb)
+				h.memDropped()
+				return nil
+			}
+			if !queue.push(tunAddrKey(addr), append(bb[:0], b...)) {
+				h.mem.release(cap(bb))
+				pool.Put(bb)
+				h.stats.incr(&h.stats.queueDropped, 1)
+			}
+			return nil
+		}
+		go func() {
+			defer h.wg.Done()
+			defer wg.Done()
+			h.lockThread()
+			if err := h.writeFairQueue(tun, queue, pool, done); err != nil {
+				select {
+				case h.chExit <- struct{}{}:
+				default:
+				}
+				errc <- tunDeviceError(err)
+			}
+		}()
+	} else if depth > 0 {
+		queue := make(chan []byte, depth)
+		writeTun = func(b []byte, addr net.Addr) error {
+			bb := pool.Get().([]byte)
+			if !h.mem.reserve(cap(bb), false) {
+				pool.Put(bb)
+				h.memDropped()
+				return nil
+			}
+			select {
+			case queue <- append(bb[:0], b...):
+			default:
+				// tail drop
+				h.mem.release(cap(bb))
+				pool.Put(bb)
+				h.stats.incr(&h.stats.queueDropped, 1)
+			}
+			return nil
+		}
+		go func() {
+			defer h.wg.Done()
+			defer wg.Done()
+			h.lockThread()
+			if err := h.writeQueue(tun, queue, pool, done); err != nil {
+				select {
+				case h.chExit <- struct{}{}:
+				default:
+				}
+				errc <- tunDeviceError(err)
+			}
+		}()
+	}
+
+	// spawn starts a background goroutine of the transport which stops once done is closed,
+	// it is waited for by Close like the forwarding goroutines. The transport holds h.wg until it returns,
+	// so the count is never added from zero while Close is waiting.
+	spawn := func(f func()) {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			f()
+		}()
+	}
+
+	// the server is the only peer on client side.
+	var server *tunPeer
+	if raddr != nil {
+		server = h.peerFor(raddr)
+		if h.options.TunConfig.AnnounceTimeout > 0 {
+			spawn(func() { h.announceRetry(conn, raddr, done) })
+		} else {
+			h.announce(conn, raddr)
+		}
+	} else if h.staticPeer != nil {
+		h.peerFor(h.staticPeer)
+	}
+	if h.options.TunConfig.DPDInterval > 0 {
+		spawn(func() { h.dpd(conn, raddr, errc, done) })
+	}
+	if h.options.TunConfig.StatsEndpoint != "" {
+		spawn(func() { h.reportStats(done) })
+	}
+	if h.options.TunConfig.SummaryInterval > 0 {
+		spawn(func() { h.logSummary(done) })
+	}
+	if h.options.TunConfig.AdaptiveMTU {
+		spawn(func() { h.adjustMTU(done) })
+	}
+	if h.options.TunConfig.PeerIdleTimeout > 0 {
+		spawn(func() { h.reapIdleRoutes(conn, done) })
+	}
+	if h.options.TunConfig.RoutePersist {
+		spawn(func() { h.persistRoutes(done) })
+	}
 
 	go func() {
+		defer h.wg.Done()
+		defer wg.Done()
+		h.lockThread()
 		for {
 			err := func() error {
-				b := sPool.Get().([]byte)
-				defer sPool.Put(b)
+				b := pool.Get().([]byte)
+				defer pool.Put(b)
 
 				n, err := tun.Read(b)
 				if err != nil {
@@ -269,59 +1948,147 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 					case h.chExit <- struct{}{}:
 					default:
 					}
-					return err
+					return tunDeviceError(err)
+				}
+				if h.truncated(tun.LocalAddr(), n, len(b)) {
+					return nil
+				}
+				if n < h.minPacketSize() {
+					h.stats.incr(&h.stats.runts, 1)
+					return h.parseFailed(tun.LocalAddr(), errTunRunt)
 				}
 
 				var src, dst net.IP
+				var proto int
+				var header4 *ipv4.Header
 				if waterutil.IsIPv4(b[:n]) {
 					header, err := ipv4.ParseHeader(b[:n])
 					if err != nil {
-						log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
-						return nil
+						return h.parseFailed(tun.LocalAddr(), err)
 					}
+					header4 = header
 					if Debug {
-						log.Logf("[tun] %s -> %s %-4s %d/%-4d %-4x %d",
-							header.Src, header.Dst, ipProtocol(waterutil.IPv4Protocol(b[:n])),
+						src, dst := flowAddrs(header.Src, header.Dst, header.Protocol, b[header.Len:n])
+						h.logf("%s -> %s %-4s %d/%-4d %-4x %d",
+							src, dst, ipProtocol(waterutil.IPv4Protocol(b[:n])),
 							header.Len, header.TotalLen, header.ID, header.Flags)
 					}
-					src, dst = header.Src, header.Dst
+					src, dst, proto = header.Src, header.Dst, header.Protocol
+
 				} else if waterutil.IsIPv6(b[:n]) {
 					header, err := ipv6.ParseHeader(b[:n])
 					if err != nil {
-						log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
-						return nil
+						return h.parseFailed(tun.LocalAddr(), err)
 					}
 					if Debug {
-						log.Logf("[tun] %s -> %s %s %d %d",
-							header.Src, header.Dst,
+						src, dst := flowAddrs(header.Src, header.Dst, header.NextHeader, b[ipv6.HeaderLen:n])
+						h.logf("%s -> %s %s %d %d",
+							src, dst,
 							ipProtocol(waterutil.IPProtocol(header.NextHeader)),
 							header.PayloadLen, header.TrafficClass)
 					}
-					src, dst = header.Src, header.Dst
+					src, dst, proto = header.Src, header.Dst, header.NextHeader
 				} else {
-					log.Logf("[tun] unknown packet")
+					return h.parseFailed(tun.LocalAddr(), errTunUnknownPacket)
+				}
+
+				if !h.protocolAllowed(proto) {
+					h.stats.incr(&h.stats.protocolDropped, 1)
+					if Debug {
+						h.logf("protocol not allowed: %s -> %s %s",
+							src, dst, ipProtocol(waterutil.IPProtocol(proto)))
+					}
+					return nil
+				}
+
+				if h.options.TunConfig.CompleteChecksums && completeChecksums(b[:n]) {
+					h.checksumCompleted(tun.LocalAddr())
+				}
+				if h.options.TunConfig.DecrementTTL && !h.decrementTTL(tun, b[:n], src, dst) {
+					return nil
+				}
+				if !h.checkFamilyMTU(tun, b[:n], src, dst) {
 					return nil
 				}
+				h.clampMSS(b[:n])
+
+				if router := h.options.TunConfig.Router; router != nil && header4 != nil {
+					if addr, ok := router(header4); ok {
+						if addr == nil {
+							h.stats.incr(&h.stats.routerDropped, 1)
+							if Debug {
+								h.logf("router: drop %s -> %s", src, dst)
+							}
+							return nil
+						}
+						if Debug {
+							h.logf("router: %s -> %s", dst, addr)
+						}
+						return h.writeTo(conn, b[:n], addr)
+					}
+				}
+
+				if routes, _ := h.staticRoutes.Load().(*tunPrefixTrie); routes != nil {
+					if v := routes.lookup(dst); v != nil {
+						if Debug {
+							h.logf("static route: %s -> %s", dst, v)
+						}
+						return h.writeTo(conn, b[:n], v.(net.Addr))
+					}
+				}
 
 				// client side, deliver packet directly.
 				if raddr != nil {
-					_, err := conn.WriteTo(b[:n], raddr)
-					return err
+					return h.writeToPeer(conn, b[:n], server)
 				}
 
-				addr := h.findRouteFor(dst)
-				if addr == nil {
-					log.Logf("[tun] no route for %s -> %s", src, dst)
+				if h.nat != nil && dst.Equal(h.nat.addr) {
+					if !h.nat.reverse(b[:n]) {
+						h.logf("no NAT flow for %s -> %s", src, dst)
+						return nil
+					}
+					dst = waterutil.IPv4Destination(b[:n])
+				}
+
+				if h.staticPeer != nil {
+					return h.writeTo(conn, b[:n], h.staticPeer)
+				}
+
+				if h.options.TunConfig.AllowBroadcast && h.isBroadcast(dst) {
+					if Debug {
+						h.logf("broadcast: %s -> %s", src, dst)
+					}
+					return h.broadcast(conn, b[:n], nil)
+				}
+
+				var addr net.Addr
+				if h.options.TunConfig.Peer != "" {
+					addr = h.pointToPointPeer()
+				} else {
+					addr = h.findRouteFor(dst)
+					if addr != nil && h.options.TunConfig.StrictRouting {
+						if owner := h.routeOwner(src); owner != nil && tunAddrKey(owner) == tunAddrKey(addr) {
+							h.misrouted("drop %s -> %s, sending back to %s owning the source", src, dst, addr)
+							return nil
+						}
+					}
+				}
+				if addr == nil && h.pending != nil && h.options.TunConfig.Peer == "" && h.holdPending(b[:n], dst) {
+					if Debug {
+						h.logf("no route for %s -> %s, hold the packet", src, dst)
+					}
 					return nil
 				}
+				if addr == nil {
+					if addr, err = h.noRoute(tun, conn, b[:n], src, dst); addr == nil {
+						return err
+					}
+				}
 
 				if Debug {
-					log.Logf("[tun] find route: %s -> %s", dst, addr)
-				}
-				if _, err := conn.WriteTo(b[:n], addr); err != nil {
-					return err
+					h.logf("find route: %s -> %s", dst, addr)
 				}
-				return nil
+				return h.writeTo(conn, b[:n], addr)
 			}()
 
 			if err != nil {
@@ -332,79 +2099,158 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 	}()
 
 	go func() {
+		defer h.wg.Done()
+		defer wg.Done()
+		h.lockThread()
 		for {
 			err := func() error {
-				b := sPool.Get().([]byte)
-				defer sPool.Put(b)
+				b := pool.Get().([]byte)
+				defer pool.Put(b)
 
 				n, addr, err := conn.ReadFrom(b)
-				if err != nil &&
-					err != shadowaead.ErrShortPacket {
-					return err
+				if err != nil {
+					if e, ok := err.(*tunDecryptError); ok {
+						return h.decryptFailed(addr, e)
+					}
+					return tunSocketError(err)
+				}
+				if addr == nil {
+					// the connection is connected to the server.
+					if raddr == nil {
+						h.logf("%s: datagram without source address", conn.LocalAddr())
+						return nil
+					}
+					addr = raddr
+				}
+				if h.truncated(addr, n, len(b)) {
+					return nil
+				}
+				if raddr == nil && h.staticPeer != nil && tunAddrKey(addr) != tunAddrKey(h.staticPeer) {
+					h.unknownPeer(addr)
+					return nil
+				}
+
+				h.countRx(h.peerSeen(addr), n)
+				if isTunControl(b[:n]) {
+					if raddr == nil && b[1] == tunCtrlAnnounce {
+						h.learnAnnounce(conn, b[:n], addr)
+						return nil
+					}
+					h.handleControl(conn, b[:n], addr)
+					return nil
+				}
+				if n < h.minPacketSize() {
+					h.stats.incr(&h.stats.runts, 1)
+					return h.parseFailed(addr, errTunRunt)
 				}
 
 				var src, dst net.IP
 				if waterutil.IsIPv4(b[:n]) {
 					header, err := ipv4.ParseHeader(b[:n])
 					if err != nil {
-						log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
-						return nil
+						return h.parseFailed(addr, err)
 					}
 					if Debug {
-						log.Logf("[tun] %s -> %s %-4s %d/%-4d %-4x %d",
-							header.Src, header.Dst, ipProtocol(waterutil.IPv4Protocol(b[:n])),
+						src, dst := flowAddrs(header.Src, header.Dst, header.Protocol, b[header.Len:n])
+						h.logf("%s -> %s %-4s %d/%-4d %-4x %d",
+							src, dst, ipProtocol(waterutil.IPv4Protocol(b[:n])),
 							header.Len, header.TotalLen, header.ID, header.Flags)
 					}
 					src, dst = header.Src, header.Dst
+					var ok bool
+					if n, ok = h.checkIPv4Length(b[:n], addr); !ok {
+						return nil
+					}
+					h.checkMTU(tun, conn, b[:n], n, addr)
 				} else if waterutil.IsIPv6(b[:n]) {
 					header, err := ipv6.ParseHeader(b[:n])
 					if err != nil {
-						log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
-						return nil
+						return h.parseFailed(addr, err)
 					}
 					if Debug {
-						log.Logf("[tun] %s -> %s %s %d %d",
-							header.Src, header.Dst,
+						src, dst := flowAddrs(header.Src, header.Dst, header.NextHeader, b[ipv6.HeaderLen:n])
+						h.logf("%s -> %s %s %d %d",
+							src, dst,
 							ipProtocol(waterutil.IPProtocol(header.NextHeader)),
 							header.PayloadLen, header.TrafficClass)
 					}
 					src, dst = header.Src, header.Dst
+					h.checkMTU(tun, conn, b[:n], ipv6.HeaderLen+header.PayloadLen, addr)
 				} else {
-					log.Logf("[tun] unknown packet")
+					return h.parseFailed(addr, errTunUnknownPacket)
+				}
+
+				if h.loops != nil && h.loops.looped(b[:n]) {
+					h.looped(src, dst, addr)
+					return nil
+				}
+				if h.options.TunConfig.RespondPing && h.ip != nil && icmpEchoReply(b[:n], h.ip) {
+					if Debug {
+						h.logf("echo reply: %s -> %s", h.ip, src)
+					}
+					return h.writeTo(conn, b[:n], addr)
+				}
+				if h.dnsInflight != nil && h.ip != nil && h.forwardDNS(conn, b[:n], addr) {
 					return nil
 				}
 
 				// client side, deliver packet to tun device.
 				if raddr != nil {
-					_, err := tun.Write(b[:n])
-					return err
+					h.learnPathMTU(b[:n])
+					if err := writeTun(b[:n], addr); err != nil {
+						return tunDeviceError(err)
+					}
+					return nil
 				}
 
-				rkey := ipToTunRouteKey(src)
-				if actual, loaded := h.routes.LoadOrStore(rkey, addr); loaded {
-					if actual.(net.Addr).String() != addr.String() {
-						log.Logf("[tun] update route: %s -> %s (old %s)",
-							src, addr, actual.(net.Addr))
-						h.routes.Store(rkey, addr)
+				// the static peer is the only peer, deliver packet to tun device.
+				if h.staticPeer == nil {
+					strict := h.options.TunConfig.StrictRouting && h.options.TunConfig.Peer == ""
+					if strict {
+						if owner := h.routeOwner(src); owner != nil && tunAddrKey(owner) != tunAddrKey(addr) {
+							h.misrouted("drop %s -> %s from %s, the source is routed to %s", src, dst, addr, owner)
+							return nil
+						}
+					}
+					if h.options.TunConfig.Peer != "" {
+						if !h.setPointToPointPeer(addr) {
+							h.unknownPeer(addr)
+							return nil
+						}
+					} else if !h.learnRoute(src, addr) {
+						return nil
+					} else if h.pending != nil {
+						if err := h.flushPending(conn, src, addr); err != nil {
+							return err
+						}
+					}
+
+					if peer := h.findRouteFor(dst); peer != nil {
+						if strict && tunAddrKey(peer) == tunAddrKey(addr) {
+							h.misrouted("drop %s -> %s from %s, relaying back to the sender", src, dst, addr)
+							return nil
+						}
+						if Debug {
+							h.logf("find route: %s -> %s", dst, peer)
+						}
+						return h.writeTo(conn, b[:n], peer)
 					}
-				} else {
-					log.Logf("[tun] new route: %s -> %s", src, addr)
 				}
 
-				if addr := h.findRouteFor(dst); addr != nil {
+				if h.nat != nil && waterutil.IsIPv4(b[:n]) && !h.nat.translate(b[:n]) {
 					if Debug {
-						log.Logf("[tun] find route: %s -> %s", dst, addr)
+						h.logf("SNAT: drop %s -> %s %s",
+							src, dst, ipProtocol(waterutil.IPv4Protocol(b[:n])))
 					}
-					_, err := conn.WriteTo(b[:n], addr)
-					return err
+					return nil
 				}
 
-				if _, err := tun.Write(b[:n]); err != nil {
+				if err := writeTun(b[:n], addr); err != nil {
 					select {
 					case h.chExit <- struct{}{}:
 					default:
 					}
-					return err
+					return tunDeviceError(err)
 				}
 				return nil
 			}()
@@ -416,11 +2262,21 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 		}
 	}()
 
-	err := <-errc
-	if err != nil && err == io.EOF {
-		err = nil
+	var err error
+	select {
+	case err = <-errc:
+	case <-h.closed:
+		// the device and the connection are closed by Close.
+		wg.Wait()
+		h.shutdown(TunShutdownCancelled, nil)
+		return nil
 	}
-	return err
+	e := tunShutdown(err)
+	h.shutdown(e.Reason, e.Err)
+	if e.Err == io.EOF {
+		return nil
+	}
+	return e
 }
 
 var mEtherTypes = map[waterutil.Ethertype]string{
@@ -437,6 +2293,78 @@ func etherType(et waterutil.Ethertype) string {
 	return fmt.Sprintf("unknown(%v)", et)
 }
 
+const (
+	etherTypeVLAN = 0x8100 // 802.1Q
+	etherTypeQinQ = 0x88a8 // 802.1ad
+	tapHeaderLen  = 14
+	tapVLANTagLen = 4
+	tapMaxVLANID  = 4094
+)
+
+// tapFrameType returns the EtherType of the Ethernet frame b and its VLAN ID, inside the VLAN tags if any,
+// the VLAN ID is of the outer tag, and zero for the untagged frame. ok is false if the frame is too short.
+func tapFrameType(b []byte) (et waterutil.Ethertype, vlan int, ok bool) {
+	if len(b) < tapHeaderLen {
+		return
+	}
+	off := 12
+	for {
+		t := binary.BigEndian.Uint16(b[off:])
+		if t != etherTypeVLAN && t != etherTypeQinQ {
+			break
+		}
+		if len(b) < off+2+tapVLANTagLen {
+			return
+		}
+		if vlan == 0 {
+			vlan = int(binary.BigEndian.Uint16(b[off+2:]) & 0x0fff)
+		}
+		off += tapVLANTagLen
+	}
+	return waterutil.Ethertype{b[off], b[off+1]}, vlan, true
+}
+
+// tapIsFlood reports whether the frame to the MAC address dst is flooded to all the peers,
+// which are the broadcast (e.g. ARP request) and multicast (e.g. IPv6 neighbor discovery) frames.
+func tapIsFlood(dst net.HardwareAddr) bool {
+	return len(dst) > 0 && dst[0]&0x01 != 0
+}
+
+// allowFrame reports whether the Ethernet frame b is forwarded, see TapConfig.AllowedVLANs and DropUnknownEtherTypes.
+func (h *tapHandler) allowFrame(b []byte) bool {
+	et, vlan, ok := tapFrameType(b)
+	if !ok {
+		if Debug {
+			log.Logf("[tap] drop short frame of %d bytes", len(b))
+		}
+		return false
+	}
+
+	cfg := &h.options.TapConfig
+	if vlan != 0 && len(cfg.AllowedVLANs) > 0 {
+		allowed := false
+		for _, id := range cfg.AllowedVLANs {
+			if id == vlan {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			if Debug {
+				log.Logf("[tap] drop frame of VLAN %d", vlan)
+			}
+			return false
+		}
+	}
+	if _, known := mEtherTypes[et]; !known && cfg.DropUnknownEtherTypes {
+		if Debug {
+			log.Logf("[tap] drop frame of %s", etherType(et))
+		}
+		return false
+	}
+	return true
+}
+
 // TapConfig is the config for TAP device.
 type TapConfig struct {
 	Name    string
@@ -444,6 +2372,17 @@ type TapConfig struct {
 	MTU     int
 	Routes  []string
 	Gateway string
+	// Bridge is the name of an existing Linux bridge (e.g. br0) the device is attached to,
+	// so the tunneled L2 traffic joins the local Ethernet segment of the bridge.
+	// The device is detached when it is closed. It is only supported on Linux.
+	Bridge string
+	// AllowedVLANs are the IDs (1-4094) of the 802.1Q VLANs whose tagged frames are forwarded,
+	// the tagged frames of other VLANs are dropped, the untagged frames are always forwarded.
+	// Empty means the frames of all the VLANs are forwarded.
+	AllowedVLANs []int
+	// DropUnknownEtherTypes drops the frames whose EtherType (inside the VLAN tag if any)
+	// is not IPv4, IPv6, ARP or RARP, instead of forwarding them.
+	DropUnknownEtherTypes bool
 }
 
 type tapRouteKey [6]byte
@@ -462,6 +2401,10 @@ type tapListener struct {
 
 // TapListener creates a listener for tap tunnel.
 func TapListener(cfg TapConfig) (Listener, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	threads := 1
 	ln := &tapListener{
 		conns:  make(chan net.Conn, threads),
@@ -648,6 +2591,9 @@ func (h *tapHandler) transportTap(tap net.Conn, conn net.PacketConn, raddr net.A
 					return err
 				}
 
+				if !h.allowFrame(b[:n]) {
+					return nil
+				}
 				src := waterutil.MACSource(b[:n])
 				dst := waterutil.MACDestination(b[:n])
 				eType := etherType(waterutil.MACEthertype(b[:n]))
@@ -662,10 +2608,12 @@ func (h *tapHandler) transportTap(tap net.Conn, conn net.PacketConn, raddr net.A
 					return err
 				}
 
-				// server side, broadcast.
-				if waterutil.IsBroadcast(dst) {
+				// server side, broadcast and multicast.
+				if tapIsFlood(dst) {
+					// the buffer is returned to the pool before the flood completes.
+					frame := append([]byte(nil), b[:n]...)
 					go h.routes.Range(func(k, v interface{}) bool {
-						conn.WriteTo(b[:n], v.(net.Addr))
+						conn.WriteTo(frame, v.(net.Addr))
 						return true
 					})
 					return nil
@@ -705,6 +2653,9 @@ func (h *tapHandler) transportTap(tap net.Conn, conn net.PacketConn, raddr net.A
 					return err
 				}
 
+				if !h.allowFrame(b[:n]) {
+					return nil
+				}
 				src := waterutil.MACSource(b[:n])
 				dst := waterutil.MACDestination(b[:n])
 				eType := etherType(waterutil.MACEthertype(b[:n]))
@@ -731,10 +2682,11 @@ func (h *tapHandler) transportTap(tap net.Conn, conn net.PacketConn, raddr net.A
 					log.Logf("[tap] new route: %s -> %s", src, addr)
 				}
 
-				if waterutil.IsBroadcast(dst) {
+				if tapIsFlood(dst) {
+					frame := append([]byte(nil), b[:n]...)
 					go h.routes.Range(func(k, v interface{}) bool {
 						if k.(tapRouteKey) != rkey {
-							conn.WriteTo(b[:n], v.(net.Addr))
+							conn.WriteTo(frame, v.(net.Addr))
 						}
 						return true
 					})
@@ -772,21 +2724,150 @@ func (h *tapHandler) transportTap(tap net.Conn, conn net.PacketConn, raddr net.A
 	return err
 }
 
+// errorReporter is implemented by the connections that can propagate
+// a fatal error back to the listener they were accepted from, see isTunFatalError.
+type errorReporter interface {
+	reportError(err error)
+}
+
 type tunTapConn struct {
-	ifce *water.Interface
-	addr net.Addr
+	ifce     *water.Interface
+	addr     net.Addr
+	errFunc  func(error)
+	cleanups []func()
+	mu       sync.Mutex            // protects cleanups and routes
+	routes   map[string]*net.IPNet // the routes added at runtime
+	reused   *tunDeviceInfo        // the settings of the reused existing device
+	addrs    []net.Addr            // all the addresses read back from the device
+	persist  bool                  // the device is kept after it is closed, see TunConfig.Persist
+	once     sync.Once             // runs Close once
+	closeErr error                 // the error of Close
+}
+
+// tunDeviceInfo is the settings read from an existing device.
+type tunDeviceInfo struct {
+	addr string // CIDR
+	mtu  int
+}
+
+// tunInterfaceAddr returns the address of the interface itf, IPv4 is preferred.
+func tunInterfaceAddr(itf *net.Interface) (net.IP, *net.IPNet, error) {
+	addrs, err := itf.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	ip, ipNet := tunPrimaryAddr(addrs, nil)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("no address on device %s", itf.Name)
+	}
+	return ip, ipNet, nil
+}
+
+// tunPrimaryAddr returns the primary address in the addresses of a device, which is prefer if present,
+// otherwise the first one not link-local, IPv4 is preferred. It returns nil if there is none.
+func tunPrimaryAddr(addrs []net.Addr, prefer net.IP) (net.IP, *net.IPNet) {
+	var ip net.IP
+	var ipNet *net.IPNet
+	for _, addr := range addrs {
+		a, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if prefer != nil && a.IP.Equal(prefer) {
+			return a.IP, &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+		}
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip == nil || ip.To4() == nil && a.IP.To4() != nil {
+			ip, ipNet = a.IP, &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+		}
+	}
+	return ip, ipNet
+}
+
+// readAddrs reads back the addresses actually configured on the device itf after it is set up,
+// the primary one becomes the LocalAddr, which is the configured address unless it is not on the device.
+func (c *tunTapConn) readAddrs(itf *net.Interface) error {
+	addrs, err := itf.Addrs()
+	if err != nil {
+		return err
+	}
+	var prefer net.IP
+	if a, ok := c.addr.(*net.IPAddr); ok {
+		prefer = a.IP
+	}
+	if ip, _ := tunPrimaryAddr(addrs, prefer); ip != nil {
+		c.addr = &net.IPAddr{IP: ip}
+	}
+	c.addrs = c.addrs[:0]
+	for _, addr := range addrs {
+		if a, ok := addr.(*net.IPNet); ok {
+			c.addrs = append(c.addrs, &net.IPAddr{IP: a.IP})
+		}
+	}
+	return nil
+}
+
+// Addrs returns all the addresses of the device read back after it is set up,
+// the first one is the LocalAddr if they can not be read.
+func (c *tunTapConn) Addrs() []net.Addr {
+	if len(c.addrs) == 0 {
+		return []net.Addr{c.addr}
+	}
+	return append([]net.Addr(nil), c.addrs...)
 }
 
 func (c *tunTapConn) Read(b []byte) (n int, err error) {
-	return c.ifce.Read(b)
+	n, err = c.ifce.Read(b)
+	if err != nil {
+		c.reportError(err)
+	}
+	return
+}
+
+func (c *tunTapConn) reportError(err error) {
+	if c.errFunc != nil && err != nil {
+		c.errFunc(err)
+	}
 }
 
 func (c *tunTapConn) Write(b []byte) (n int, err error) {
 	return c.ifce.Write(b)
 }
 
-func (c *tunTapConn) Close() (err error) {
-	return c.ifce.Close()
+// Close runs the cleanups in the reverse order they were added, then closes the device.
+// It is safe to call concurrently, e.g. by the handler and the signal handler, the cleanups are run once.
+func (c *tunTapConn) Close() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		cleanups := c.cleanups
+		c.cleanups = nil
+		c.mu.Unlock()
+
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+		c.closeErr = c.ifce.Close()
+	})
+	return c.closeErr
+}
+
+// addCleanup adds a function called when the device is closed.
+func (c *tunTapConn) addCleanup(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cleanups = append(c.cleanups, f)
+}
+
+// deleteDevice deletes the persistent device after it is closed.
+func (c *tunTapConn) deleteDevice() error {
+	return deleteTunDevice(c.ifce.Name())
+}
+
+// SetMTU changes the MTU of the device.
+func (c *tunTapConn) SetMTU(mtu int) error {
+	return setTunMTU(c.ifce.Name(), mtu)
 }
 
 func (c *tunTapConn) LocalAddr() net.Addr {
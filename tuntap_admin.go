@@ -0,0 +1,223 @@
+package gost
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AddStaticRoute adds the static route of the network cidr to the peer addr (host:port) at runtime,
+// it replaces the route of the same network, see TunConfig.StaticRoutes.
+func (h *tunHandler) AddStaticRoute(cidr, addr string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid static route %s: %v", cidr, err)
+	}
+	peer, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("invalid static route %s: %v", cidr, err)
+	}
+
+	h.staticMu.Lock()
+	defer h.staticMu.Unlock()
+	if h.staticMap == nil {
+		h.staticMap = make(map[string]net.Addr)
+	}
+	h.staticMap[ipNet.String()] = peer
+	h.buildStaticRoutes()
+	return nil
+}
+
+// RemoveStaticRoute removes the static route of the network cidr.
+func (h *tunHandler) RemoveStaticRoute(cidr string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	h.staticMu.Lock()
+	defer h.staticMu.Unlock()
+	if _, ok := h.staticMap[ipNet.String()]; !ok {
+		return fmt.Errorf("no static route %s", ipNet)
+	}
+	delete(h.staticMap, ipNet.String())
+	h.buildStaticRoutes()
+	return nil
+}
+
+// StaticRoutes returns the static routes, the networks to the addresses of the peers.
+func (h *tunHandler) StaticRoutes() map[string]string {
+	h.staticMu.Lock()
+	defer h.staticMu.Unlock()
+
+	routes := make(map[string]string, len(h.staticMap))
+	for dest, addr := range h.staticMap {
+		routes[dest] = addr.String()
+	}
+	return routes
+}
+
+// buildStaticRoutes rebuilds the trie of the static routes from staticMap, as the trie is not safe
+// for concurrent modification, the packets are routed by the old trie until the new one is stored.
+// It is called with staticMu held.
+func (h *tunHandler) buildStaticRoutes() {
+	var routes *tunPrefixTrie
+	if len(h.staticMap) > 0 {
+		routes = &tunPrefixTrie{}
+		for dest, addr := range h.staticMap {
+			_, ipNet, _ := net.ParseCIDR(dest)
+			routes.insert(ipNet, addr)
+		}
+	}
+	h.staticRoutes.Store(routes)
+}
+
+// DropPeer removes the peer of the outer address addr and all the routes to it.
+func (h *tunHandler) DropPeer(addr string) error {
+	key := addr
+	if a, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		key = tunAddrKey(a)
+	}
+	v, ok := h.peers.Load(key)
+	if !ok {
+		return fmt.Errorf("no peer %s", addr)
+	}
+	peer := v.(*tunPeer)
+	ips := h.removePeer(peer.addr)
+	h.logf("drop peer %s, routes: %v", peer.addr, ips)
+	return nil
+}
+
+// listenAdmin listens on TunConfig.AdminSocket and serves the admin commands until the handler is closed.
+// The stale socket file left by a previous process is removed.
+func (h *tunHandler) listenAdmin() error {
+	path := h.options.TunConfig.AdminSocket
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// the commands can drop the peers, so the socket is only accessible by the owner.
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	h.logf("admin socket %s", path)
+
+	go func() {
+		<-h.closed
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !h.isClosed() {
+					h.logf("admin socket %s: %v", path, err)
+				}
+				return
+			}
+			go h.serveAdmin(conn)
+		}
+	}()
+	return nil
+}
+
+var errTunAdminUsage = errors.New("invalid command, try help")
+
+const tunAdminHelp = `peers                    list the peers: addr user=... ips=...,... rtt=...
+stats                    show the stats line
+routes                   list the static routes: cidr addr
+route add <cidr> <addr>  add the static route of the network cidr to the peer addr (host:port)
+route del <cidr>         remove the static route of the network cidr
+drop <addr>              drop the peer of the outer address addr and the routes to it
+quit                     close the connection`
+
+// serveAdmin serves the admin commands on conn. The protocol is line-based text:
+// each command is a line, and the reply is the lines of the result followed by a line of "OK",
+// or a line of "ERR <message>" if the command fails. The commands are listed by "help".
+// The output of "routes" is in the form of the arguments of "route add", so it can be imported
+// to another instance.
+func (h *tunHandler) serveAdmin(conn net.Conn) {
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		args := strings.Fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" {
+			return
+		}
+
+		lines, err := h.adminCommand(args)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		if err != nil {
+			fmt.Fprintln(w, "ERR", err)
+		} else {
+			fmt.Fprintln(w, "OK")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && err != io.EOF {
+		h.logf("admin %s: %v", conn.LocalAddr(), err)
+	}
+}
+
+// adminCommand runs the admin command of args, and returns the lines of the result.
+func (h *tunHandler) adminCommand(args []string) (lines []string, err error) {
+	switch {
+	case args[0] == "help":
+		return strings.Split(tunAdminHelp, "\n"), nil
+	case args[0] == "peers" && len(args) == 1:
+		rtts := make(map[string]time.Duration)
+		for _, st := range h.Stats().Peers {
+			rtts[tunAddrKey(st.Addr)] = st.RTT
+		}
+		for _, peer := range h.Peers() {
+			ips := make([]string, len(peer.IPs))
+			for i, ip := range peer.IPs {
+				ips[i] = ip.String()
+			}
+			sort.Strings(ips)
+			user := peer.User
+			if user == "" {
+				user = "-"
+			}
+			lines = append(lines, fmt.Sprintf("%s user=%s ips=%s rtt=%s",
+				peer.Addr, user, strings.Join(ips, ","), rtts[tunAddrKey(peer.Addr)]))
+		}
+		sort.Strings(lines)
+		return lines, nil
+	case args[0] == "stats" && len(args) == 1:
+		return []string{h.Stats().String()}, nil
+	case args[0] == "routes" && len(args) == 1:
+		for dest, addr := range h.StaticRoutes() {
+			lines = append(lines, dest+" "+addr)
+		}
+		sort.Strings(lines)
+		return lines, nil
+	case args[0] == "route" && len(args) == 4 && args[1] == "add":
+		return nil, h.AddStaticRoute(args[2], args[3])
+	case args[0] == "route" && len(args) == 3 && args[1] == "del":
+		return nil, h.RemoveStaticRoute(args[2])
+	case args[0] == "drop" && len(args) == 2:
+		return nil, h.DropPeer(args[1])
+	default:
+		return nil, errTunAdminUsage
+	}
+}
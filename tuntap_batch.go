@@ -0,0 +1,75 @@
+package gost
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const maxTunUDPBatch = 1024
+
+// tunBatchReader reads a batch of datagrams, it is implemented by both ipv4.PacketConn and ipv6.PacketConn.
+type tunBatchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// tunBatchConn reads the datagrams of the UDP socket in batches, see TunConfig.UDPBatch.
+// ReadFrom returns the datagrams of the last batch in turn, and reads the next batch once they are all returned.
+type tunBatchConn struct {
+	*net.UDPConn
+	r    tunBatchReader
+	mu   sync.Mutex
+	msgs []ipv4.Message
+	n    int // the number of the datagrams of the last batch
+	next int // the next datagram to return
+}
+
+// newTunBatchConn creates the batched reader of uc reading up to n datagrams of size bytes at a time.
+func newTunBatchConn(uc *net.UDPConn, n, size int) *tunBatchConn {
+	c := &tunBatchConn{
+		UDPConn: uc,
+		msgs:    make([]ipv4.Message, n),
+	}
+	if addr, ok := uc.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		c.r = ipv4.NewPacketConn(uc)
+	} else {
+		c.r = ipv6.NewPacketConn(uc)
+	}
+	buf := make([]byte, n*size)
+	for i := range c.msgs {
+		c.msgs[i].Buffers = [][]byte{buf[i*size : (i+1)*size]}
+	}
+	return c
+}
+
+func (c *tunBatchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.next >= c.n {
+		n, err := c.r.ReadBatch(c.msgs, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.n, c.next = n, 0
+	}
+	m := &c.msgs[c.next]
+	c.next++
+	return copy(b, m.Buffers[0][:m.N]), m.Addr, nil
+}
+
+// batchConn returns the batched reader of the tunnel socket pc if TunConfig.UDPBatch is set.
+func (h *tunHandler) batchConn(pc net.PacketConn) net.PacketConn {
+	n := h.options.TunConfig.UDPBatch
+	if n <= 1 {
+		return pc
+	}
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		h.logf("%s: batched read is only supported on UDP socket", pc.LocalAddr())
+		return pc
+	}
+	return newTunBatchConn(uc, n, h.bufferSize())
+}
@@ -0,0 +1,533 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	tunMinMTU = 576
+	tunMaxMTU = 65535
+	// tunHeaderOverhead is the worst case overhead of the outer headers: IPv6 header (40),
+	// TCP header of fake TCP (20, UDP is 8).
+	tunHeaderOverhead = 40 + 20
+	// tunMaxCipherOverhead is the largest salt (32) and tag (16) of the AEAD ciphers,
+	// used when the cipher is unknown, see TunConfig.Cipher.
+	tunMaxCipherOverhead = 32 + 16
+	// tunOverhead is the worst case overhead of the tunnel.
+	tunOverhead     = tunHeaderOverhead + tunMaxCipherOverhead
+	defaultOuterMTU = 1500
+	tunMaxAliasLen  = 255 // IFALIASZ - 1
+)
+
+// mtu returns the MTU of the device.
+func (cfg *TunConfig) mtu() int {
+	if cfg.AutoInnerMTU {
+		mtu := cfg.outerMTU() - tunHeaderOverhead - cfg.cipherOverhead()
+		if cfg.ClearHeader {
+			mtu -= tunClearHeaderLen
+		}
+		if cfg.SessionID {
+			mtu -= tunSessionIDLen
+		}
+		if cfg.Padding > 0 {
+			mtu -= tunPaddingTrailerLen
+		}
+		return mtu - cfg.Obfs.overhead()
+	}
+	if cfg.MTU > 0 {
+		return cfg.MTU
+	}
+	return DefaultMTU
+}
+
+// cipherOverhead returns the overhead of the cipher in each datagram,
+// which is the worst case if the cipher is unknown.
+func (cfg *TunConfig) cipherOverhead() int {
+	if cfg.Cipher == "" {
+		return tunMaxCipherOverhead
+	}
+	n, err := tunCipherOverhead(cfg.Cipher)
+	if err != nil {
+		return tunMaxCipherOverhead
+	}
+	return n
+}
+
+// tunCipherOverheads caches the overheads of the cipher methods, as picking a cipher derives the key.
+var tunCipherOverheads sync.Map
+
+// tunCipherOverhead returns the overhead of the cipher method in each datagram,
+// which is the salt and the tag of an AEAD cipher.
+func tunCipherOverhead(method string) (int, error) {
+	if v, ok := tunCipherOverheads.Load(method); ok {
+		return v.(int), nil
+	}
+	cipher, err := core.PickCipher(method, nil, "overhead")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if c, ok := cipher.(shadowaead.Cipher); ok {
+		salt := make([]byte, c.SaltSize())
+		aead, err := c.Encrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+		n = len(salt) + aead.Overhead()
+	}
+	tunCipherOverheads.Store(method, n)
+	return n, nil
+}
+
+// owner returns the owner of the device, which is RunAsUser by default.
+func (cfg *TunConfig) owner() string {
+	if cfg.Owner != "" {
+		return cfg.Owner
+	}
+	return cfg.RunAsUser
+}
+
+func (cfg *TunConfig) outerMTU() int {
+	if cfg.OuterMTU > 0 {
+		return cfg.OuterMTU
+	}
+	return defaultOuterMTU
+}
+
+// maxTunCPU is the number of the CPUs in the affinity mask of the kernel (CPU_SETSIZE).
+const maxTunCPU = 1024
+
+// ParseTunConfig parses the TunConfig from the JSON or YAML document read from r, and validates it.
+// The keys are the field names of TunConfig, matched case-insensitively, e.g.
+//
+//	{
+//		"name": "tun0",
+//		"addr": "192.168.123.1/24",
+//		"mtu": 1350,
+//		"routes": ["10.100.0.0/16", "172.20.0.0/16 192.168.123.2"],
+//		"dpdInterval": "10s"
+//	}
+//
+// A route is a string of the destination network optionally followed by a gateway,
+// a duration can be either a string accepted by time.ParseDuration or a number of nanoseconds.
+// or in YAML:
+//
+//	name: tun0
+//	addr: 192.168.123.1/24
+//	mtu: 1350
+//	routes:
+//	  - 10.100.0.0/16
+//	  - 172.20.0.0/16 192.168.123.2
+//	dpdInterval: 10s
+//
+// The document which is not valid JSON is parsed as YAML, then both are decoded and validated in the same way.
+func ParseTunConfig(r io.Reader) (TunConfig, error) {
+	var cfg TunConfig
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return cfg, err
+	}
+
+	if !json.Valid(data) {
+		if data, err = yamlToJSON(data); err != nil {
+			return cfg, err
+		}
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return cfg, err
+	}
+	if err := parseJSONDurations(reflect.TypeOf(cfg), m); err != nil {
+		return cfg, err
+	}
+	if data, err = json.Marshal(m); err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// yamlToJSON converts the YAML document data to JSON.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := yamlJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// yamlJSONValue converts the maps keyed by interface{} in the YAML value v to the maps keyed by string,
+// which can be marshaled to JSON.
+func yamlJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("yaml: key %v is not a string", k)
+			}
+			e, err := yamlJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[s] = e
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			e, err := yamlJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+	}
+	return v, nil
+}
+
+// parseJSONDurations converts the duration strings in m to nanoseconds
+// for the fields of time.Duration type in struct type t.
+func parseJSONDurations(t reflect.Type, m map[string]json.RawMessage) error {
+	durationType := reflect.TypeOf(time.Duration(0))
+	for k, v := range m {
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			continue
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Type != durationType || !strings.EqualFold(f.Name, k) {
+				continue
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			m[k] = json.RawMessage(fmt.Sprintf("%d", d))
+		}
+	}
+	return nil
+}
+
+// Validate checks the config without side effects, so the mistakes are reported
+// before the device is created. It returns the first error found.
+func (cfg *TunConfig) Validate() error {
+	if cfg.ReuseExisting {
+		if cfg.Name == "" {
+			return errors.New("tun: name is required to reuse an existing device")
+		}
+	} else if cfg.Addr == "" {
+		return errors.New("tun: addr is required")
+	}
+	if cfg.GroupAccess {
+		if cfg.Group == "" {
+			return errors.New("tun: group is required for group access")
+		}
+		if !cfg.Persist && !cfg.ReuseExisting {
+			return errors.New("tun: group access requires a persistent device")
+		}
+	}
+	var ip net.IP
+	if cfg.Addr != "" {
+		var err error
+		if ip, _, err = net.ParseCIDR(cfg.Addr); err != nil {
+			return fmt.Errorf("tun: addr: %v", err)
+		}
+	}
+	if len(cfg.Alias) > tunMaxAliasLen || strings.ContainsAny(cfg.Alias, "\r\n") {
+		return fmt.Errorf("tun: invalid alias %q", cfg.Alias)
+	}
+	if cfg.Peer != "" && net.ParseIP(cfg.Peer) == nil {
+		return fmt.Errorf("tun: invalid peer %s", cfg.Peer)
+	}
+	if cfg.MTU != 0 && (cfg.MTU < tunMinMTU || cfg.MTU > tunMaxMTU) {
+		return fmt.Errorf("tun: MTU %d out of range [%d, %d]", cfg.MTU, tunMinMTU, tunMaxMTU)
+	}
+	if mtu := cfg.mtu(); cfg.MTU4 != 0 && (cfg.MTU4 < tunMinPMTU4 || cfg.MTU4 > mtu) {
+		return fmt.Errorf("tun: IPv4 MTU %d out of range [%d, %d]", cfg.MTU4, tunMinPMTU4, mtu)
+	}
+	if mtu := cfg.mtu(); cfg.MTU6 != 0 && (cfg.MTU6 < tunMinPMTU6 || cfg.MTU6 > mtu) {
+		return fmt.Errorf("tun: IPv6 MTU %d out of range [%d, %d]", cfg.MTU6, tunMinPMTU6, mtu)
+	}
+	if cfg.OuterMTU < 0 || cfg.OuterMTU > tunMaxMTU {
+		return fmt.Errorf("tun: outer MTU %d out of range [0, %d]", cfg.OuterMTU, tunMaxMTU)
+	}
+	if cfg.AutoInnerMTU && cfg.mtu() < tunMinMTU {
+		return fmt.Errorf("tun: outer MTU %d is too small for the inner MTU %d", cfg.outerMTU(), tunMinMTU)
+	}
+	if cfg.UDPBatch < 0 || cfg.UDPBatch > maxTunUDPBatch {
+		return fmt.Errorf("tun: UDP batch %d out of range [0, %d]", cfg.UDPBatch, maxTunUDPBatch)
+	}
+	if cfg.BufferSize < 0 {
+		return errors.New("tun: negative buffer size")
+	}
+	if mtu := cfg.mtu(); cfg.BufferSize > 0 {
+		if cfg.BufferSize < mtu {
+			return fmt.Errorf("tun: buffer size %d is smaller than MTU %d", cfg.BufferSize, mtu)
+		}
+	}
+	for _, route := range cfg.Routes {
+		if route.Dest == nil {
+			return errors.New("tun: route without destination")
+		}
+		if route.Gateway != nil && (route.Dest.IP.To4() == nil) != (route.Gateway.To4() == nil) {
+			return fmt.Errorf("tun: route %s: gateway of different address family", route)
+		}
+	}
+	if cfg.Gateway != "" && net.ParseIP(cfg.Gateway) == nil {
+		return fmt.Errorf("tun: invalid gateway %s", cfg.Gateway)
+	}
+	if cfg.OuterDSCP < 0 || cfg.OuterDSCP > 63 {
+		return fmt.Errorf("tun: DSCP %d out of range [0, 63]", cfg.OuterDSCP)
+	}
+	if cfg.SNAT != "" {
+		nat := net.ParseIP(cfg.SNAT)
+		if nat.To4() == nil {
+			return fmt.Errorf("tun: invalid SNAT address %s", cfg.SNAT)
+		}
+		if nat.Equal(ip) {
+			return errors.New("tun: SNAT address must not be the address of the device")
+		}
+	}
+	if cfg.StaticPeer != "" {
+		if _, err := net.ResolveUDPAddr("udp", cfg.StaticPeer); err != nil {
+			return fmt.Errorf("tun: static peer: %v", err)
+		}
+	}
+	for dest, addr := range cfg.StaticRoutes {
+		if _, _, err := net.ParseCIDR(dest); err != nil {
+			return fmt.Errorf("tun: static route: %v", err)
+		}
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("tun: static route %s: %v", dest, err)
+		}
+	}
+	if cfg.DNSForward != "" {
+		if host, _, err := net.SplitHostPort(cfg.dnsUpstream()); err != nil || host == "" {
+			return fmt.Errorf("tun: invalid DNS upstream %s", cfg.DNSForward)
+		}
+	}
+	if err := cfg.Obfs.validate(); err != nil {
+		return fmt.Errorf("tun: %v", err)
+	}
+	if cfg.Padding < 0 || cfg.Padding > cfg.mtu() {
+		return fmt.Errorf("tun: padding %d out of range [0, %d]", cfg.Padding, cfg.mtu())
+	}
+	if s := cfg.SourcePortRange; s != "" {
+		if ports, err := ParsePortRange(s); err != nil || ports.Min == 0 {
+			return fmt.Errorf("tun: invalid source port range %s", s)
+		}
+	}
+	if _, ok := cfg.Transporter.(*connTunTransporter); ok && (len(cfg.ListenAddrs) > 0 || cfg.SourcePortRange != "") {
+		return errors.New("tun: the transporter of a connection can not bind the listen addresses or the source port")
+	}
+	if cfg.RemoteSRVInterval < 0 {
+		return errors.New("tun: negative SRV interval")
+	}
+	if cfg.StatsInterval < 0 {
+		return errors.New("tun: negative stats interval")
+	}
+	if cfg.ExitGracePeriod < 0 {
+		return errors.New("tun: negative exit grace period")
+	}
+	if cfg.SummaryInterval < 0 {
+		return errors.New("tun: negative summary interval")
+	}
+	if cfg.NATInterface != "" && !cfg.AutoNAT {
+		return errors.New("tun: NAT interface requires AutoNAT")
+	}
+	if cfg.RestoreIPForward && !cfg.EnableIPForward {
+		return errors.New("tun: restoring IP forwarding requires EnableIPForward")
+	}
+	if cfg.DPDInterval < 0 || cfg.DPDMaxMiss < 0 {
+		return errors.New("tun: negative dead peer detection setting")
+	}
+	if cfg.AnnounceTimeout < 0 {
+		return errors.New("tun: negative announce timeout")
+	}
+	if cfg.PeerIdleTimeout < 0 {
+		return errors.New("tun: negative peer idle timeout")
+	}
+	if cfg.MeasureLatency && cfg.DPDInterval == 0 {
+		return errors.New("tun: latency measurement requires dead peer detection")
+	}
+	if cfg.CreateRetries < 0 {
+		return errors.New("tun: negative create retries")
+	}
+	for _, proto := range cfg.AllowedProtocols {
+		if proto < 0 || proto > 255 {
+			return fmt.Errorf("tun: protocol %d out of range [0, 255]", proto)
+		}
+	}
+	if cfg.ThreadPriority < -20 || cfg.ThreadPriority > 19 {
+		return fmt.Errorf("tun: thread priority %d out of range [-20, 19]", cfg.ThreadPriority)
+	}
+	for _, cpu := range cfg.CPUAffinity {
+		if cpu < 0 || cpu >= maxTunCPU {
+			return fmt.Errorf("tun: CPU %d out of range [0, %d]", cpu, maxTunCPU-1)
+		}
+	}
+	if cfg.MaxMemory < 0 {
+		return errors.New("tun: negative memory budget")
+	}
+	if cfg.SendRetry < 0 {
+		return errors.New("tun: negative send retry")
+	}
+	if cfg.WriteQueue < 0 {
+		return errors.New("tun: negative write queue")
+	}
+	for _, d := range []*TunDirectionConfig{&cfg.Upstream, &cfg.Downstream} {
+		if d.SockBuffer < 0 || d.Queue < 0 {
+			return errors.New("tun: negative direction buffer setting")
+		}
+	}
+	if q := cfg.Downstream.Queue; q > 0 && cfg.WriteQueue > 0 && q != cfg.WriteQueue {
+		return errors.New("tun: downstream queue and write queue mismatch")
+	}
+	if cfg.Upstream.Queue > 0 && cfg.PreserveTOS {
+		return errors.New("tun: upstream queue and preserve ToS are mutually exclusive")
+	}
+	if cfg.PendingBuffer < 0 || cfg.PendingTimeout < 0 {
+		return errors.New("tun: negative pending buffer setting")
+	}
+	if cfg.MinPacketSize < 0 || cfg.MinPacketSize > tunMaxMTU {
+		return fmt.Errorf("tun: minimum packet size %d out of range [0, %d]", cfg.MinPacketSize, tunMaxMTU)
+	}
+	if cfg.MaxParseErrors < 0 || cfg.ParseErrorWindow < 0 {
+		return errors.New("tun: negative parse error setting")
+	}
+	if cfg.PerPeerQueue < 0 {
+		return errors.New("tun: negative per peer queue")
+	}
+	if cfg.InlineWrite && (cfg.writeQueue() > 0 || cfg.PerPeerQueue > 0) {
+		return errors.New("tun: inline write and write queue are mutually exclusive")
+	}
+	if cfg.PerPeerQueue > 0 && cfg.writeQueue() > 0 {
+		return errors.New("tun: write queue and per peer queue are mutually exclusive")
+	}
+	if cfg.MaxPeers < 0 {
+		return errors.New("tun: negative max peers")
+	}
+	if cfg.Cipher != "" {
+		if _, err := tunCipherOverhead(cfg.Cipher); err != nil {
+			return fmt.Errorf("tun: cipher %s: %v", cfg.Cipher, err)
+		}
+	}
+	switch cfg.DuplicateIPPolicy {
+	case "", TunDuplicateLastWins, TunDuplicateFirstWins, TunDuplicateReject:
+	default:
+		return fmt.Errorf("tun: unknown duplicate IP policy %q", cfg.DuplicateIPPolicy)
+	}
+	if cfg.MTUAdjustWindow < 0 {
+		return errors.New("tun: negative MTU adjust window")
+	}
+	if cfg.DuplicateIPWindow < 0 {
+		return errors.New("tun: negative duplicate IP window")
+	}
+	if cfg.PrewarmBuffers < 0 {
+		return errors.New("tun: negative prewarm buffers")
+	}
+	if cfg.LoopDetect < 0 {
+		return errors.New("tun: negative loop detection size")
+	}
+	if cfg.LoopWindow < 0 {
+		return errors.New("tun: negative loop detection window")
+	}
+	switch cfg.NoRouteAction {
+	case "", TunNoRouteDrop, TunNoRouteICMP, TunNoRouteFlood:
+	case TunNoRouteGateway:
+		if net.ParseIP(cfg.DefaultPeer) == nil {
+			return fmt.Errorf("tun: invalid default peer %q", cfg.DefaultPeer)
+		}
+		if cfg.Peer != "" {
+			return errors.New("tun: no route gateway and point-to-point peer are mutually exclusive")
+		}
+	default:
+		return fmt.Errorf("tun: unknown no route action %q", cfg.NoRouteAction)
+	}
+	if cfg.DefaultPeer != "" && cfg.NoRouteAction != TunNoRouteGateway {
+		return errors.New("tun: default peer requires the gateway no route action")
+	}
+	return nil
+}
+
+// String returns the route in the form of "dest [gateway]".
+func (r IPRoute) String() string {
+	if r.Dest == nil {
+		return ""
+	}
+	if r.Gateway == nil {
+		return r.Dest.String()
+	}
+	return r.Dest.String() + " " + r.Gateway.String()
+}
+
+// MarshalJSON implements json.Marshaler, the route is encoded as a string of "dest [gateway]".
+func (r IPRoute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, the route is decoded from a string of "dest [gateway]".
+func (r *IPRoute) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	ss := strings.Fields(s)
+	if len(ss) == 0 || len(ss) > 2 {
+		return fmt.Errorf("invalid route %q", s)
+	}
+	_, dest, err := net.ParseCIDR(ss[0])
+	if err != nil {
+		return err
+	}
+	r.Dest = dest
+	r.Gateway = nil
+	if len(ss) > 1 {
+		if r.Gateway = net.ParseIP(ss[1]); r.Gateway == nil {
+			return fmt.Errorf("invalid route gateway %q", ss[1])
+		}
+	}
+	return nil
+}
+
+// Validate checks the config of the tap device, it returns the first error found.
+func (cfg *TapConfig) Validate() error {
+	for _, id := range cfg.AllowedVLANs {
+		if id < 1 || id > tapMaxVLANID {
+			return fmt.Errorf("tap: VLAN ID %d out of range [1, %d]", id, tapMaxVLANID)
+		}
+	}
+	return nil
+}
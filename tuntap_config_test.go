@@ -0,0 +1,211 @@
+package gost
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var parseTunConfigTests = []struct {
+	s   string
+	cfg TunConfig
+	ok  bool
+}{
+	{`{"addr": "192.168.123.1/24"}`, TunConfig{Addr: "192.168.123.1/24"}, true},
+	{`{"Name": "tun0", "addr": "192.168.123.1/24", "mtu": 1400}`,
+		TunConfig{Name: "tun0", Addr: "192.168.123.1/24", MTU: 1400}, true},
+	{`{"addr": "192.168.123.1/24", "dpdInterval": "10s", "dpdMaxMiss": 5}`,
+		TunConfig{Addr: "192.168.123.1/24", DPDInterval: 10 * time.Second, DPDMaxMiss: 5}, true},
+	{`{"addr": "192.168.123.1/24", "dpdInterval": 1000}`,
+		TunConfig{Addr: "192.168.123.1/24", DPDInterval: 1000}, true},
+	{`{"addr": "192.168.123.1/24", "routes": ["10.100.0.0/16", "172.20.0.0/16 192.168.123.2"]}`,
+		TunConfig{Addr: "192.168.123.1/24"}, true},
+	{``, TunConfig{}, false},
+	{`{}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "mtu": 100}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "routes": ["10.100.0.0"]}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "routes": ["10.100.0.0/16 gw"]}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "dpdInterval": "10"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "outerDSCP": 64}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "snat": "192.168.123.1"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "unknown": 1}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "autoInnerMTU": true, "outerMTU": 600}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "mtu": 1500, "bufferSize": 1400}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "noRouteAction": "gateway", "defaultPeer": "192.168.123.2"}`,
+		TunConfig{Addr: "192.168.123.1/24"}, true},
+	{`{"addr": "192.168.123.1/24", "noRouteAction": "gateway"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "noRouteAction": "reject"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "defaultPeer": "192.168.123.2"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "peer": "192.168.123.2", "noRouteAction": "gateway", "defaultPeer": "192.168.123.2"}`,
+		TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "natInterface": "eth0"}`, TunConfig{}, false},
+	{`{"addr": "192.168.123.1/24", "routes": ["10.100.0.0/16 fd00::1"]}`, TunConfig{}, false},
+	// YAML
+	{`{addr: 192.168.123.1/24, mtu: 1350}`, TunConfig{Addr: "192.168.123.1/24", MTU: 1350}, true},
+	{"name: tun0\naddr: 192.168.123.1/24\nmtu: 1350\ndpdInterval: 10s\ndpdMaxMiss: 5\n",
+		TunConfig{Name: "tun0", Addr: "192.168.123.1/24", MTU: 1350, DPDInterval: 10 * time.Second, DPDMaxMiss: 5}, true},
+	{"addr: 192.168.123.1/24\nroutes:\n  - 10.100.0.0/16\n  - 172.20.0.0/16 192.168.123.2\n",
+		TunConfig{Addr: "192.168.123.1/24"}, true},
+	{"addr: 192.168.123.1/24\nmtu: 100\n", TunConfig{}, false},
+	{"addr: 192.168.123.1/24\nunknown: 1\n", TunConfig{}, false},
+	{"addr: 192.168.123.1/24\n1: 1\n", TunConfig{}, false},
+	{"addr: [192.168.123.1/24\n", TunConfig{}, false},
+	{"- 192.168.123.1/24\n", TunConfig{}, false},
+}
+
+func TestParseTunConfig(t *testing.T) {
+	for i, tc := range parseTunConfigTests {
+		cfg, err := ParseTunConfig(bytes.NewBufferString(tc.s))
+		if (err == nil) != tc.ok {
+			t.Errorf("#%d parse should be ok=%v, got error %v", i, tc.ok, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if cfg.Name != tc.cfg.Name || cfg.Addr != tc.cfg.Addr || cfg.MTU != tc.cfg.MTU ||
+			cfg.DPDInterval != tc.cfg.DPDInterval || cfg.DPDMaxMiss != tc.cfg.DPDMaxMiss {
+			t.Errorf("#%d config should be %+v, got %+v", i, tc.cfg, cfg)
+		}
+	}
+}
+
+func TestParseTunConfigRoutes(t *testing.T) {
+	for i, s := range []string{
+		`{"addr": "192.168.123.1/24", "routes": ["10.100.0.1/16", "172.20.0.0/16 192.168.123.2"]}`,
+		"addr: 192.168.123.1/24\nroutes:\n  - 10.100.0.1/16\n  - 172.20.0.0/16 192.168.123.2\n",
+	} {
+		cfg, err := ParseTunConfig(bytes.NewBufferString(s))
+		if err != nil {
+			t.Errorf("#%d %v", i, err)
+			continue
+		}
+		if len(cfg.Routes) != 2 {
+			t.Errorf("#%d should have 2 routes, got %d", i, len(cfg.Routes))
+			continue
+		}
+		if s := cfg.Routes[0].String(); s != "10.100.0.0/16" {
+			t.Errorf("#%d route should be 10.100.0.0/16, got %s", i, s)
+		}
+		if s := cfg.Routes[1].String(); s != "172.20.0.0/16 192.168.123.2" {
+			t.Errorf("#%d route should be 172.20.0.0/16 192.168.123.2, got %s", i, s)
+		}
+	}
+}
+
+var tunConfigMTUTests = []struct {
+	cfg TunConfig
+	mtu int
+}{
+	{TunConfig{}, DefaultMTU},
+	{TunConfig{MTU: 1400}, 1400},
+	{TunConfig{MTU: 1400, AutoInnerMTU: true}, 1500 - tunOverhead},
+	{TunConfig{AutoInnerMTU: true, OuterMTU: 9000}, 9000 - tunOverhead},
+	{TunConfig{AutoInnerMTU: true, ClearHeader: true}, 1500 - tunOverhead - tunClearHeaderLen},
+	{TunConfig{AutoInnerMTU: true, Cipher: "chacha20-ietf-poly1305"}, 1500 - tunHeaderOverhead - 32 - 16},
+	{TunConfig{AutoInnerMTU: true, Cipher: "aes-128-gcm"}, 1500 - tunHeaderOverhead - 16 - 16},
+	{TunConfig{AutoInnerMTU: true, Cipher: "dummy"}, 1500 - tunHeaderOverhead},
+}
+
+func TestTunConfigMTU(t *testing.T) {
+	for i, tc := range tunConfigMTUTests {
+		if mtu := tc.cfg.mtu(); mtu != tc.mtu {
+			t.Errorf("#%d MTU should be %d, got %d", i, tc.mtu, mtu)
+		}
+	}
+}
+
+var tunConfigValidateTests = []struct {
+	cfg TunConfig
+	ok  bool
+}{
+	{TunConfig{Addr: "192.168.123.1/24"}, true},
+	{TunConfig{Addr: "192.168.123.1/24", AutoNAT: true, NATInterface: "eth0"}, true},
+	{TunConfig{Addr: "192.168.123.1/24", EnableIPForward: true, RestoreIPForward: true}, true},
+	{TunConfig{Addr: "192.168.123.1/24", RestoreIPForward: true}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Alias: "gost tunnel to site A"}, true},
+	{TunConfig{Addr: "192.168.123.1/24", Alias: "gost\ntunnel"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Routes: []IPRoute{{}}}, false},
+	{TunConfig{Addr: "192.168.123.1/24", AllowedProtocols: []int{6, 256}}, false},
+	{TunConfig{Addr: "192.168.123.1/24", WriteQueue: -1}, false},
+	{TunConfig{Addr: "192.168.123.1/24", PerPeerQueue: 8}, true},
+	{TunConfig{Addr: "192.168.123.1/24", PerPeerQueue: 8, WriteQueue: 8}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Upstream: TunDirectionConfig{SockBuffer: 1 << 20, Queue: 64}, Downstream: TunDirectionConfig{SockBuffer: 4 << 20, Queue: 512}}, true},
+	{TunConfig{Addr: "192.168.123.1/24", Upstream: TunDirectionConfig{Queue: -1}}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Downstream: TunDirectionConfig{SockBuffer: -1}}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Downstream: TunDirectionConfig{Queue: 512}, WriteQueue: 512}, true},
+	{TunConfig{Addr: "192.168.123.1/24", Downstream: TunDirectionConfig{Queue: 512}, WriteQueue: 256}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Downstream: TunDirectionConfig{Queue: 8}, PerPeerQueue: 8}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Downstream: TunDirectionConfig{Queue: 8}, InlineWrite: true}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Upstream: TunDirectionConfig{Queue: 8}, PreserveTOS: true}, false},
+	{TunConfig{Addr: "192.168.123.1/24", InlineWrite: true}, true},
+	{TunConfig{Addr: "192.168.123.1/24", LockThreads: true, ThreadPriority: -5}, true},
+	{TunConfig{Addr: "192.168.123.1/24", ThreadPriority: 20}, false},
+	{TunConfig{Addr: "192.168.123.1/24", DuplicateIPPolicy: TunDuplicateReject, DuplicateIPWindow: time.Second}, true},
+	{TunConfig{Addr: "192.168.123.1/24", DuplicateIPPolicy: "second-wins"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", DuplicateIPPolicy: TunDuplicateFirstWins, DuplicateIPWindow: -time.Second}, false},
+	{TunConfig{Addr: "192.168.123.1/24", LoopDetect: 1024, LoopWindow: time.Second}, true},
+	{TunConfig{Addr: "192.168.123.1/24", LoopDetect: -1}, false},
+	{TunConfig{Addr: "192.168.123.1/24", PrewarmBuffers: 256}, true},
+	{TunConfig{Addr: "192.168.123.1/24", PrewarmBuffers: -1}, false},
+	{TunConfig{Addr: "192.168.123.1/24", LoopDetect: 1024, LoopWindow: -time.Second}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Cipher: "AEAD_AES_256_GCM"}, true},
+	{TunConfig{Addr: "192.168.123.1/24", Cipher: "rc4-md5"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", InlineWrite: true, WriteQueue: 8}, false},
+	{TunConfig{Addr: "192.168.123.1/24", MTU: 70000}, false},
+	{TunConfig{Addr: "192.168.123.1/24", SNAT: "192.168.123.1"}, false},
+	{TunConfig{Name: "tun0", ReuseExisting: true}, true},
+	{TunConfig{ReuseExisting: true}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Group: "gost", Persist: true, GroupAccess: true}, true},
+	{TunConfig{Name: "tun0", Group: "gost", ReuseExisting: true, GroupAccess: true}, true},
+	{TunConfig{Addr: "192.168.123.1/24", Persist: true, GroupAccess: true}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Group: "gost", GroupAccess: true}, false},
+	{TunConfig{Name: "tun0"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", MeasureLatency: true}, false},
+	{TunConfig{Addr: "192.168.123.1/24", MeasureLatency: true, DPDInterval: time.Second}, true},
+	{TunConfig{Addr: "192.168.123.1/24", PeerIdleTimeout: -time.Second}, false},
+	{TunConfig{Addr: "192.168.123.1/24", UDPBatch: 64}, true},
+	{TunConfig{Addr: "192.168.123.1/24", UDPBatch: 2048}, false},
+	{TunConfig{Addr: "192.168.123.1/24", MinPacketSize: 40}, true},
+	{TunConfig{Addr: "192.168.123.1/24", SourcePortRange: "40000-40099"}, true},
+	{TunConfig{Addr: "192.168.123.1/24", SourcePortRange: "40000"}, true},
+	{TunConfig{Addr: "192.168.123.1/24", SourcePortRange: "0-100"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", SourcePortRange: "*"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", SourcePortRange: "40000-"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Transporter: ConnTunTransporter(nil)}, true},
+	{TunConfig{Addr: "192.168.123.1/24", Transporter: ConnTunTransporter(nil), SourcePortRange: "40000"}, false},
+	{TunConfig{Addr: "192.168.123.1/24", Transporter: ConnTunTransporter(nil), ListenAddrs: []string{":8422"}}, false},
+	{TunConfig{Addr: "192.168.123.1/24", ExitGracePeriod: 10 * time.Second}, true},
+	{TunConfig{Addr: "192.168.123.1/24", ExitGracePeriod: -time.Second}, false},
+	{TunConfig{Addr: "192.168.123.1/24", MinPacketSize: -1}, false},
+	{TunConfig{Addr: "192.168.123.1/24", MinPacketSize: 65536}, false},
+	{TunConfig{Addr: "192.168.123.1/24", CPUAffinity: []int{0, 3}}, true},
+	{TunConfig{Addr: "192.168.123.1/24", CPUAffinity: []int{-1}}, false},
+}
+
+func TestTunConfigValidate(t *testing.T) {
+	for i, tc := range tunConfigValidateTests {
+		if err := tc.cfg.Validate(); (err == nil) != tc.ok {
+			t.Errorf("#%d validate should be ok=%v, got error %v", i, tc.ok, err)
+		}
+	}
+}
+
+var tapConfigValidateTests = []struct {
+	cfg TapConfig
+	ok  bool
+}{
+	{TapConfig{}, true},
+	{TapConfig{AllowedVLANs: []int{10, 4094}}, true},
+	{TapConfig{AllowedVLANs: []int{4095}}, false},
+	{TapConfig{AllowedVLANs: []int{0}}, false},
+}
+
+func TestTapConfigValidate(t *testing.T) {
+	for i, tc := range tapConfigValidateTests {
+		if err := tc.cfg.Validate(); (err == nil) != tc.ok {
+			t.Errorf("#%d validate should be ok=%v, got error %v", i, tc.ok, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errTunConnUsed = errors.New("tun: the connection of the transporter is already used")
+
+// connTunTransporter is the TunTransporter of a ready packet connection, see ConnTunTransporter.
+type connTunTransporter struct {
+	mu sync.Mutex
+	pc net.PacketConn
+}
+
+// ConnTunTransporter creates a TunTransporter that carries the tunnel over the ready packet connection pc,
+// e.g. a datagram connection dialed over a proxy chain, instead of the socket bound by the handler.
+// The local address of the handler is ignored. The connected socket, which has a remote address,
+// is read from and written to its remote address regardless of the address of the peer.
+//
+// The handler owns pc and closes it when the tunnel stops. As pc can not be created again, the handler stops
+// once the tunnel over it ends instead of restarting it, so it can not be restarted by TunTunnel.Reconfigure either,
+// and it can not be used with TunConfig.ListenAddrs or TunConfig.SourcePortRange.
+func ConnTunTransporter(pc net.PacketConn) TunTransporter {
+	return &connTunTransporter{pc: pc}
+}
+
+func (tr *connTunTransporter) PacketConn(laddr, raddr string) (net.PacketConn, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	pc := tr.pc
+	if pc == nil {
+		return nil, errTunConnUsed
+	}
+	tr.pc = nil
+	if c, ok := pc.(net.Conn); ok && c.RemoteAddr() != nil {
+		return &tunConnectedConn{PacketConn: pc, conn: c}, nil
+	}
+	return pc, nil
+}
+
+// tunConnectedConn is the connected socket used as the packet connection, e.g. a connected UDP socket
+// which fails the WriteTo of an address.
+type tunConnectedConn struct {
+	net.PacketConn
+	conn net.Conn
+}
+
+func (c *tunConnectedConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, err = c.conn.Read(b)
+	return n, c.conn.RemoteAddr(), err
+}
+
+func (c *tunConnectedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.conn.Write(b)
+}
@@ -12,6 +12,27 @@ import (
 )
 
 func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
+	if cfg.ReuseExisting {
+		err = errors.New("reusing an existing device is not supported on darwin")
+		return
+	}
+	if cfg.Owner != "" || cfg.Group != "" || cfg.Persist || cfg.MultiQueue || cfg.GroupAccess {
+		err = errors.New("owner, group, group access, persist and multi-queue of device are not supported on darwin")
+		return
+	}
+	if cfg.AutoNAT {
+		err = errors.New("auto NAT is not supported on darwin")
+		return
+	}
+	if cfg.EnableIPForward {
+		err = errors.New("IP forwarding management is not supported on darwin")
+		return
+	}
+	if cfg.Alias != "" {
+		err = errors.New("alias of device is not supported on darwin")
+		return
+	}
+
 	ip, _, err := net.ParseCIDR(cfg.Addr)
 	if err != nil {
 		return
@@ -23,6 +44,11 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			ifce.Close()
+		}
+	}()
 
 	mtu := cfg.MTU
 	if mtu <= 0 {
@@ -77,3 +103,32 @@ func addTunRoutes(ifName string, routes ...IPRoute) error {
 	}
 	return nil
 }
+
+func addTunRoute(ifName string, route IPRoute) error {
+	return addTunRoutes(ifName, route)
+}
+
+func deleteTunRoute(ifName string, route IPRoute) error {
+	cmd := fmt.Sprintf("route delete -net %s -interface %s", route.Dest.String(), ifName)
+	log.Logf("[tun] %s", cmd)
+	args := strings.Split(cmd, " ")
+	if er := exec.Command(args[0], args[1:]...).Run(); er != nil {
+		return fmt.Errorf("%s: %v", cmd, er)
+	}
+	return nil
+}
+
+func deleteTunDevice(ifName string) error {
+	return errors.New("deleting the device is not supported on darwin")
+}
+
+// setTunMTU changes the MTU of the device ifName at runtime.
+func setTunMTU(ifName string, mtu int) error {
+	cmd := fmt.Sprintf("ifconfig %s mtu %d", ifName, mtu)
+	log.Log("[tun]", cmd)
+	args := strings.Split(cmd, " ")
+	if er := exec.Command(args[0], args[1:]...).Run(); er != nil {
+		return fmt.Errorf("%s: %v", cmd, er)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// TunDirectionConfig is the buffering of a direction of the forwarding, see TunConfig.Upstream and TunConfig.Downstream.
+type TunDirectionConfig struct {
+	// SockBuffer is the size in bytes of the buffer of the tunnel socket for the direction: the send buffer
+	// (SO_SNDBUF) upstream and the receive buffer (SO_RCVBUF) downstream. The kernel may cap the size,
+	// e.g. by net.core.wmem_max and net.core.rmem_max on Linux. Zero means the system default.
+	SockBuffer int
+	// Queue is the depth of the queue of the packets of the direction, the packets are dropped when it is full.
+	// Upstream the datagrams to the peers are sent by a dedicated goroutine, so the device is drained while
+	// the socket send is blocked. It can not be used with PreserveTOS, as the ToS is set on the socket
+	// for the packet being sent. Zero means the datagrams are sent in the goroutine reading the device.
+	// Downstream it is the depth of WriteQueue, they must match if both are set.
+	Queue int
+}
+
+// writeQueue returns the depth of the write queue configured by Downstream.Queue or WriteQueue.
+func (cfg *TunConfig) writeQueue() int {
+	if q := cfg.Downstream.Queue; q > 0 {
+		return q
+	}
+	return cfg.WriteQueue
+}
+
+// initSockBuffers sets the buffer sizes of the tunnel socket pc configured by Upstream and Downstream.
+func (h *tunHandler) initSockBuffers(pc net.PacketConn) {
+	cfg := &h.options.TunConfig
+	if size := cfg.Upstream.SockBuffer; size > 0 {
+		if c, ok := pc.(interface{ SetWriteBuffer(int) error }); !ok {
+			h.logf("%s: send buffer size is not supported", pc.LocalAddr())
+		} else if err := c.SetWriteBuffer(size); err != nil {
+			h.logf("%s: set send buffer %d: %v", pc.LocalAddr(), size, err)
+		}
+	}
+	if size := cfg.Downstream.SockBuffer; size > 0 {
+		if c, ok := pc.(interface{ SetReadBuffer(int) error }); !ok {
+			h.logf("%s: receive buffer size is not supported", pc.LocalAddr())
+		} else if err := c.SetReadBuffer(size); err != nil {
+			h.logf("%s: set receive buffer %d: %v", pc.LocalAddr(), size, err)
+		}
+	}
+}
+
+var errTunSendQueueClosed = errors.New("send queue is closed")
+
+type tunSendItem struct {
+	b    []byte
+	addr net.Addr
+}
+
+// tunSendQueueConn sends the datagrams written to it by a dedicated goroutine, see TunDirectionConfig.Queue.
+// The permanent error of a send, e.g. network unreachable, is returned by the next WriteTo,
+// so the session is stopped as by the send in place.
+type tunSendQueueConn struct {
+	net.PacketConn
+	h      *tunHandler
+	queue  chan tunSendItem
+	pool   *bufferPool
+	mu     sync.Mutex
+	err    error
+	closed chan struct{}
+	once   sync.Once
+}
+
+// sendQueueConn returns the queued sender of the tunnel socket pc if TunConfig.Upstream.Queue is set.
+func (h *tunHandler) sendQueueConn(pc net.PacketConn) net.PacketConn {
+	depth := h.options.TunConfig.Upstream.Queue
+	if depth <= 0 {
+		return pc
+	}
+	c := &tunSendQueueConn{
+		PacketConn: pc,
+		h:          h,
+		queue:      make(chan tunSendItem, depth),
+		pool:       h.bufferPool(),
+		closed:     make(chan struct{}),
+	}
+	go c.send()
+	return c
+}
+
+func (c *tunSendQueueConn) send() {
+	defer func() {
+		for {
+			select {
+			case item := <-c.queue:
+				c.release(item.b)
+			default:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case item := <-c.queue:
+			_, err := c.PacketConn.WriteTo(item.b, item.addr)
+			c.release(item.b)
+			if err == nil {
+				continue
+			}
+			if isTunSendBufferFull(err) {
+				c.h.stats.incr(&c.h.stats.sendDropped, 1)
+				continue
+			}
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.mu.Unlock()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *tunSendQueueConn) release(b []byte) {
+	c.h.mem.release(cap(b))
+	c.pool.Put(b[:cap(b)])
+}
+
+func (c *tunSendQueueConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.err = nil
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-c.closed:
+		return 0, errTunSendQueueClosed
+	default:
+	}
+
+	bb := c.pool.Get().([]byte)
+	if len(b) > len(bb) {
+		c.pool.Put(bb)
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	if !c.h.mem.reserve(cap(bb), false) {
+		c.pool.Put(bb)
+		c.h.memDropped()
+		return 0, errTunSendDropped
+	}
+	select {
+	case c.queue <- tunSendItem{b: append(bb[:0], b...), addr: addr}:
+	default:
+		// tail drop
+		c.release(bb)
+		c.h.stats.incr(&c.h.stats.sendDropped, 1)
+		return 0, errTunSendDropped
+	}
+	return len(b), nil
+}
+
+func (c *tunSendQueueConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.PacketConn.Close()
+}
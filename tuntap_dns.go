@@ -0,0 +1,83 @@
+package gost
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// tunDNSTimeout is the timeout of the exchange with the upstream resolver of TunConfig.DNSForward.
+	tunDNSTimeout = 5 * time.Second
+	// tunDNSMaxInflight is the maximum number of the queries being forwarded,
+	// the queries beyond it are dropped, and the clients retry.
+	tunDNSMaxInflight = 64
+)
+
+// dnsUpstream returns the address of the upstream resolver of DNSForward, the port is 53 by default.
+func (cfg *TunConfig) dnsUpstream() string {
+	addr := cfg.DNSForward
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// forwardDNS forwards the DNS query b to the address of the device from the peer addr to the upstream resolver,
+// it reports false if b is not such a query. The response is sent back to the peer asynchronously.
+func (h *tunHandler) forwardDNS(conn net.PacketConn, b []byte, addr net.Addr) bool {
+	sport, dport, query, ok := udpPayload(b, h.ip)
+	if !ok || dport != 53 {
+		return false
+	}
+	src := append(net.IP(nil), net.IP(b[12:16])...)
+	if b[0]>>4 == 6 {
+		src = append(net.IP(nil), net.IP(b[8:24])...)
+	}
+
+	select {
+	case h.dnsInflight <- struct{}{}:
+	default:
+		if Debug {
+			h.logf("dns: drop query from %s, too many queries in flight", src)
+		}
+		return true
+	}
+	query = append([]byte(nil), query...)
+	go func() {
+		defer func() { <-h.dnsInflight }()
+
+		upstream := h.options.TunConfig.dnsUpstream()
+		resp, err := tunDNSExchange(upstream, query)
+		if err != nil {
+			h.logf("dns: %s -> %s: %v", src, upstream, err)
+			return
+		}
+		if Debug {
+			h.logf("dns: %s -> %s: %d bytes", src, upstream, len(resp))
+		}
+		if err := h.writeTo(conn, udpPacket(h.ip, src, dport, sport, resp), addr); err != nil {
+			h.logf("dns: %s: %v", addr, err)
+		}
+	}()
+	return true
+}
+
+// tunDNSExchange sends the query to the upstream resolver and returns the response.
+func tunDNSExchange(upstream string, query []byte) ([]byte, error) {
+	c, err := net.DialTimeout("udp", upstream, tunDNSTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(tunDNSTimeout))
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 65535)
+	n, err := c.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
@@ -0,0 +1,101 @@
+package gost
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TunDuplicateIPPolicy is the policy for the inner address claimed by two peers, see TunConfig.DuplicateIPPolicy.
+type TunDuplicateIPPolicy string
+
+const (
+	// TunDuplicateLastWins routes the address to the peer sending last, which is the behavior without detection.
+	TunDuplicateLastWins TunDuplicateIPPolicy = "last-wins"
+	// TunDuplicateFirstWins keeps the address routed to the peer owning it before the conflict,
+	// the packets from the other peer with the address are dropped.
+	TunDuplicateFirstWins TunDuplicateIPPolicy = "first-wins"
+	// TunDuplicateReject removes the route of the address, the packets from both peers with the address are dropped.
+	TunDuplicateReject TunDuplicateIPPolicy = "reject"
+)
+
+const defaultTunDuplicateIPWindow = 10 * time.Second
+
+// tunDupIP is the state of the route of an inner address changed between the peers.
+type tunDupIP struct {
+	mu       sync.Mutex
+	prev     net.Addr  // the owner before the last change
+	changed  time.Time // the time of the last change
+	conflict bool
+	first    net.Addr  // the owner at the start of the conflict
+	last     time.Time // the time of the last packet of the conflict
+}
+
+func (h *tunHandler) duplicateIPWindow() time.Duration {
+	if d := h.options.TunConfig.DuplicateIPWindow; d > 0 {
+		return d
+	}
+	return defaultTunDuplicateIPWindow
+}
+
+// checkDuplicateIP is called when the route of the inner address ip is to be changed from the peer old
+// (nil for a new route) to the peer addr, it reports whether the change is allowed.
+// The route changed back to the previous owner within TunConfig.DuplicateIPWindow is a conflict of
+// the duplicate address, unlike a peer roaming to a new address once. The conflict is over once no
+// packet of it is received in the window.
+func (h *tunHandler) checkDuplicateIP(ip net.IP, rkey tunRouteKey, old, addr net.Addr) bool {
+	policy := h.options.TunConfig.DuplicateIPPolicy
+	now := time.Now()
+	window := h.duplicateIPWindow()
+
+	var d *tunDupIP
+	if old == nil {
+		v, ok := h.dups.Load(rkey)
+		if !ok {
+			return true
+		}
+		d = v.(*tunDupIP)
+	} else {
+		v, _ := h.dups.LoadOrStore(rkey, &tunDupIP{})
+		d = v.(*tunDupIP)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conflict && now.Sub(d.last) > window {
+		d.conflict = false
+		h.logf("duplicate inner address %s: conflict is over", ip)
+	}
+	if !d.conflict {
+		if old == nil {
+			return true
+		}
+		if d.changed.IsZero() || now.Sub(d.changed) > window || tunAddrKey(d.prev) != tunAddrKey(addr) {
+			d.prev, d.changed = old, now
+			return true
+		}
+		d.conflict, d.first = true, addr
+		h.logf("DUPLICATE inner address %s is claimed by both %s and %s, policy: %s",
+			ip, addr, old, policy)
+	}
+	d.last = now
+
+	switch policy {
+	case TunDuplicateFirstWins:
+		if tunAddrKey(addr) == tunAddrKey(d.first) {
+			return true
+		}
+	case TunDuplicateReject:
+		if old != nil {
+			h.removeRoute(rkey, nil)
+		}
+	default:
+		return true
+	}
+	h.stats.incr(&h.stats.duplicateIP, 1)
+	if Debug {
+		h.logf("duplicate inner address %s: drop packet from %s", ip, addr)
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package gost
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+// The clear header is prepended to the encrypted datagram when TunConfig.ClearHeader is set,
+// so that a middle box can balance the tunnel traffic by the peer and the flow without the key.
+//
+//	+---------+-----------+----------------------+
+//	| PEER ID | FLOW HASH | ENCRYPTED IP PACKET  |
+//	+---------+-----------+----------------------+
+//	     4          4
+//
+// PEER ID is the FNV-1a hash of the user name, FLOW HASH is the FNV-1a hash of the
+// addresses, protocol and ports of the inner packet, it is zero for the control messages.
+const tunClearHeaderLen = 8
+
+var (
+	errTunClearHeaderShort  = errors.New("clear header: short datagram")
+	errTunClearHeaderPeerID = errors.New("clear header: unknown peer ID")
+)
+
+// tunPeerID returns the peer ID of the user in the clear header.
+func tunPeerID(user string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	return h.Sum32()
+}
+
+// tunFlowHash returns the flow hash of the IP packet b in the clear header.
+func tunFlowHash(b []byte) uint32 {
+	if len(b) == 0 || isTunControl(b) {
+		return 0
+	}
+
+	var addrs []byte
+	var proto byte
+	var l4 []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return 0
+		}
+		addrs, proto = b[12:20], b[9]
+		if hl := ipv4HeaderLen(b); ipv4FragOffset(b) == 0 && len(b) >= hl {
+			l4 = b[hl:]
+		}
+	case 6:
+		if len(b) < 40 {
+			return 0
+		}
+		addrs, proto, l4 = b[8:40], b[6], b[40:]
+	default:
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(addrs)
+	h.Write([]byte{proto})
+	// TCP and UDP ports
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		h.Write(l4[:4])
+	}
+	return h.Sum32()
+}
+
+// tunClearHeaderConn adds the clear header to the datagrams encrypted by the cipher above it,
+// and removes the header of the received datagrams before they are decrypted.
+type tunClearHeaderConn struct {
+	net.PacketConn
+	id   uint32
+	mu   sync.Mutex
+	flow uint32 // the flow hash of the datagram being written
+	buf  []byte
+}
+
+func (c *tunClearHeaderConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return
+	}
+	if n < tunClearHeaderLen {
+		return 0, addr, errTunClearHeaderShort
+	}
+	if binary.BigEndian.Uint32(b) != c.id {
+		return 0, addr, errTunClearHeaderPeerID
+	}
+	n = copy(b, b[tunClearHeaderLen:n])
+	return
+}
+
+// writeFlow writes the plaintext b through the cipher conn with the flow hash of b in the clear header.
+func (c *tunClearHeaderConn) writeFlow(conn net.PacketConn, b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flow = tunFlowHash(b)
+	return conn.WriteTo(b, addr)
+}
+
+// WriteTo is called by the cipher within writeFlow.
+func (c *tunClearHeaderConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if n := tunClearHeaderLen + len(b); cap(c.buf) < n {
+		c.buf = make([]byte, n)
+	}
+	buf := c.buf[:tunClearHeaderLen+len(b)]
+	binary.BigEndian.PutUint32(buf, c.id)
+	binary.BigEndian.PutUint32(buf[4:], c.flow)
+	copy(buf[tunClearHeaderLen:], b)
+
+	n, err := c.PacketConn.WriteTo(buf, addr)
+	if n -= tunClearHeaderLen; n < 0 {
+		n = 0
+	}
+	return n, err
+}
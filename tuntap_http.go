@@ -0,0 +1,216 @@
+package gost
+
+import (
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// tunHTTPPeer is the JSON form of a peer served by the debug HTTP endpoint.
+type tunHTTPPeer struct {
+	Addr      string
+	User      string
+	IPs       []string
+	RxPackets uint64
+	RxBytes   uint64
+	TxPackets uint64
+	TxBytes   uint64
+	RTT       time.Duration
+}
+
+// tunHTTPRequest is the JSON body of the POST endpoints of the debug HTTP endpoint.
+type tunHTTPRequest struct {
+	Addr string `json:"addr,omitempty"`
+	CIDR string `json:"cidr,omitempty"`
+}
+
+// tunHTTPMaxBody is the maximum size of the body of a POST request.
+const tunHTTPMaxBody = 4096
+
+// listenDebugHTTP serves the JSON of the peers, the stats and the config on TunConfig.DebugHTTP
+// until the handler is closed, see debugHTTPHandler.
+func (h *tunHandler) listenDebugHTTP() error {
+	addr := h.options.TunConfig.DebugHTTP
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	h.logf("debug HTTP %s", ln.Addr())
+
+	srv := &http.Server{
+		Handler:      h.debugHTTPHandler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-h.closed
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			h.logf("debug HTTP %s: %v", addr, err)
+		}
+	}()
+	return nil
+}
+
+// debugHTTPHandler returns the handler of the debug HTTP endpoint:
+//
+//	GET  /peers                       the peers: Addr, User, IPs, the counters and RTT
+//	GET  /stats                       the stats without the peers
+//	GET  /config                      the config, without the callbacks and the credentials
+//	GET  /routes                      the static routes: the networks to the addresses of the peers
+//	POST /peers/drop {"addr": <addr>} drop the peer of the outer address addr
+//	POST /routes/add {"cidr": <cidr>, "addr": <addr>}
+//	                                  add the static route of the network cidr to the peer addr
+//	POST /routes/del {"cidr": <cidr>} remove the static route of the network cidr
+//
+// The POST endpoints are forbidden unless TunConfig.DebugHTTPWrite is set. Their parameters are in the JSON body
+// of Content-Type application/json, which a web page of another origin can not send without the permission of
+// CORS preflight, which is never granted, so the state is not changed by a cross-site request from a browser.
+// The errors are replied in the JSON object of {"Error": message}.
+func (h *tunHandler) debugHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", h.httpGet(func(r *http.Request) (interface{}, error) {
+		return h.httpPeers(), nil
+	}))
+	mux.HandleFunc("/stats", h.httpGet(func(r *http.Request) (interface{}, error) {
+		st := h.Stats()
+		st.Peers = nil
+		return st, nil
+	}))
+	mux.HandleFunc("/config", h.httpGet(func(r *http.Request) (interface{}, error) {
+		return tunConfigJSON(&h.options.TunConfig), nil
+	}))
+	mux.HandleFunc("/routes", h.httpGet(func(r *http.Request) (interface{}, error) {
+		return h.StaticRoutes(), nil
+	}))
+	mux.HandleFunc("/peers/drop", h.httpPost(func(req *tunHTTPRequest) error {
+		return h.DropPeer(req.Addr)
+	}))
+	mux.HandleFunc("/routes/add", h.httpPost(func(req *tunHTTPRequest) error {
+		return h.AddStaticRoute(req.CIDR, req.Addr)
+	}))
+	mux.HandleFunc("/routes/del", h.httpPost(func(req *tunHTTPRequest) error {
+		return h.RemoveStaticRoute(req.CIDR)
+	}))
+	return mux
+}
+
+func (h *tunHandler) httpGet(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeTunHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		v, err := f(r)
+		if err != nil {
+			writeTunHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeTunHTTP(w, http.StatusOK, v)
+	}
+}
+
+func (h *tunHandler) httpPost(f func(req *tunHTTPRequest) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeTunHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !h.options.TunConfig.DebugHTTPWrite {
+			writeTunHTTPError(w, http.StatusForbidden, "read-only, see DebugHTTPWrite")
+			return
+		}
+		// the simple requests, e.g. the forms, can be sent by the web pages of any origin.
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+			writeTunHTTPError(w, http.StatusUnsupportedMediaType, "content type must be application/json")
+			return
+		}
+		var req tunHTTPRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, tunHTTPMaxBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeTunHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := f(&req); err != nil {
+			writeTunHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		b, _ := json.Marshal(req)
+		h.logf("debug HTTP %s: %s %s", r.RemoteAddr, r.URL.Path, b)
+		writeTunHTTP(w, http.StatusOK, struct{}{})
+	}
+}
+
+func writeTunHTTP(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeTunHTTPError(w http.ResponseWriter, code int, msg string) {
+	writeTunHTTP(w, code, struct{ Error string }{msg})
+}
+
+// httpPeers returns the peers with their stats, sorted by the address.
+func (h *tunHandler) httpPeers() []tunHTTPPeer {
+	stats := make(map[string]TunPeerStats)
+	for _, st := range h.Stats().Peers {
+		stats[tunAddrKey(st.Addr)] = st
+	}
+	peers := []tunHTTPPeer{}
+	for _, peer := range h.Peers() {
+		st := stats[tunAddrKey(peer.Addr)]
+		p := tunHTTPPeer{
+			Addr:      peer.Addr.String(),
+			User:      peer.User,
+			IPs:       []string{},
+			RxPackets: st.RxPackets,
+			RxBytes:   st.RxBytes,
+			TxPackets: st.TxPackets,
+			TxBytes:   st.TxBytes,
+			RTT:       st.RTT,
+		}
+		for _, ip := range peer.IPs {
+			p.IPs = append(p.IPs, ip.String())
+		}
+		sort.Strings(p.IPs)
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+	return peers
+}
+
+// tunConfigJSON returns the fields of cfg to be encoded in JSON. The callbacks and the extension points
+// (the fields of func and interface types) are omitted, and the passwords of the URLs, e.g. of StatsEndpoint,
+// are redacted. The key of the tunnel is not in TunConfig, but in the user of the handler options.
+func tunConfigJSON(cfg *TunConfig) map[string]interface{} {
+	m := make(map[string]interface{})
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Func, reflect.Interface, reflect.Chan:
+			continue
+		case reflect.String:
+			if u, err := url.Parse(f.String()); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), "xxxxx")
+					m[v.Type().Field(i).Name] = u.String()
+					continue
+				}
+			}
+		}
+		m[v.Type().Field(i).Name] = f.Interface()
+	}
+	return m
+}
@@ -1,8 +1,17 @@
 package gost
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/docker/libcontainer/netlink"
 	"github.com/go-log/log"
@@ -11,20 +20,47 @@ import (
 )
 
 func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
+	if cfg.ReuseExisting {
+		return reuseTun(cfg)
+	}
+
 	ip, ipNet, err := net.ParseCIDR(cfg.Addr)
 	if err != nil {
 		return
 	}
+	perm, err := tunPermissions(cfg.owner(), cfg.Group)
+	if err != nil {
+		return
+	}
 
 	ifce, err := water.New(water.Config{
 		DeviceType: water.TUN,
 		PlatformSpecificParams: water.PlatformSpecificParams{
-			Name: cfg.Name,
+			Name:        cfg.Name,
+			Persist:     cfg.Persist,
+			Permissions: perm,
+			MultiQueue:  cfg.MultiQueue,
 		},
 	})
 	if err != nil {
 		return
 	}
+	c := &tunTapConn{
+		ifce:    ifce,
+		addr:    &net.IPAddr{IP: ip},
+		persist: cfg.Persist,
+	}
+	// the cleanups added so far are run on error, e.g. the NAT rule when enabling IP forwarding fails.
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+	if cfg.GroupAccess {
+		if err = setTunGroupAccess(tunControlDevice, cfg.Group); err != nil {
+			return
+		}
+	}
 
 	link, err := tenus.NewLinkFrom(ifce.Name())
 	if err != nil {
@@ -43,11 +79,22 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 		return
 	}
 
-	cmd = fmt.Sprintf("ip address add %s dev %s", cfg.Addr, ifce.Name())
-	log.Log("[tun]", cmd)
-	if er := link.SetLinkIp(ip, ipNet); er != nil {
-		err = fmt.Errorf("%s: %v", cmd, er)
-		return
+	if cfg.Peer != "" {
+		cmd = fmt.Sprintf("ip address add %s peer %s dev %s", cfg.Addr, cfg.Peer, ifce.Name())
+		log.Log("[tun]", cmd)
+		args := strings.Split(cmd, " ")
+		// the address of the persistent device is kept from the last run.
+		if out, er := exec.Command(args[0], args[1:]...).CombinedOutput(); er != nil && !strings.Contains(string(out), "File exists") {
+			err = fmt.Errorf("%s: %v: %s", cmd, er, strings.TrimSpace(string(out)))
+			return
+		}
+	} else {
+		cmd = fmt.Sprintf("ip address add %s dev %s", cfg.Addr, ifce.Name())
+		log.Log("[tun]", cmd)
+		if er := link.SetLinkIp(ip, ipNet); er != nil && !errors.Is(er, syscall.EEXIST) {
+			err = fmt.Errorf("%s: %v", cmd, er)
+			return
+		}
 	}
 
 	cmd = fmt.Sprintf("ip link set dev %s up", ifce.Name())
@@ -57,7 +104,17 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 		return
 	}
 
-	if err = addTunRoutes(ifce.Name(), cfg.Routes...); err != nil {
+	if cfg.Alias != "" {
+		if err = setTunAlias(ifce.Name(), cfg.Alias); err != nil {
+			return
+		}
+	}
+
+	addRoutes := addTunRoutes
+	if cfg.Persist {
+		addRoutes = addPersistTunRoutes
+	}
+	if err = addRoutes(ifce.Name(), cfg.Routes...); err != nil {
 		return
 	}
 
@@ -66,13 +123,174 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 		return
 	}
 
-	conn = &tunTapConn{
-		ifce: ifce,
-		addr: &net.IPAddr{IP: ip},
+	if cfg.AutoNAT {
+		if err = addTunNAT(c, ipNet, cfg.NATInterface); err != nil {
+			return
+		}
 	}
+	if cfg.EnableIPForward {
+		if err = enableTunIPForward(c, ip, cfg.RestoreIPForward); err != nil {
+			return
+		}
+	}
+
+	conn = c
 	return
 }
 
+// reuseTun attaches to the existing device cfg.Name configured by another tool, e.g. a persistent device
+// created by "ip tuntap add". The address and the MTU are read from the device instead of being set.
+func reuseTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
+	if itf, err = net.InterfaceByName(cfg.Name); err != nil {
+		return
+	}
+	ip, ipNet, err := tunInterfaceAddr(itf)
+	if err != nil {
+		return
+	}
+
+	perm, err := tunPermissions(cfg.owner(), cfg.Group)
+	if err != nil {
+		return
+	}
+
+	ifce, err := water.New(water.Config{
+		DeviceType: water.TUN,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name: cfg.Name,
+			// the device created by another tool is persistent, otherwise it is removed when closed.
+			Persist:     true,
+			Permissions: perm,
+			MultiQueue:  cfg.MultiQueue,
+		},
+	})
+	if err != nil {
+		return
+	}
+	addr := (&net.IPNet{IP: ip, Mask: ipNet.Mask}).String()
+	c := &tunTapConn{
+		ifce:   ifce,
+		addr:   &net.IPAddr{IP: ip},
+		reused: &tunDeviceInfo{addr: addr, mtu: itf.MTU},
+	}
+	// the cleanups added so far are run on error, e.g. the NAT rule when enabling IP forwarding fails.
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+	if cfg.GroupAccess {
+		if err = setTunGroupAccess(tunControlDevice, cfg.Group); err != nil {
+			return
+		}
+	}
+	log.Logf("[tun] reuse device %s: addr %s, mtu %d", ifce.Name(), addr, itf.MTU)
+
+	if cfg.Alias != "" {
+		if err = setTunAlias(ifce.Name(), cfg.Alias); err != nil {
+			return
+		}
+	}
+
+	if err = addPersistTunRoutes(ifce.Name(), cfg.Routes...); err != nil {
+		return
+	}
+
+	if cfg.AutoNAT {
+		if err = addTunNAT(c, ipNet, cfg.NATInterface); err != nil {
+			return
+		}
+	}
+	if cfg.EnableIPForward {
+		if err = enableTunIPForward(c, ip, cfg.RestoreIPForward); err != nil {
+			return
+		}
+	}
+
+	conn = c
+	return
+}
+
+// tunControlDevice is the device the tun devices are created and attached through.
+const tunControlDevice = "/dev/net/tun"
+
+// setTunGroupAccess makes the control device path readable and writable by group, see TunConfig.GroupAccess.
+// The device accessible to all is unchanged, and the device accessible to another group is an error.
+func setTunGroupAccess(path, group string) error {
+	perm, err := tunPermissions("", group)
+	if err != nil {
+		return err
+	}
+	if perm == nil {
+		return errors.New("group is required for group access")
+	}
+	gid := perm.Group
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	mode := fi.Mode().Perm()
+	if mode&0006 == 0006 {
+		return nil
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && uint(st.Gid) != gid {
+		if mode&0060 != 0 {
+			return fmt.Errorf("%s is accessible to group %d, not to group %d", path, st.Gid, gid)
+		}
+		if err := os.Chown(path, -1, int(gid)); err != nil {
+			return err
+		}
+		log.Logf("[tun] %s: group %d to %d", path, st.Gid, gid)
+	}
+	if mode&0060 != 0060 {
+		if err := os.Chmod(path, fi.Mode()|0060); err != nil {
+			return err
+		}
+		log.Logf("[tun] %s: mode %v to %v", path, mode, mode|0060)
+	}
+	return nil
+}
+
+// tunPermissions returns the owner and group of the device, the user and group are either names or IDs.
+func tunPermissions(owner, group string) (*water.DevicePermissions, error) {
+	if owner == "" && group == "" {
+		return nil, nil
+	}
+	// -1 means unchanged.
+	perm := &water.DevicePermissions{Owner: ^uint(0), Group: ^uint(0)}
+	if owner != "" {
+		id := owner
+		if _, err := strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return nil, err
+			}
+			id = u.Uid
+		}
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid owner %s", owner)
+		}
+		perm.Owner = uint(n)
+	}
+	if group != "" {
+		id := group
+		if _, err := strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			id = g.Gid
+		}
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group %s", group)
+		}
+		perm.Group = uint(n)
+	}
+	return perm, nil
+}
+
 func createTap(cfg TapConfig) (conn net.Conn, itf *net.Interface, err error) {
 	var ip net.IP
 	var ipNet *net.IPNet
@@ -135,13 +353,47 @@ func createTap(cfg TapConfig) (conn net.Conn, itf *net.Interface, err error) {
 		return
 	}
 
-	conn = &tunTapConn{
+	c := &tunTapConn{
 		ifce: ifce,
 		addr: &net.IPAddr{IP: ip},
 	}
+	if cfg.Bridge != "" {
+		if err = attachTapBridge(c, itf, cfg.Bridge); err != nil {
+			return
+		}
+	}
+
+	conn = c
 	return
 }
 
+// attachTapBridge attaches the tap device itf to the existing bridge,
+// the device is detached when it is closed.
+func attachTapBridge(c *tunTapConn, itf *net.Interface, bridge string) error {
+	br, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return fmt.Errorf("bridge %s: %v", bridge, err)
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/net", bridge, "bridge")); err != nil {
+		return fmt.Errorf("%s is not a bridge", bridge)
+	}
+
+	cmd := fmt.Sprintf("ip link set dev %s master %s", itf.Name, bridge)
+	log.Log("[tap]", cmd)
+	if er := netlink.NetworkSetMaster(itf, br); er != nil {
+		return fmt.Errorf("%s: %v", cmd, er)
+	}
+
+	c.addCleanup(func() {
+		cmd := fmt.Sprintf("ip link set dev %s nomaster", itf.Name)
+		log.Log("[tap]", cmd)
+		if er := netlink.NetworkSetNoMaster(itf); er != nil {
+			log.Logf("[tap] %s: %v", cmd, er)
+		}
+	})
+	return nil
+}
+
 func addTunRoutes(ifName string, routes ...IPRoute) error {
 	for _, route := range routes {
 		if route.Dest == nil {
@@ -150,7 +402,18 @@ func addTunRoutes(ifName string, routes ...IPRoute) error {
 		cmd := fmt.Sprintf("ip route add %s dev %s", route.Dest.String(), ifName)
 		log.Logf("[tun] %s", cmd)
 		if err := netlink.AddRoute(route.Dest.String(), "", "", ifName); err != nil {
-			return fmt.Errorf("%s: %v", cmd, err)
+			return fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+// addPersistTunRoutes adds the routes via the persistent device ifName,
+// the routes kept by the device from the last run are skipped.
+func addPersistTunRoutes(ifName string, routes ...IPRoute) error {
+	for _, route := range routes {
+		if err := addTunRoutes(ifName, route); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return err
 		}
 	}
 	return nil
@@ -169,3 +432,139 @@ func addTapRoutes(ifName string, gw string, routes ...string) error {
 	}
 	return nil
 }
+
+// setTunAlias sets the alias (ifalias) of the device, which is shown by "ip link show".
+func setTunAlias(ifName string, alias string) error {
+	args := []string{"link", "set", "dev", ifName, "alias", alias}
+	cmd := "ip " + strings.Join(args, " ")
+	log.Log("[tun]", cmd)
+	if out, er := exec.Command("ip", args...).CombinedOutput(); er != nil {
+		return fmt.Errorf("%s: %v: %s", cmd, er, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func tunNATRule(ifName string, ipNet *net.IPNet, wan string) string {
+	if wan != "" {
+		return fmt.Sprintf("POSTROUTING -s %s -o %s -j MASQUERADE", ipNet, wan)
+	}
+	return fmt.Sprintf("POSTROUTING -s %s ! -o %s -j MASQUERADE", ipNet, ifName)
+}
+
+// addTunNAT installs the masquerade rule for the tun network,
+// the rule is removed when the device is closed.
+func addTunNAT(c *tunTapConn, ipNet *net.IPNet, wan string) error {
+	rule := tunNATRule(c.ifce.Name(), ipNet, wan)
+
+	cmd := "iptables -t nat -A " + rule
+	log.Log("[tun]", cmd)
+	args := strings.Split(cmd, " ")
+	if er := exec.Command(args[0], args[1:]...).Run(); er != nil {
+		return fmt.Errorf("%s: %v", cmd, er)
+	}
+
+	c.addCleanup(func() {
+		cmd := "iptables -t nat -D " + rule
+		log.Log("[tun]", cmd)
+		args := strings.Split(cmd, " ")
+		if er := exec.Command(args[0], args[1:]...).Run(); er != nil {
+			log.Logf("[tun] %s: %v", cmd, er)
+		}
+	})
+	return nil
+}
+
+const tunSysctlRoot = "/proc/sys"
+
+// tunForwardSysctl returns the sysctl key of IP forwarding of the address family of ip.
+func tunForwardSysctl(ip net.IP) string {
+	if ip.To4() == nil {
+		return "net.ipv6.conf.all.forwarding"
+	}
+	return "net.ipv4.ip_forward"
+}
+
+// setTunSysctl sets the sysctl key under root (e.g. /proc/sys) to value, and returns the old value.
+func setTunSysctl(root, key, value string) (old string, err error) {
+	path := filepath.Join(root, strings.Replace(key, ".", "/", -1))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	old = strings.TrimSpace(string(b))
+	if old == value {
+		return
+	}
+	err = ioutil.WriteFile(path, []byte(value+"\n"), 0644)
+	return
+}
+
+// enableTunIPForward enables IP forwarding of the address family of the device address ip,
+// so the packets of the peers are routed by the kernel. It requires root. If restore is true,
+// the old setting is restored when the device is closed.
+func enableTunIPForward(c *tunTapConn, ip net.IP, restore bool) error {
+	if os.Geteuid() != 0 {
+		return errors.New("enabling IP forwarding requires root")
+	}
+
+	key := tunForwardSysctl(ip)
+	cmd := fmt.Sprintf("sysctl -w %s=1", key)
+	old, err := setTunSysctl(tunSysctlRoot, key, "1")
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+	if old == "1" {
+		log.Logf("[tun] %s is already enabled", key)
+		return nil
+	}
+	log.Log("[tun]", cmd)
+
+	if restore {
+		c.addCleanup(func() {
+			cmd := fmt.Sprintf("sysctl -w %s=%s", key, old)
+			log.Log("[tun]", cmd)
+			if _, er := setTunSysctl(tunSysctlRoot, key, old); er != nil {
+				log.Logf("[tun] %s: %v", cmd, er)
+			}
+		})
+	}
+	return nil
+}
+
+func addTunRoute(ifName string, route IPRoute) error {
+	return addTunRoutes(ifName, route)
+}
+
+func deleteTunRoute(ifName string, route IPRoute) error {
+	cmd := fmt.Sprintf("ip route del %s dev %s", route.Dest.String(), ifName)
+	log.Logf("[tun] %s", cmd)
+	args := strings.Split(cmd, " ")
+	if out, er := exec.Command(args[0], args[1:]...).CombinedOutput(); er != nil {
+		return fmt.Errorf("%s: %v: %s", cmd, er, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// deleteTunDevice deletes the device ifName, e.g. a persistent device after it is closed.
+func deleteTunDevice(ifName string) error {
+	cmd := fmt.Sprintf("ip link del dev %s", ifName)
+	log.Log("[tun]", cmd)
+	if err := netlink.NetworkLinkDel(ifName); err != nil {
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+	return nil
+}
+
+// setTunMTU changes the MTU of the device ifName at runtime.
+func setTunMTU(ifName string, mtu int) error {
+	cmd := fmt.Sprintf("ip link set dev %s mtu %d", ifName, mtu)
+	log.Log("[tun]", cmd)
+	link, err := tenus.NewLinkFrom(ifName)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+	if err := link.SetLinkMTU(mtu); err != nil {
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+	return nil
+}
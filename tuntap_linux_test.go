@@ -0,0 +1,427 @@
+package gost
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/libcontainer/netlink"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+var tunPermissionsTests = []struct {
+	owner, group string
+	uid, gid     uint
+	ok           bool
+}{
+	{"0", "", 0, ^uint(0), true},
+	{"", "0", ^uint(0), 0, true},
+	{"root", "root", 0, 0, true},
+	{"1000", "1000", 1000, 1000, true},
+	{"gost-no-such-user", "", 0, 0, false},
+	{"", "gost-no-such-group", 0, 0, false},
+	{"-1", "", 0, 0, false},
+}
+
+func TestTunPermissions(t *testing.T) {
+	if perm, err := tunPermissions("", ""); perm != nil || err != nil {
+		t.Errorf("permissions should be nil without owner and group, got %v, %v", perm, err)
+	}
+	for i, tc := range tunPermissionsTests {
+		perm, err := tunPermissions(tc.owner, tc.group)
+		if (err == nil) != tc.ok {
+			t.Errorf("#%d should be ok=%v, got error %v", i, tc.ok, err)
+			continue
+		}
+		if tc.ok && (perm.Owner != tc.uid || perm.Group != tc.gid) {
+			t.Errorf("#%d permissions should be %d:%d, got %d:%d", i, tc.uid, tc.gid, perm.Owner, perm.Group)
+		}
+	}
+}
+
+var tunGroupAccessTests = []struct {
+	mode     os.FileMode
+	gid      int
+	group    string
+	wantMode os.FileMode
+	wantGid  int
+	ok       bool
+}{
+	{0666, 0, "1000", 0666, 0, true},
+	{0600, 0, "1000", 0660, 1000, true},
+	{0600, 1000, "1000", 0660, 1000, true},
+	{0640, 1000, "1000", 0660, 1000, true},
+	{0660, 0, "1000", 0660, 0, false},
+	{0600, 0, "", 0600, 0, false},
+}
+
+func TestSetTunGroupAccess(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("root is required to change the group")
+	}
+	dir, err := ioutil.TempDir("", "gost-tun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tc := range tunGroupAccessTests {
+		path := filepath.Join(dir, fmt.Sprintf("tun%d", i))
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(path, -1, tc.gid); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := setTunGroupAccess(path, tc.group); (err == nil) != tc.ok {
+			t.Errorf("#%d should be ok=%v, got error %v", i, tc.ok, err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gid := int(fi.Sys().(*syscall.Stat_t).Gid); fi.Mode().Perm() != tc.wantMode || gid != tc.wantGid {
+			t.Errorf("#%d should be %v of group %d, got %v of group %d", i, tc.wantMode, tc.wantGid, fi.Mode().Perm(), gid)
+		}
+	}
+}
+
+func TestSetTunSysctl(t *testing.T) {
+	root, err := ioutil.TempDir("", "gost-sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	key := tunForwardSysctl(net.ParseIP("192.168.123.1"))
+	if key != "net.ipv4.ip_forward" {
+		t.Fatalf("sysctl key should be net.ipv4.ip_forward, got %s", key)
+	}
+	if key := tunForwardSysctl(net.ParseIP("fd00::1")); key != "net.ipv6.conf.all.forwarding" {
+		t.Errorf("sysctl key should be net.ipv6.conf.all.forwarding, got %s", key)
+	}
+
+	path := filepath.Join(root, "net", "ipv4", "ip_forward")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if old, err := setTunSysctl(root, key, "1"); err != nil || old != "0" {
+		t.Fatalf("old value should be 0, got %q, %v", old, err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "1\n" {
+		t.Errorf("value should be 1, got %q", b)
+	}
+	if old, err := setTunSysctl(root, key, "1"); err != nil || old != "1" {
+		t.Errorf("old value should be 1, got %q, %v", old, err)
+	}
+	if _, err := setTunSysctl(root, "net.ipv6.conf.all.forwarding", "1"); err == nil {
+		t.Error("setting a missing sysctl should fail")
+	}
+}
+
+func TestSetThreadPriority(t *testing.T) {
+	errc := make(chan error, 1)
+	go func() {
+		// the thread is terminated with the goroutine, as it is not unlocked.
+		runtime.LockOSThread()
+		if err := setThreadPriority(5); err != nil {
+			errc <- err
+			return
+		}
+		// the kernel returns 20 - niceness.
+		prio, err := unix.Getpriority(unix.PRIO_PROCESS, unix.Gettid())
+		if err == nil && prio != 15 {
+			err = fmt.Errorf("niceness should be 5, got %d", 20-prio)
+		}
+		errc <- err
+	}()
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetThreadAffinity(t *testing.T) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		t.Skip(err)
+	}
+	cpu := 0
+	for !set.IsSet(cpu) {
+		cpu++
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := setThreadAffinity([]int{cpu}); err != nil {
+			errc <- err
+			return
+		}
+		var set unix.CPUSet
+		err := unix.SchedGetaffinity(0, &set)
+		if err == nil && (set.Count() != 1 || !set.IsSet(cpu)) {
+			err = fmt.Errorf("the thread should be bound to CPU %d, got %d CPUs", cpu, set.Count())
+		}
+		errc <- err
+	}()
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
+var tunOuterTOSTests = []struct {
+	laddr  string
+	cfg    TunConfig
+	v4, v6 int // the expected marks, -1 means the family is not marked
+}{
+	{"127.0.0.1:0", TunConfig{OuterDSCP: 46}, 46 << 2, -1},
+	{"[::1]:0", TunConfig{OuterDSCP: 46}, -1, 46 << 2},
+	{"[::]:0", TunConfig{OuterDSCP: 46}, 46 << 2, 46 << 2},
+	{"127.0.0.1:0", TunConfig{PreserveTOS: true}, 0x28, -1},
+	{"[::1]:0", TunConfig{PreserveTOS: true}, -1, 0x28},
+}
+
+func TestTunOuterTOS(t *testing.T) {
+	for i, tc := range tunOuterTOSTests {
+		addr, _ := net.ResolveUDPAddr("udp", tc.laddr)
+		uc, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			t.Logf("#%d %s: %v", i, tc.laddr, err)
+			continue
+		}
+		h := TunHandler(TunConfigHandlerOption(tc.cfg)).(*tunHandler)
+		h.initTOS(uc)
+		if tc.cfg.PreserveTOS {
+			if h.tosConn == nil {
+				t.Errorf("#%d %s: the inner ToS should be preserved", i, tc.laddr)
+				uc.Close()
+				continue
+			}
+			// the ToS of an inner packet.
+			if err := h.tosConn.SetTOS(0x28); err != nil {
+				t.Errorf("#%d %s: set ToS: %v", i, tc.laddr, err)
+			}
+		} else if h.tosConn != nil {
+			t.Errorf("#%d %s: the fixed DSCP should not be overridden", i, tc.laddr)
+		}
+
+		if tc.v4 >= 0 {
+			if tos, err := ipv4.NewPacketConn(uc).TOS(); err != nil || tos != tc.v4 {
+				t.Errorf("#%d %s: ToS should be %#x, got %#x %v", i, tc.laddr, tc.v4, tos, err)
+			}
+		}
+		if tc.v6 >= 0 {
+			if class, err := ipv6.NewPacketConn(uc).TrafficClass(); err != nil || class != tc.v6 {
+				t.Errorf("#%d %s: traffic class should be %#x, got %#x %v", i, tc.laddr, tc.v6, class, err)
+			}
+		}
+		uc.Close()
+	}
+}
+
+func TestTunPreserveTOSControl(t *testing.T) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	sc, err := peer.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// receiveTOS returns the ToS of the datagram received by the peer.
+	receiveTOS := func() int {
+		b, oob := make([]byte, 1500), make([]byte, 64)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, oobn, _, _, err := peer.ReadMsgUDP(b, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+		for _, m := range msgs {
+			if m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) > 0 {
+				return int(m.Data[0])
+			}
+		}
+		t.Fatal("ToS of the datagram is not received")
+		return -1
+	}
+
+	h := TunHandler(TunConfigHandlerOption(TunConfig{PreserveTOS: true})).(*tunHandler)
+	h.initTOS(uc)
+	pkt := tunTestPacket(tunTestServerIP, tunTestClientIP)
+	pkt[1] = 0xb8
+	setIPv4Checksum(pkt)
+	if err := h.writeTo(uc, pkt, peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if tos := receiveTOS(); tos != 0xb8 {
+		t.Errorf("the data datagram should be marked by the inner ToS %#x, got %#x", 0xb8, tos)
+	}
+
+	// the keepalive reply sent after the marked packet.
+	h.handleControl(uc, []byte{0x00, tunCtrlKeepAlive}, peer.LocalAddr())
+	if tos := receiveTOS(); tos != 0 {
+		t.Errorf("the control message should not be marked, got %#x", tos)
+	}
+	if err := h.writeTo(uc, pkt, peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if tos := receiveTOS(); tos != 0xb8 {
+		t.Errorf("the data datagram should be marked again by the inner ToS %#x, got %#x", 0xb8, tos)
+	}
+}
+
+func TestTunSockBuffers(t *testing.T) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	sc, err := uc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockopt := func(opt int) (v int) {
+		sc.Control(func(fd uintptr) {
+			v, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+		})
+		return
+	}
+	snd, rcv := sockopt(unix.SO_SNDBUF), sockopt(unix.SO_RCVBUF)
+
+	// the sizes are distinct from the defaults, and within the default caps of the kernel.
+	cfg := TunConfig{
+		Upstream:   TunDirectionConfig{SockBuffer: snd/2 + 1024},
+		Downstream: TunDirectionConfig{SockBuffer: rcv/2 + 2048},
+	}
+	h := TunHandler(TunConfigHandlerOption(cfg)).(*tunHandler)
+	h.initSockBuffers(uc)
+	// the kernel doubles the size for the bookkeeping overhead.
+	if v := sockopt(unix.SO_SNDBUF); v != 2*cfg.Upstream.SockBuffer {
+		t.Errorf("send buffer should be %d, got %d", 2*cfg.Upstream.SockBuffer, v)
+	}
+	if v := sockopt(unix.SO_RCVBUF); v != 2*cfg.Downstream.SockBuffer {
+		t.Errorf("receive buffer should be %d, got %d", 2*cfg.Downstream.SockBuffer, v)
+	}
+}
+
+func TestTunRoutePersist(t *testing.T) {
+	_, dest, _ := net.ParseCIDR("198.19.0.0/24")
+	cfg := TunConfig{Name: "gosttest0", Addr: "198.18.0.1/24", Routes: []IPRoute{{Dest: dest}}, RoutePersist: true}
+	conn, _, err := createTun(cfg)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	h := TunHandler(TunConfigHandlerOption(cfg)).(*tunHandler)
+	h.tun = conn
+	done := make(chan struct{})
+	defer close(done)
+	go h.persistRoutes(done)
+
+	_, runtimeDest, _ := net.ParseCIDR("198.19.1.0/24")
+	if err := h.AddRoute(runtimeDest.String()); err != nil {
+		t.Fatal(err)
+	}
+	hasRoute := func(dest *net.IPNet) bool {
+		routes, _ := netlink.NetworkGetRoutes()
+		for _, r := range routes {
+			if r.IPNet != nil && r.IPNet.String() == dest.String() && r.Iface != nil && r.Iface.Name == cfg.Name {
+				return true
+			}
+		}
+		return false
+	}
+	waitRoutes := func() bool {
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+			if hasRoute(dest) && hasRoute(runtimeDest) {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	time.Sleep(100 * time.Millisecond) // the watch is subscribed
+	for _, dest := range []*net.IPNet{dest, runtimeDest} {
+		if err := deleteTunRoute(cfg.Name, IPRoute{Dest: dest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitRoutes() {
+		t.Error("the removed routes should be re-installed")
+	}
+
+	for _, state := range []string{"down", "up"} {
+		if out, err := exec.Command("ip", "link", "set", "dev", cfg.Name, state).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+	if !waitRoutes() {
+		t.Error("the routes should be re-installed after the interface flaps")
+	}
+}
+
+func TestTunTeardownPersist(t *testing.T) {
+	cfg := TunConfig{Name: "gosttest1", Addr: "198.18.1.1/24", Persist: true}
+	conn, _, err := createTun(cfg)
+	if err != nil {
+		t.Skip(err)
+	}
+	h := TunHandler(TunConfigHandlerOption(cfg)).(*tunHandler)
+	h.tun = conn
+	if err := h.teardown(); err != nil {
+		deleteTunDevice(cfg.Name)
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName(cfg.Name); err == nil {
+		deleteTunDevice(cfg.Name)
+		t.Error("the persistent device should be deleted by the teardown")
+	}
+}
+
+func TestTunPersistRestart(t *testing.T) {
+	_, dest, _ := net.ParseCIDR("198.19.2.0/24")
+	cfg := TunConfig{Name: "gosttest2", Addr: "198.18.2.1/24", Routes: []IPRoute{{Dest: dest}}, Persist: true}
+	conn, _, err := createTun(cfg)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer deleteTunDevice(cfg.Name)
+	conn.Close()
+
+	// the address and the routes are kept by the persistent device.
+	conn, _, err = createTun(cfg)
+	if err != nil {
+		t.Fatalf("the persistent device should be created again: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,111 @@
+package gost
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTunLoopWindow = 2 * time.Second
+	// tunLoopSigBytes is the number of the bytes of the payload after the IP header in the signature of a packet.
+	tunLoopSigBytes = 16
+	// tunLoopWarnInterval is the minimum interval of the warnings of the looped packets.
+	tunLoopWarnInterval = 10 * time.Second
+)
+
+// tunLoopDetector keeps the signatures of the packets recently sent to the peers, see TunConfig.LoopDetect.
+// It is a table of the fixed size indexed by the signature, a slot is overwritten by the newer signature,
+// so a loop is detected as long as the looped packet comes back before the slot is reused.
+type tunLoopDetector struct {
+	window int64    // nanoseconds
+	sigs   []uint64 // accessed atomically
+	times  []int64  // the time in Unix nanoseconds the signature is sent, accessed atomically
+}
+
+func newTunLoopDetector(size int, window time.Duration) *tunLoopDetector {
+	if window <= 0 {
+		window = defaultTunLoopWindow
+	}
+	return &tunLoopDetector{
+		window: int64(window),
+		sigs:   make([]uint64, size),
+		times:  make([]int64, size),
+	}
+}
+
+// tunLoopSignature returns the signature of the IP packet b, which is the FNV-1a hash of the IP header
+// and the first bytes of the payload. The TTL (hop limit) and the header checksum are excluded,
+// as they are changed by the routers on the loop. It returns zero for the datagrams other than the IP packets.
+func tunLoopSignature(b []byte) uint64 {
+	var hl, ttl, csum int
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		hl, ttl, csum = ipv4HeaderLen(b), 8, 10
+		if hl < 20 || hl > len(b) {
+			return 0
+		}
+	case len(b) >= 40 && b[0]>>4 == 6:
+		hl, ttl, csum = 40, 7, -1
+	default:
+		return 0
+	}
+	n := hl + tunLoopSigBytes
+	if n > len(b) {
+		n = len(b)
+	}
+
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	sig := uint64(offset64)
+	for i := 0; i < n; i++ {
+		c := b[i]
+		if i == ttl || i == csum || i == csum+1 {
+			c = 0
+		}
+		sig ^= uint64(c)
+		sig *= prime64
+	}
+	if sig == 0 {
+		sig = 1
+	}
+	return sig
+}
+
+// sent records the packet b sent to a peer.
+func (d *tunLoopDetector) sent(b []byte) {
+	sig := tunLoopSignature(b)
+	if sig == 0 {
+		return
+	}
+	i := sig % uint64(len(d.sigs))
+	atomic.StoreUint64(&d.sigs[i], sig)
+	atomic.StoreInt64(&d.times[i], time.Now().UnixNano())
+}
+
+// looped reports whether the packet b received from a peer is one sent to the peers within the window.
+func (d *tunLoopDetector) looped(b []byte) bool {
+	sig := tunLoopSignature(b)
+	if sig == 0 {
+		return false
+	}
+	i := sig % uint64(len(d.sigs))
+	if atomic.LoadUint64(&d.sigs[i]) != sig {
+		return false
+	}
+	return time.Now().UnixNano()-atomic.LoadInt64(&d.times[i]) <= d.window
+}
+
+// looped counts the packet src -> dst from the peer addr which is detected as looped back,
+// and warns of the loop at most once in tunLoopWarnInterval.
+func (h *tunHandler) looped(src, dst net.IP, addr net.Addr) {
+	h.stats.incr(&h.stats.looped, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&h.loopWarned)
+	if now-last < int64(tunLoopWarnInterval) || !atomic.CompareAndSwapInt64(&h.loopWarned, last, now) {
+		return
+	}
+	h.logf("routing loop: packet %s -> %s sent to the peers is received back from %s, dropped", src, dst, addr)
+}
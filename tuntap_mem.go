@@ -0,0 +1,74 @@
+package gost
+
+import (
+	"sync/atomic"
+)
+
+// tunMemLowPercent is the percentage of TunConfig.MaxMemory available for the low priority buffers,
+// i.e. the pending buffer, so they are shed first when the budget is approached.
+const tunMemLowPercent = 75
+
+// tunMemBudget bounds the memory of the packets buffered by the handler, see TunConfig.MaxMemory.
+// A nil budget is unlimited.
+type tunMemBudget struct {
+	used int64 // accessed atomically, first for the alignment on 32-bit platforms
+	max  int64
+}
+
+func newTunMemBudget(max int64) *tunMemBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &tunMemBudget{max: max}
+}
+
+// reserve accounts n bytes of a buffered packet, it reports false if the budget would be exceeded,
+// the low priority packets are bounded by tunMemLowPercent of the budget.
+func (m *tunMemBudget) reserve(n int, low bool) bool {
+	if m == nil {
+		return true
+	}
+	limit := m.max
+	if low {
+		limit = m.max * tunMemLowPercent / 100
+	}
+	if atomic.AddInt64(&m.used, int64(n)) > limit {
+		atomic.AddInt64(&m.used, -int64(n))
+		return false
+	}
+	return true
+}
+
+// release returns n bytes reserved to the budget.
+func (m *tunMemBudget) release(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.used, -int64(n))
+}
+
+// usage returns the bytes reserved.
+func (m *tunMemBudget) usage() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.used)
+}
+
+// memDropped counts the packet dropped as the memory budget is exhausted.
+func (h *tunHandler) memDropped() {
+	h.stats.incr(&h.stats.memoryDropped, 1)
+}
+
+// releaseQueue releases the packets left in queue when the writer stops, to the budget and pool.
+func (h *tunHandler) releaseQueue(queue chan []byte, pool *bufferPool) {
+	for {
+		select {
+		case b := <-queue:
+			h.mem.release(cap(b))
+			pool.Put(b[:cap(b)])
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultTunMTUWindow = 10 * time.Second
+	// tunMTUEvents is the number of the path MTU events within the window to lower the MTU.
+	tunMTUEvents = 3
+	// tunMTUHysteresis is the least change of the MTU, so the MTU does not drift with each event.
+	tunMTUHysteresis = 16
+	// tunMTUStep is the size the MTU is lowered below a packet rejected as too big by the system,
+	// as the exact path MTU is unknown.
+	tunMTUStep = 32
+	// tunMTURestoreWindows is the number of the windows without event to restore the MTU.
+	tunMTURestoreWindows = 30
+	// tunMTUNotifyInterval is the minimum interval of the ICMP packet too big sent to the peers.
+	tunMTUNotifyInterval = time.Second
+)
+
+// tunMTUSetter is the device of which the MTU can be changed at runtime.
+type tunMTUSetter interface {
+	SetMTU(mtu int) error
+}
+
+// tunMTUAdjuster is the state of AdaptiveMTU.
+type tunMTUAdjuster struct {
+	live     int32 // the lowered MTU, 0 means the configured MTU
+	mu       sync.Mutex
+	start    time.Time // start of the window of events
+	events   int       // events in the window
+	lowest   int       // the lowest MTU of the events in the window
+	last     time.Time // the time of the last event
+	notified time.Time // the time of the last ICMP packet too big sent to a peer
+}
+
+func (h *tunHandler) mtuAdjustWindow() time.Duration {
+	if d := h.options.TunConfig.MTUAdjustWindow; d > 0 {
+		return d
+	}
+	return defaultTunMTUWindow
+}
+
+// mtuEvent records an event of the path MTU dropping to mtu, the MTU of the device is lowered to the lowest
+// of the events, once tunMTUEvents events are recorded within TunConfig.MTUAdjustWindow.
+func (h *tunHandler) mtuEvent(mtu int, reason string) {
+	if !h.options.TunConfig.AdaptiveMTU {
+		return
+	}
+	if mtu < tunMinMTU {
+		mtu = tunMinMTU
+	}
+
+	a := &h.mtuAdj
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(a.start) > h.mtuAdjustWindow() {
+		a.start, a.events, a.lowest = now, 0, 0
+	}
+	a.events++
+	a.last = now
+	if a.lowest == 0 || mtu < a.lowest {
+		a.lowest = mtu
+	}
+	if a.events < tunMTUEvents {
+		return
+	}
+
+	old := h.mtu()
+	if old-a.lowest < tunMTUHysteresis {
+		return
+	}
+	h.logf("path MTU drops (%s), lower the MTU: %d -> %d", reason, old, a.lowest)
+	h.setDeviceMTU(a.lowest)
+	atomic.StoreInt32(&a.live, int32(a.lowest))
+	a.start, a.events, a.lowest = now, 0, 0
+}
+
+// restoreMTU restores the configured MTU lowered by mtuEvent, if no event is recorded in tunMTURestoreWindows windows,
+// so the tunnel recovers from a temporary path change. The MTU is lowered again if the path MTU is still low.
+func (h *tunHandler) restoreMTU() {
+	a := &h.mtuAdj
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if atomic.LoadInt32(&a.live) == 0 || time.Since(a.last) < tunMTURestoreWindows*h.mtuAdjustWindow() {
+		return
+	}
+	mtu := h.options.TunConfig.mtu()
+	h.logf("no path MTU event in %s, restore the MTU: %d",
+		tunMTURestoreWindows*h.mtuAdjustWindow(), mtu)
+	h.setDeviceMTU(mtu)
+	atomic.StoreInt32(&a.live, 0)
+	atomic.StoreInt32(&h.pmtu, 0)
+}
+
+// adjustMTU restores the lowered MTU periodically until done is closed.
+func (h *tunHandler) adjustMTU(done <-chan struct{}) {
+	ticker := time.NewTicker(h.mtuAdjustWindow())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.restoreMTU()
+		case <-done:
+			return
+		}
+	}
+}
+
+// setDeviceMTU changes the MTU of the tun device of the running transport.
+// The MTU of the handler is changed even if the device does not support it,
+// so the larger packets from the device are still answered with ICMP packet too big.
+func (h *tunHandler) setDeviceMTU(mtu int) {
+	h.mu.Lock()
+	tun := h.tun
+	h.mu.Unlock()
+
+	s, ok := tun.(tunMTUSetter)
+	if !ok {
+		return
+	}
+	if err := s.SetMTU(mtu); err != nil {
+		h.logf("%s: set MTU %d: %v", tun.LocalAddr(), mtu, err)
+	}
+}
+
+// isTunMessageTooBig reports whether the write error err is caused by the datagram larger than the path MTU known by the system.
+func isTunMessageTooBig(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// notifyMTU answers the packet b larger than the lowered MTU from the peer addr with ICMP packet too big,
+// so the peer lowers its path MTU, at most once in tunMTUNotifyInterval. The packet is still delivered.
+func (h *tunHandler) notifyMTU(conn net.PacketConn, b []byte, mtu int, addr net.Addr) {
+	if atomic.LoadInt32(&h.mtuAdj.live) == 0 || h.ip == nil {
+		return
+	}
+	// the IPv4 packets without DF are fragmented.
+	if b[0]>>4 == 4 && (len(b) < 20 || b[6]&0x40 == 0) {
+		return
+	}
+
+	h.mtuAdj.mu.Lock()
+	now := time.Now()
+	if now.Sub(h.mtuAdj.notified) < tunMTUNotifyInterval {
+		h.mtuAdj.mu.Unlock()
+		return
+	}
+	h.mtuAdj.notified = now
+	h.mtuAdj.mu.Unlock()
+
+	if pkt := icmpPacketTooBigError(h.ip, b, mtu); pkt != nil {
+		if Debug {
+			h.logf("notify %s of the MTU %d", addr, mtu)
+		}
+		if err := h.writeTo(conn, pkt, addr); err != nil {
+			h.logf("%s: %v", conn.LocalAddr(), err)
+		}
+	}
+}
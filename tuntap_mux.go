@@ -0,0 +1,147 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunMuxAddr is the outer address of a peer received on one of the sockets of tunMuxConn.
+// The handler keeps the address in its peers and routes, so the replies to the peer are sent
+// on the socket it arrived on, and its source address is the one the peer sent to.
+type tunMuxAddr struct {
+	net.Addr
+	conn net.PacketConn
+}
+
+var errTunMuxClosed = errors.New("use of closed connection")
+
+type tunMuxRead struct {
+	b    []byte
+	n    int
+	addr net.Addr
+	err  error
+}
+
+// tunMuxConn is the tunnel connection of the server over the sockets bound to several local addresses,
+// see TunConfig.ListenAddrs. The datagrams received on the sockets are read in turn by ReadFrom.
+type tunMuxConn struct {
+	conns  []net.PacketConn
+	reads  chan tunMuxRead
+	pool   *bufferPool
+	closed chan struct{}
+	once   sync.Once
+}
+
+// listenTunMux binds the sockets of tr to the local addresses laddrs, the datagrams are read
+// into the buffers of pool, which should be the pool of the reader.
+func listenTunMux(tr TunTransporter, laddrs []string, pool *bufferPool) (net.PacketConn, error) {
+	c := &tunMuxConn{
+		reads:  make(chan tunMuxRead),
+		pool:   pool,
+		closed: make(chan struct{}),
+	}
+	for _, laddr := range laddrs {
+		pc, err := tr.PacketConn(laddr, "")
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, pc)
+	}
+	for _, pc := range c.conns {
+		go c.read(pc)
+	}
+	return c, nil
+}
+
+func (c *tunMuxConn) read(pc net.PacketConn) {
+	for {
+		b := c.pool.Get().([]byte)
+		n, addr, err := pc.ReadFrom(b)
+		if addr != nil {
+			addr = &tunMuxAddr{Addr: addr, conn: pc}
+		}
+		select {
+		case c.reads <- tunMuxRead{b: b, n: n, addr: addr, err: err}:
+		case <-c.closed:
+			c.pool.Put(b)
+			return
+		}
+		if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Temporary()) {
+			return
+		}
+	}
+}
+
+func (c *tunMuxConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	select {
+	case r := <-c.reads:
+		n = copy(b, r.b[:r.n])
+		c.pool.Put(r.b)
+		return n, r.addr, r.err
+	case <-c.closed:
+		return 0, nil, errTunMuxClosed
+	}
+}
+
+// WriteTo sends b on the socket the peer addr arrived on. The address not received from the peer,
+// e.g. of a static route, is sent on the first socket of the same address family.
+func (c *tunMuxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if a, ok := addr.(*tunMuxAddr); ok {
+		return a.conn.WriteTo(b, a.Addr)
+	}
+	return c.connFor(addr).WriteTo(b, addr)
+}
+
+func (c *tunMuxConn) connFor(addr net.Addr) net.PacketConn {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return c.conns[0]
+	}
+	for _, pc := range c.conns {
+		la, ok := pc.LocalAddr().(*net.UDPAddr)
+		if !ok || la.IP == nil || la.IP.IsUnspecified() && la.IP.To4() == nil ||
+			(la.IP.To4() == nil) == (ua.IP.To4() == nil) {
+			return pc
+		}
+	}
+	return c.conns[0]
+}
+
+func (c *tunMuxConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		for _, pc := range c.conns {
+			pc.Close()
+		}
+	})
+	return nil
+}
+
+// LocalAddr returns the address of the first socket.
+func (c *tunMuxConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *tunMuxConn) SetDeadline(t time.Time) error {
+	return c.each(func(pc net.PacketConn) error { return pc.SetDeadline(t) })
+}
+
+func (c *tunMuxConn) SetReadDeadline(t time.Time) error {
+	return c.each(func(pc net.PacketConn) error { return pc.SetReadDeadline(t) })
+}
+
+func (c *tunMuxConn) SetWriteDeadline(t time.Time) error {
+	return c.each(func(pc net.PacketConn) error { return pc.SetWriteDeadline(t) })
+}
+
+func (c *tunMuxConn) each(f func(net.PacketConn) error) (err error) {
+	for _, pc := range c.conns {
+		if e := f(pc); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
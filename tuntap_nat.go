@@ -0,0 +1,216 @@
+package gost
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/songgao/water/waterutil"
+)
+
+const (
+	tunNATPortMin = 1024
+	tunNATPortMax = 65535
+)
+
+var (
+	// tunNATTimeout is the idle time after which a NAT flow can be reused.
+	tunNATTimeout = 5 * time.Minute
+)
+
+type tunNATKey struct {
+	proto waterutil.IPProtocol
+	ip    [4]byte
+	port  uint16
+}
+
+type tunNATPortKey struct {
+	proto waterutil.IPProtocol
+	port  uint16
+}
+
+type tunNATEntry struct {
+	key  tunNATKey
+	port uint16
+	seen time.Time
+}
+
+// tunNAT translates the source address of the IPv4 packets received from the peers
+// to a single address, and translates the destination of the return traffic back.
+// TCP and UDP flows are mapped by the source port, ICMP echo by the identifier.
+// The flows expire lazily, an idle flow is only released when its port is reused.
+type tunNAT struct {
+	addr  net.IP
+	mu    sync.Mutex
+	flows map[tunNATKey]*tunNATEntry
+	ports map[tunNATPortKey]*tunNATEntry
+	next  int
+}
+
+func newTunNAT(addr net.IP) *tunNAT {
+	return &tunNAT{
+		addr:  addr.To4(),
+		flows: make(map[tunNATKey]*tunNATEntry),
+		ports: make(map[tunNATPortKey]*tunNATEntry),
+		next:  tunNATPortMin,
+	}
+}
+
+// tunNATFields returns the offsets of the port (or the ICMP echo identifier) and the checksum
+// of the transport header in the IPv4 packet b. The source port is used for the outbound packet,
+// and the destination port for the return packet.
+func tunNATFields(b []byte, outbound bool) (portOff, sumOff int, ok bool) {
+	hl := ipv4HeaderLen(b)
+	if ipv4FragOffset(b) != 0 {
+		return
+	}
+
+	switch waterutil.IPv4Protocol(b) {
+	case waterutil.TCP:
+		if len(b) < hl+18 {
+			return
+		}
+		portOff, sumOff = hl, hl+16
+	case waterutil.UDP:
+		if len(b) < hl+8 {
+			return
+		}
+		portOff, sumOff = hl, hl+6
+	case waterutil.ICMP:
+		if len(b) < hl+8 {
+			return
+		}
+		// only echo request is allowed to pass through, and echo reply to return.
+		if outbound && b[hl] != 8 || !outbound && b[hl] != 0 {
+			return
+		}
+		return hl + 4, hl + 2, true
+	default:
+		return
+	}
+
+	if !outbound {
+		portOff += 2
+	}
+	return portOff, sumOff, true
+}
+
+// translate rewrites the source of the outbound packet b to the NAT address,
+// it reports false if the packet can not be translated.
+func (n *tunNAT) translate(b []byte) bool {
+	portOff, sumOff, ok := tunNATFields(b, true)
+	if !ok {
+		return false
+	}
+
+	key := tunNATKey{
+		proto: waterutil.IPv4Protocol(b),
+		port:  binary.BigEndian.Uint16(b[portOff:]),
+	}
+	copy(key.ip[:], b[12:16])
+
+	port, ok := n.lookup(key)
+	if !ok {
+		return false
+	}
+
+	var addr [6]byte
+	copy(addr[:], n.addr)
+	binary.BigEndian.PutUint16(addr[4:], port)
+	n.rewrite(b, 12, portOff, sumOff, addr[:])
+	return true
+}
+
+// reverse rewrites the destination of the return packet b to the original source,
+// it reports false if there is no flow for the packet.
+func (n *tunNAT) reverse(b []byte) bool {
+	portOff, sumOff, ok := tunNATFields(b, false)
+	if !ok {
+		return false
+	}
+
+	pk := tunNATPortKey{
+		proto: waterutil.IPv4Protocol(b),
+		port:  binary.BigEndian.Uint16(b[portOff:]),
+	}
+
+	n.mu.Lock()
+	e := n.ports[pk]
+	if e != nil {
+		e.seen = time.Now()
+	}
+	n.mu.Unlock()
+	if e == nil {
+		return false
+	}
+
+	var addr [6]byte
+	copy(addr[:], e.key.ip[:])
+	binary.BigEndian.PutUint16(addr[4:], e.key.port)
+	n.rewrite(b, 16, portOff, sumOff, addr[:])
+	return true
+}
+
+// rewrite replaces the address at ipOff and the port at portOff of the packet b with addr,
+// and fixes up the checksums.
+func (n *tunNAT) rewrite(b []byte, ipOff, portOff, sumOff int, addr []byte) {
+	var old [6]byte
+	copy(old[:4], b[ipOff:ipOff+4])
+	copy(old[4:], b[portOff:portOff+2])
+
+	copy(b[ipOff:], addr[:4])
+	copy(b[portOff:], addr[4:])
+
+	sum := binary.BigEndian.Uint16(b[sumOff:])
+	switch waterutil.IPv4Protocol(b) {
+	case waterutil.ICMP:
+		// ICMP checksum does not cover the pseudo header.
+		sum = checksumUpdate(sum, old[4:], addr[4:])
+	case waterutil.UDP:
+		// zero checksum means no checksum for UDP.
+		if sum == 0 {
+			break
+		}
+		if sum = checksumUpdate(sum, old[:], addr); sum == 0 {
+			sum = 0xffff
+		}
+	default:
+		sum = checksumUpdate(sum, old[:], addr)
+	}
+	binary.BigEndian.PutUint16(b[sumOff:], sum)
+
+	setIPv4Checksum(b)
+}
+
+func (n *tunNAT) lookup(key tunNATKey) (uint16, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if e := n.flows[key]; e != nil {
+		e.seen = now
+		return e.port, true
+	}
+
+	for i := tunNATPortMin; i <= tunNATPortMax; i++ {
+		port := uint16(n.next)
+		if n.next++; n.next > tunNATPortMax {
+			n.next = tunNATPortMin
+		}
+
+		pk := tunNATPortKey{proto: key.proto, port: port}
+		if e := n.ports[pk]; e != nil {
+			if now.Sub(e.seen) < tunNATTimeout {
+				continue
+			}
+			delete(n.flows, e.key)
+		}
+
+		e := &tunNATEntry{key: key, port: port, seen: now}
+		n.flows[key] = e
+		n.ports[pk] = e
+		return port, true
+	}
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package gost
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TunObfs is the framing of the outer datagrams of tun tunnel.
+type TunObfs string
+
+const (
+	// TunObfsNone sends the datagrams as is.
+	TunObfsNone TunObfs = "none"
+	// TunObfsSTUN prepends a header resembling a STUN binding request (RFC 5389) to each datagram.
+	TunObfsSTUN TunObfs = "stun-like"
+)
+
+// The STUN-like header, the length is the length of the payload,
+// and the transaction ID is random for each datagram.
+//
+//	+------------+--------+--------------+----------------+---------+
+//	| 0x00 0x01  | LENGTH | 0x2112A442   | TRANSACTION ID | PAYLOAD |
+//	+------------+--------+--------------+----------------+---------+
+//	      2          2          4                12
+const (
+	tunSTUNHeaderLen   = 20
+	tunSTUNMagicCookie = 0x2112A442
+)
+
+var errTunObfs = errors.New("invalid obfuscation framing")
+
+// overhead returns the size of the framing.
+func (o TunObfs) overhead() int {
+	if o == TunObfsSTUN {
+		return tunSTUNHeaderLen
+	}
+	return 0
+}
+
+func (o TunObfs) validate() error {
+	switch o {
+	case "", TunObfsNone, TunObfsSTUN:
+		return nil
+	}
+	return fmt.Errorf("unknown obfuscation %q", string(o))
+}
+
+// tunSTUNConn frames the outer datagrams with the STUN-like header.
+// The datagrams without a valid header are reported as *tunDecryptError, so they are dropped.
+type tunSTUNConn struct {
+	net.PacketConn
+	pool *bufferPool
+}
+
+func (c *tunSTUNConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return
+	}
+	if n < tunSTUNHeaderLen || binary.BigEndian.Uint16(b) != 0x0001 ||
+		binary.BigEndian.Uint32(b[4:]) != tunSTUNMagicCookie ||
+		int(binary.BigEndian.Uint16(b[2:])) != n-tunSTUNHeaderLen {
+		return 0, addr, &tunDecryptError{err: errTunObfs}
+	}
+	return copy(b, b[tunSTUNHeaderLen:n]), addr, nil
+}
+
+func (c *tunSTUNConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := c.pool.Get().([]byte)
+	defer c.pool.Put(buf)
+	if n := tunSTUNHeaderLen + len(b); len(buf) < n {
+		buf = make([]byte, n)
+	}
+	binary.BigEndian.PutUint16(buf, 0x0001)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(buf[4:], tunSTUNMagicCookie)
+	rand.Read(buf[8:tunSTUNHeaderLen])
+	n := copy(buf[tunSTUNHeaderLen:], b)
+
+	if _, err := c.PacketConn.WriteTo(buf[:tunSTUNHeaderLen+n], addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TunTransform is an encoding of the outer datagrams of tun tunnel, see TunConfig.Transform.
+// The methods are called concurrently by the goroutines sending and receiving the datagrams.
+type TunTransform interface {
+	// Encode returns the encoding of the datagram b. It must not modify b,
+	// as b may be sent to more peers, e.g. a broadcast without encryption.
+	Encode(b []byte) []byte
+	// Decode returns the datagram of the encoding b, it can decode b in place.
+	Decode(b []byte) ([]byte, error)
+}
+
+// tunTransformConn encodes the outer datagrams with TunConfig.Transform.
+// The datagrams can not be decoded are reported as *tunDecryptError, so they are dropped.
+type tunTransformConn struct {
+	net.PacketConn
+	t TunTransform
+}
+
+func (c *tunTransformConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return
+	}
+	p, err := c.t.Decode(b[:n])
+	if err != nil {
+		return 0, addr, &tunDecryptError{err: err}
+	}
+	if len(p) > len(b) {
+		return 0, addr, &tunDecryptError{err: errTunObfs}
+	}
+	return copy(b, p), addr, nil
+}
+
+func (c *tunTransformConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, err := c.PacketConn.WriteTo(c.t.Encode(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
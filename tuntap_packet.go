@@ -0,0 +1,504 @@
+package gost
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"github.com/songgao/water/waterutil"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// checksum computes the Internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// checksumPseudo computes the Internet checksum of the pseudo header ph followed by b, ph must have an even length.
+func checksumPseudo(ph, b []byte) uint16 {
+	var sum uint32
+	for ; len(ph) >= 2; ph = ph[2:] {
+		sum += uint32(ph[0])<<8 | uint32(ph[1])
+	}
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// checksumUpdate incrementally updates the checksum sum (RFC 1624)
+// for the change of data from old to new, both must have the same even length.
+func checksumUpdate(sum uint16, old, new []byte) uint16 {
+	s := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		s += uint32(^binary.BigEndian.Uint16(old[i:]))
+		s += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// ipv4HeaderLen returns the header length of the IPv4 packet b.
+func ipv4HeaderLen(b []byte) int {
+	return int(b[0]&0x0f) << 2
+}
+
+// setIPv4Checksum recomputes the header checksum of the IPv4 packet b.
+func setIPv4Checksum(b []byte) {
+	hl := ipv4HeaderLen(b)
+	b[10], b[11] = 0, 0
+	binary.BigEndian.PutUint16(b[10:], checksum(b[:hl]))
+}
+
+// completeChecksums fills the checksums of the IPv4 header and of the TCP or UDP packet over IPv4 and IPv6
+// in the packet b which are not valid, it reports whether a checksum is filled. A zero UDP checksum over IPv4,
+// which means no checksum, is filled as well. The fragments and the IPv6 packets with extension headers are
+// left unchanged, as the checksums of them can not be computed from the packet alone.
+func completeChecksums(b []byte) bool {
+	var ph [40]byte
+	var l4 []byte
+	var proto byte
+	completed := false
+
+	switch {
+	case len(b) >= ipv4.HeaderLen && b[0]>>4 == 4:
+		hl := ipv4HeaderLen(b)
+		total := int(binary.BigEndian.Uint16(b[2:]))
+		if hl < ipv4.HeaderLen || total < hl || total > len(b) {
+			return false
+		}
+		if checksum(b[:hl]) != 0 {
+			setIPv4Checksum(b)
+			completed = true
+		}
+		if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return completed
+		}
+		proto, l4 = b[9], b[hl:total]
+		copy(ph[0:8], b[12:20])
+		ph[9] = proto
+		binary.BigEndian.PutUint16(ph[10:], uint16(len(l4)))
+		return completeL4Checksum(ph[:12], l4, proto) || completed
+	case len(b) >= ipv6.HeaderLen && b[0]>>4 == 6:
+		total := ipv6.HeaderLen + int(binary.BigEndian.Uint16(b[4:]))
+		if total > len(b) {
+			return false
+		}
+		proto, l4 = b[6], b[ipv6.HeaderLen:total]
+		copy(ph[0:32], b[8:40])
+		binary.BigEndian.PutUint32(ph[32:], uint32(len(l4)))
+		ph[39] = proto
+		return completeL4Checksum(ph[:], l4, proto)
+	}
+	return false
+}
+
+// completeL4Checksum fills the checksum of the TCP or UDP packet b with the pseudo header ph if it is not valid.
+func completeL4Checksum(ph, b []byte, proto byte) bool {
+	var off int
+	switch {
+	case proto == 6 && len(b) >= 20:
+		off = 16
+	case proto == 17 && len(b) >= 8:
+		off = 6
+	default:
+		return false
+	}
+	if checksumPseudo(ph, b) == 0 && (proto != 17 || b[6]|b[7] != 0) {
+		return false
+	}
+	b[off], b[off+1] = 0, 0
+	sum := checksumPseudo(ph, b)
+	if proto == 17 && sum == 0 {
+		// zero means no checksum for UDP.
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[off:], sum)
+	return true
+}
+
+// ipv4FragOffset returns the fragment offset of the IPv4 packet b.
+func ipv4FragOffset(b []byte) int {
+	return int(binary.BigEndian.Uint16(b[6:]) & 0x1fff)
+}
+
+// fragmentIPv4 fragments the IPv4 packet b into the fragments of at most mtu bytes (RFC 791),
+// the options not of the copied class are only in the first fragment, and DF is cleared in the fragments
+// if clearDF is set. It returns nil if b is not larger than mtu, or mtu is too small for the header.
+func fragmentIPv4(b []byte, mtu int, clearDF bool) [][]byte {
+	hl := ipv4HeaderLen(b)
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if hl < ipv4.HeaderLen || total < hl || total > len(b) || total <= mtu {
+		return nil
+	}
+	b = b[:total]
+
+	// the header of the other fragments with the copied options.
+	header := append([]byte(nil), b[:ipv4.HeaderLen]...)
+	for i := ipv4.HeaderLen; i < hl && b[i] != 0; {
+		if b[i] == 1 { // no operation
+			i++
+			continue
+		}
+		if i+1 >= hl || b[i+1] < 2 || i+int(b[i+1]) > hl {
+			break
+		}
+		if b[i]&0x80 != 0 {
+			header = append(header, b[i:i+int(b[i+1])]...)
+		}
+		i += int(b[i+1])
+	}
+	for len(header)%4 != 0 {
+		header = append(header, 0) // end of options
+	}
+
+	flags := binary.BigEndian.Uint16(b[6:])
+	offset := int(flags&0x1fff) << 3
+	flags &= 0x6000 // DF and MF of the last fragment
+	if clearDF {
+		flags &^= 0x4000
+	}
+	var frags [][]byte
+	for hdr, payload := b[:hl], b[hl:]; len(payload) > 0; hdr = header {
+		size := (mtu - len(hdr)) &^ 7
+		if size <= 0 {
+			return nil
+		}
+		fl := flags | 0x2000
+		if size >= len(payload) {
+			size, fl = len(payload), flags
+		}
+		f := make([]byte, len(hdr)+size)
+		copy(f, hdr)
+		copy(f[len(hdr):], payload[:size])
+		f[0] = 0x40 | byte(len(hdr)>>2)
+		binary.BigEndian.PutUint16(f[2:], uint16(len(f)))
+		binary.BigEndian.PutUint16(f[6:], fl|uint16(offset>>3))
+		setIPv4Checksum(f)
+		frags = append(frags, f)
+		offset += size
+		payload = payload[size:]
+	}
+	return frags
+}
+
+// icmpHostUnreachable builds the ICMP host unreachable message (ICMPv6 address unreachable for IPv6)
+// from src for the packet b, it returns nil if the error must not be sent for b (RFC 1122, RFC 4443),
+// or src is not of the same address family as b.
+func icmpHostUnreachable(src net.IP, b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return icmpv4Error(src.To4(), b, 3, 1, 0) // destination unreachable, host unreachable
+	case 6:
+		if src.To4() != nil {
+			return nil
+		}
+		return icmpv6Error(src.To16(), b, 1, 3, 0) // destination unreachable, address unreachable
+	}
+	return nil
+}
+
+// icmpPacketTooBigError builds the ICMP fragmentation needed message (ICMPv6 packet too big for IPv6)
+// of the next-hop mtu from src for the packet b, in the same way as icmpHostUnreachable.
+func icmpPacketTooBigError(src net.IP, b []byte, mtu int) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return icmpv4Error(src.To4(), b, 3, 4, uint32(mtu))
+	case 6:
+		if src.To4() != nil {
+			return nil
+		}
+		return icmpv6Error(src.To16(), b, 2, 0, uint32(mtu))
+	}
+	return nil
+}
+
+// icmpTimeExceeded builds the ICMP time exceeded in transit message (ICMPv6 hop limit exceeded for IPv6)
+// from src for the packet b, in the same way as icmpHostUnreachable.
+func icmpTimeExceeded(src net.IP, b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return icmpv4Error(src.To4(), b, 11, 0, 0)
+	case 6:
+		if src.To4() != nil {
+			return nil
+		}
+		return icmpv6Error(src.To16(), b, 3, 0, 0)
+	}
+	return nil
+}
+
+// decrementTTL decrements the TTL (hop limit for IPv6) of the packet b in place,
+// it reports false and leaves b unchanged if the TTL would reach zero.
+func decrementTTL(b []byte) bool {
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 || b[8] <= 1 {
+			return false
+		}
+		old := []byte{b[8], b[9]}
+		b[8]--
+		binary.BigEndian.PutUint16(b[10:], checksumUpdate(binary.BigEndian.Uint16(b[10:]), old, b[8:10]))
+	case 6:
+		if len(b) < 40 || b[7] <= 1 {
+			return false
+		}
+		b[7]--
+	}
+	return true
+}
+
+// icmpv4Error builds the ICMP error message of type and code for the packet b,
+// info is the 4 bytes following the checksum.
+func icmpv4Error(src net.IP, b []byte, typ, code byte, info uint32) []byte {
+	if src == nil || len(b) < 20 || len(b) < ipv4HeaderLen(b) || ipv4FragOffset(b) != 0 {
+		return nil
+	}
+	hl := ipv4HeaderLen(b)
+	if !icmpErrorAllowed(net.IP(b[12:16]), net.IP(b[16:20])) {
+		return nil
+	}
+	// never reply an ICMP error message.
+	if b[9] == 1 && len(b) > hl {
+		switch b[hl] {
+		case 3, 4, 5, 11, 12:
+			return nil
+		}
+	}
+
+	// the original header and the first 8 bytes of the payload.
+	n := hl + 8
+	if n > len(b) {
+		n = len(b)
+	}
+	pkt := make([]byte, 20+8+n)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 1
+	copy(pkt[12:16], src)
+	copy(pkt[16:20], b[12:16])
+	setIPv4Checksum(pkt)
+
+	m := pkt[20:]
+	m[0], m[1] = typ, code
+	binary.BigEndian.PutUint32(m[4:], info)
+	copy(m[8:], b[:n])
+	binary.BigEndian.PutUint16(m[2:], checksum(m))
+	return pkt
+}
+
+// icmpv6Error builds the ICMPv6 error message of type and code for the packet b,
+// info is the 4 bytes following the checksum.
+func icmpv6Error(src net.IP, b []byte, typ, code byte, info uint32) []byte {
+	if src == nil || len(b) < 40 {
+		return nil
+	}
+	if !icmpErrorAllowed(net.IP(b[8:24]), net.IP(b[24:40])) {
+		return nil
+	}
+	// never reply an ICMPv6 error message.
+	if b[6] == 58 && len(b) > 40 && b[40] < 128 {
+		return nil
+	}
+
+	// as much of the original packet as possible without exceeding the minimum IPv6 MTU.
+	n := len(b)
+	if n > 1280-40-8 {
+		n = 1280 - 40 - 8
+	}
+	pkt := make([]byte, 40+8+n)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(8+n))
+	pkt[6] = 58
+	pkt[7] = 64
+	copy(pkt[8:24], src)
+	copy(pkt[24:40], b[8:24])
+
+	m := pkt[40:]
+	m[0], m[1] = typ, code
+	binary.BigEndian.PutUint32(m[4:], info)
+	copy(m[8:], b[:n])
+
+	ph := make([]byte, 40, 40+len(m))
+	copy(ph[0:32], pkt[8:40])
+	binary.BigEndian.PutUint32(ph[32:], uint32(len(m)))
+	ph[39] = 58
+	binary.BigEndian.PutUint16(m[2:], checksum(append(ph, m...)))
+	return pkt
+}
+
+// icmpEchoReply turns the ICMP echo request (or ICMPv6 echo request) b to ip into the echo reply in place,
+// it reports false and leaves b unchanged if b is not such a request.
+func icmpEchoReply(b []byte, ip net.IP) bool {
+	if len(b) == 0 {
+		return false
+	}
+	var icmp []byte
+	switch b[0] >> 4 {
+	case 4:
+		ip = ip.To4()
+		if ip == nil || len(b) < 20 || b[9] != 1 || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return false
+		}
+		hl := ipv4HeaderLen(b)
+		if len(b) < hl+8 || !net.IP(b[16:20]).Equal(ip) || b[hl] != 8 || b[hl+1] != 0 {
+			return false
+		}
+		icmp = b[hl:]
+		icmp[0] = 0
+		var src [4]byte
+		copy(src[:], b[12:16])
+		copy(b[12:16], b[16:20])
+		copy(b[16:20], src[:])
+		b[8] = 64
+		setIPv4Checksum(b)
+		sum := checksumUpdate(binary.BigEndian.Uint16(icmp[2:]), []byte{8, 0}, icmp[:2])
+		binary.BigEndian.PutUint16(icmp[2:], sum)
+	case 6:
+		if ip.To4() != nil || len(b) < 40+8 || b[6] != 58 || !net.IP(b[24:40]).Equal(ip) || b[40] != 128 {
+			return false
+		}
+		icmp = b[40:]
+		icmp[0] = 129
+		var src [16]byte
+		copy(src[:], b[8:24])
+		copy(b[8:24], b[24:40])
+		copy(b[24:40], src[:])
+		b[7] = 64
+		// the pseudo header is not changed by swapping the addresses.
+		sum := checksumUpdate(binary.BigEndian.Uint16(icmp[2:]), []byte{128, icmp[1]}, icmp[:2])
+		binary.BigEndian.PutUint16(icmp[2:], sum)
+	default:
+		return false
+	}
+	return true
+}
+
+// icmpErrorAllowed reports whether an ICMP error can be sent for the packet from src to dst.
+func icmpErrorAllowed(src, dst net.IP) bool {
+	if src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() {
+		return false
+	}
+	if ip := dst.To4(); ip != nil && ip.Equal(net.IPv4bcast) {
+		return false
+	}
+	return true
+}
+
+// flowAddrs returns the source and destination of the packet for logging,
+// the ports in the transport header l4 are included for TCP and UDP.
+func flowAddrs(src, dst net.IP, proto int, l4 []byte) (string, string) {
+	if (proto != int(waterutil.TCP) && proto != int(waterutil.UDP)) || len(l4) < 4 {
+		return src.String(), dst.String()
+	}
+	return net.JoinHostPort(src.String(), strconv.Itoa(int(binary.BigEndian.Uint16(l4[0:])))),
+		net.JoinHostPort(dst.String(), strconv.Itoa(int(binary.BigEndian.Uint16(l4[2:]))))
+}
+
+// udpPacket builds the IPv4 (or IPv6 if src is not an IPv4 address) UDP packet of payload
+// from src:sport to dst:dport, with both the header and UDP checksums.
+func udpPacket(src, dst net.IP, sport, dport int, payload []byte) []byte {
+	var pkt, ph []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pkt = make([]byte, 20+8+len(payload))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8] = 64
+		pkt[9] = 17
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		setIPv4Checksum(pkt)
+
+		ph = make([]byte, 12, 12+8+len(payload))
+		copy(ph[0:8], pkt[12:20])
+		ph[9] = 17
+		binary.BigEndian.PutUint16(ph[10:], uint16(8+len(payload)))
+	} else {
+		pkt = make([]byte, 40+8+len(payload))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(8+len(payload)))
+		pkt[6] = 17
+		pkt[7] = 64
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+
+		ph = make([]byte, 40, 40+8+len(payload))
+		copy(ph[0:32], pkt[8:40])
+		binary.BigEndian.PutUint32(ph[32:], uint32(8+len(payload)))
+		ph[39] = 17
+	}
+
+	udp := pkt[len(pkt)-8-len(payload):]
+	binary.BigEndian.PutUint16(udp[0:], uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dport))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+	sum := checksum(append(ph, udp...))
+	if sum == 0 {
+		// zero means no checksum for UDP.
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return pkt
+}
+
+// udpPayload returns the source port, destination port and payload of the UDP packet b to dst,
+// it reports false if b is not an unfragmented UDP packet to dst.
+func udpPayload(b []byte, dst net.IP) (sport, dport int, payload []byte, ok bool) {
+	if len(b) == 0 {
+		return
+	}
+	var udp []byte
+	switch b[0] >> 4 {
+	case 4:
+		if dst.To4() == nil || len(b) < 20 || b[9] != 17 || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return
+		}
+		if hl := ipv4HeaderLen(b); len(b) >= hl && net.IP(b[16:20]).Equal(dst) {
+			udp = b[hl:]
+		}
+	case 6:
+		if dst.To4() == nil && len(b) >= 40 && b[6] == 17 && net.IP(b[24:40]).Equal(dst) {
+			udp = b[40:]
+		}
+	}
+	if len(udp) < 8 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(udp[4:]))
+	if n < 8 || n > len(udp) {
+		return
+	}
+	sport = int(binary.BigEndian.Uint16(udp[0:]))
+	dport = int(binary.BigEndian.Uint16(udp[2:]))
+	return sport, dport, udp[8:n], true
+}
@@ -0,0 +1,113 @@
+package gost
+
+import (
+	"net"
+	"time"
+)
+
+// TunPacketConn is a net.PacketConn over the tun tunnel, which carries the datagrams of the application
+// instead of the IP packets of a tun device. The datagrams are sent to and received from the outer
+// addresses of the peers in the data messages of the tunnel, encrypted with the cipher of the handler
+// options, and with the obfuscation, transform and padding of TunConfig applied as by the handler.
+//
+// The peers are learned from the datagrams received as by the handler, and the keepalives of the peers
+// are answered, so the other side can detect a dead peer. The IP packets received from a tun handler are dropped.
+type TunPacketConn struct {
+	conn net.PacketConn // the tunnel connection
+	h    *tunHandler
+}
+
+// NewTunPacketConn creates the TunPacketConn over the packet connection pc, e.g. a UDP socket,
+// with the handler options, e.g. UsersHandlerOption to encrypt the tunnel and TunConfigHandlerOption.
+// The other side of the tunnel is another TunPacketConn with the same options.
+func NewTunPacketConn(pc net.PacketConn, opts ...HandlerOption) (*TunPacketConn, error) {
+	h := TunHandler(opts...).(*tunHandler)
+	if err := h.initConfig(); err != nil {
+		return nil, err
+	}
+	conn, err := h.initTunnelConn(pc)
+	if err != nil {
+		return nil, err
+	}
+	return &TunPacketConn{conn: conn, h: h}, nil
+}
+
+// ReadFrom reads a datagram of the peer addr into b. The datagrams can not be decrypted are dropped,
+// unless TunConfig.DecryptFloodTeardown is set and they persist.
+func (c *TunPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	pool := c.h.bufferPool()
+	buf := pool.Get().([]byte)
+	defer pool.Put(buf)
+
+	for {
+		n, addr, err = c.conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(*tunDecryptError); ok {
+				if err = c.h.decryptFailed(addr, e); err != nil {
+					return 0, addr, err
+				}
+				continue
+			}
+			return
+		}
+		if !isTunControl(buf[:n]) {
+			if Debug {
+				c.h.logf("%s: drop IP packet from %s", c.conn.LocalAddr(), addr)
+			}
+			continue
+		}
+		if buf[1] != tunCtrlData {
+			c.h.countRx(c.h.peerSeen(addr), n)
+			c.h.handleControl(c.conn, buf[:n], addr)
+			continue
+		}
+		c.h.countRx(c.h.peerFor(addr), n)
+		return copy(b, buf[2:n]), addr, nil
+	}
+}
+
+// WriteTo sends the datagram b to the peer addr.
+func (c *TunPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pool := c.h.bufferPool()
+	buf := pool.Get().([]byte)
+	defer pool.Put(buf)
+
+	if len(b)+2 > len(buf) {
+		buf = make([]byte, len(b)+2)
+	}
+	buf[0], buf[1] = 0x00, tunCtrlData
+	n := copy(buf[2:], b)
+	if err := c.h.writeTo(c.conn, buf[:2+n], addr); err != nil {
+		if e, ok := err.(*TunShutdownError); ok {
+			err = e.Err
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Stats returns the stats of the datagrams and the peers of the connection.
+func (c *TunPacketConn) Stats() TunStats {
+	return c.h.Stats()
+}
+
+// Close closes the underlying packet connection.
+func (c *TunPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *TunPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *TunPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *TunPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *TunPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,70 @@
+package gost
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+)
+
+// The random padding is appended to each datagram before it is encrypted when TunConfig.Padding is set,
+// and the length of the padding is appended after it, so that the receiver can strip it.
+//
+//	+-----------+---------+-------------+
+//	| IP PACKET | PADDING | PADDING LEN |
+//	+-----------+---------+-------------+
+//	                            2
+const tunPaddingTrailerLen = 2
+
+var errTunPadding = errors.New("invalid padding")
+
+// tunPaddingConn pads the datagrams written to the tunnel connection,
+// and strips the padding of the datagrams read from it.
+type tunPaddingConn struct {
+	net.PacketConn
+	max  int // the maximum padding size
+	mtu  int // a packet is not padded beyond the MTU
+	pool *bufferPool
+}
+
+func (c *tunPaddingConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return
+	}
+	if n < tunPaddingTrailerLen {
+		return 0, addr, &tunDecryptError{err: errTunPadding}
+	}
+	n -= tunPaddingTrailerLen
+	pad := int(binary.BigEndian.Uint16(b[n:]))
+	if pad > n {
+		return 0, addr, &tunDecryptError{err: errTunPadding}
+	}
+	return n - pad, addr, nil
+}
+
+func (c *tunPaddingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	max := c.max
+	if room := c.mtu - len(b); room < max {
+		max = room
+	}
+	pad := 0
+	if max > 0 {
+		pad = rand.Intn(max + 1)
+	}
+
+	buf := c.pool.Get().([]byte)
+	defer c.pool.Put(buf)
+	if n := len(b) + pad + tunPaddingTrailerLen; len(buf) < n {
+		// the control message or the oversized packet
+		buf = make([]byte, n)
+	}
+	n := copy(buf, b)
+	rand.Read(buf[n : n+pad])
+	binary.BigEndian.PutUint16(buf[n+pad:], uint16(pad))
+
+	if _, err := c.PacketConn.WriteTo(buf[:n+pad+tunPaddingTrailerLen], addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
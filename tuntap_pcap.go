@@ -0,0 +1,219 @@
+package gost
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The link types of pcap supported by ReadTunPcap, WriteTunPcap writes LINKTYPE_RAW.
+const (
+	pcapLinkEthernet = 1
+	pcapLinkRawOld   = 12 // DLT_RAW on most platforms
+	pcapLinkRaw      = 101
+	pcapLinkLinuxSLL = 113
+	pcapLinkIPv4     = 228
+	pcapLinkIPv6     = 229
+)
+
+const (
+	pcapHeaderLen       = 24
+	pcapRecordHeaderLen = 16
+	pcapMaxSnapLen      = 262144
+)
+
+var errPcapMagic = errors.New("pcap: unknown magic number, only the classic pcap format is supported")
+
+// ReadTunPcap reads the inner IP packets from the capture in the classic pcap format (not pcapng) read from r,
+// e.g. captured by "tcpdump -i tun0 -w file". The captures of raw IP, Ethernet and Linux cooked
+// link types are supported, the link headers are stripped, and the frames not of IPv4 or IPv6 are skipped.
+func ReadTunPcap(r io.Reader) (pkts [][]byte, err error) {
+	hdr := make([]byte, pcapHeaderLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("pcap: header: %v", err)
+	}
+
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(hdr) {
+	case 0xa1b2c3d4, 0xa1b23c4d: // microsecond and nanosecond timestamps
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, errPcapMagic
+	}
+	link := order.Uint32(hdr[20:]) & 0x0fffffff // the upper bits are the FCS info
+
+	rec := make([]byte, pcapRecordHeaderLen)
+	for {
+		if _, err = io.ReadFull(r, rec); err != nil {
+			if err == io.EOF {
+				return pkts, nil
+			}
+			return pkts, fmt.Errorf("pcap: record %d: %v", len(pkts), err)
+		}
+		n := order.Uint32(rec[8:])
+		if n > pcapMaxSnapLen {
+			return pkts, fmt.Errorf("pcap: record %d: invalid length %d", len(pkts), n)
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return pkts, fmt.Errorf("pcap: record %d: %v", len(pkts), err)
+		}
+
+		if b, err = pcapInnerPacket(link, b); err != nil {
+			return pkts, err
+		}
+		if b != nil {
+			pkts = append(pkts, b)
+		}
+	}
+}
+
+// pcapInnerPacket strips the link header of the frame b, nil means it is not an IP packet.
+func pcapInnerPacket(link uint32, b []byte) ([]byte, error) {
+	var etherType uint16
+	switch link {
+	case pcapLinkRaw, pcapLinkRawOld, pcapLinkIPv4, pcapLinkIPv6:
+	case pcapLinkEthernet:
+		if len(b) < 14 {
+			return nil, nil
+		}
+		etherType, b = binary.BigEndian.Uint16(b[12:]), b[14:]
+		if etherType == 0x8100 && len(b) >= 4 { // 802.1Q VLAN tag
+			etherType, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+	case pcapLinkLinuxSLL:
+		if len(b) < 16 {
+			return nil, nil
+		}
+		etherType, b = binary.BigEndian.Uint16(b[14:]), b[16:]
+	default:
+		return nil, fmt.Errorf("pcap: unsupported link type %d", link)
+	}
+	if etherType != 0 && etherType != 0x0800 && etherType != 0x86dd {
+		return nil, nil
+	}
+	if len(b) == 0 || (b[0]>>4 != 4 && b[0]>>4 != 6) {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// tunPcapWriter writes the packets in the classic pcap format of LINKTYPE_RAW.
+type tunPcapWriter struct {
+	w io.Writer
+}
+
+func newTunPcapWriter(w io.Writer) (*tunPcapWriter, error) {
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapMaxSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &tunPcapWriter{w: w}, nil
+}
+
+func (pw *tunPcapWriter) write(b []byte, t time.Time) error {
+	rec := make([]byte, pcapRecordHeaderLen, pcapRecordHeaderLen+len(b))
+	binary.LittleEndian.PutUint32(rec, uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(b)))
+	_, err := pw.w.Write(append(rec, b...))
+	return err
+}
+
+// WriteTunPcap writes the IP packets to w in the classic pcap format of raw IP link type,
+// which can be read by ReadTunPcap and the common tools, e.g. tcpdump and wireshark.
+func WriteTunPcap(w io.Writer, pkts [][]byte) error {
+	pw, err := newTunPcapWriter(w)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, b := range pkts {
+		if err := pw.write(b, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const defaultTunReplayTimeout = time.Second
+
+// TunReplay replays the inner packets of a pcap through the sending path of the tun handler
+// for load and correctness testing, e.g. of the routing and filtering, against real traffic patterns.
+// The packets are injected into Tun as if they were routed to the device, and the datagrams
+// received by Peers on Network are captured. As the datagrams are captured as received, the handler
+// should run without cipher, so the captured datagrams are the inner packets forwarded to the peers.
+type TunReplay struct {
+	// Tun is the device of the handler under test.
+	Tun *TunPipe
+	// Network is the carrier of the tunnel of the handler under test.
+	Network *MemPacketNetwork
+	// Peers are the packet connections of the peers on Network.
+	Peers []net.PacketConn
+	// Timeout is the time to wait for more datagrams once the peers receive nothing, default is 1 second.
+	Timeout time.Duration
+}
+
+// Run injects the packets of the pcap read from in into the device, and writes the datagrams received
+// by the peers to out in the pcap format, in the order they are received. It returns the numbers of
+// the injected packets and the received datagrams once the peers receive nothing in Timeout.
+func (rp *TunReplay) Run(in io.Reader, out io.Writer) (sent, received int, err error) {
+	pkts, err := ReadTunPcap(in)
+	if err != nil {
+		return
+	}
+	pw, err := newTunPcapWriter(out)
+	if err != nil {
+		return
+	}
+	timeout := rp.Timeout
+	if timeout <= 0 {
+		timeout = defaultTunReplayTimeout
+	}
+
+	var mu sync.Mutex
+	var werr error
+	var wg sync.WaitGroup
+	wg.Add(len(rp.Peers))
+	for _, pc := range rp.Peers {
+		go func(pc net.PacketConn) {
+			defer wg.Done()
+			for {
+				b, _, err := rp.Network.Receive(pc, timeout)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				received++
+				if werr == nil {
+					werr = pw.write(b, time.Now())
+				}
+				mu.Unlock()
+			}
+		}(pc)
+	}
+
+	for _, b := range pkts {
+		if err = rp.Tun.Inject(b); err != nil {
+			break
+		}
+		sent++
+	}
+	wg.Wait()
+	if err == nil {
+		err = werr
+	}
+	return
+}
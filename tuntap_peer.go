@@ -0,0 +1,545 @@
+package gost
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The control message of tun tunnel is exchanged in-band with the IP packets,
+// it is distinguished from IP packets by the first byte which is never zero for IPv4 and IPv6.
+//
+//	+------+------+---------+
+//	| 0x00 | TYPE | PAYLOAD |
+//	+------+------+---------+
+//
+// The payload of the announcement is the inner addresses of the client, each of which is
+// prefixed by its length (4 or 16). The server acknowledges the announcement without payload.
+// The payload of the data message is a datagram of TunPacketConn.
+const (
+	tunCtrlKeepAlive      byte = 0x01
+	tunCtrlKeepAliveReply byte = 0x02
+	tunCtrlAnnounce       byte = 0x03
+	tunCtrlAnnounceAck    byte = 0x04
+	tunCtrlData           byte = 0x05
+)
+
+const (
+	defaultDPDMaxMiss = 3
+)
+
+var (
+	tunAnnounceRetryDelay    = 250 * time.Millisecond
+	tunAnnounceRetryMaxDelay = 4 * time.Second
+)
+
+var (
+	errTunPeerDead = errors.New("peer is dead")
+)
+
+func isTunControl(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x00
+}
+
+// TunPeerEventType is the type of TunPeerEvent.
+type TunPeerEventType int
+
+const (
+	// TunPeerDead means the peer missed too many keepalives and has been removed.
+	TunPeerDead TunPeerEventType = iota + 1
+	// TunPeerIdle means the routes to the peer have received no packet in TunConfig.PeerIdleTimeout
+	// and have been removed, IPs are the inner addresses of the removed routes.
+	TunPeerIdle
+)
+
+// TunPeerEvent describes the state change of a tun tunnel peer.
+type TunPeerEvent struct {
+	Type TunPeerEventType
+	// Addr is the outer address of the peer.
+	Addr net.Addr
+	// IPs are the inner addresses routed to the peer.
+	IPs []net.IP
+}
+
+// TunPeerInfo is the information of a tun tunnel peer.
+type TunPeerInfo struct {
+	// Addr is the outer address of the peer.
+	Addr net.Addr
+	// User is the user authenticated the peer, it is empty if the tunnel is not encrypted.
+	User string
+	// IPs are the inner addresses routed to the peer.
+	IPs []net.IP
+}
+
+// tunPeer is the state of a peer known by the tun handler.
+type tunPeer struct {
+	tunCounters
+	addr net.Addr
+	user string
+	miss int32 // consecutive missed keepalives
+	rtt  int64 // the last round-trip time of the keepalives in nanoseconds
+}
+
+// tunRoute is a route learned from the packets of a peer.
+type tunRoute struct {
+	addr net.Addr
+	seen int64 // the time of the last packet from the inner address in unix nanoseconds
+}
+
+func newTunRoute(addr net.Addr) *tunRoute {
+	return &tunRoute{addr: addr, seen: time.Now().UnixNano()}
+}
+
+// tunAddrKey returns the canonical form of the outer address addr of a peer,
+// which is used to identify the peer, as the transports may return the address
+// of the same peer in different types or forms (e.g. IPv4-mapped IPv6 address) for each datagram.
+func tunAddrKey(addr net.Addr) string {
+	var ip net.IP
+	var port int
+	var zone string
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	case *net.TCPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	case *net.IPAddr:
+		ip, zone = a.IP, a.Zone
+	case *tunMuxAddr:
+		return tunAddrKey(a.Addr)
+	case nil:
+		return ""
+	default:
+		return addr.String()
+	}
+	if ip == nil {
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, zone = ip4, ""
+	}
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// peerFor returns the peer of the outer address addr, the peer is created if not exists.
+func (h *tunHandler) peerFor(addr net.Addr) *tunPeer {
+	v, _ := h.peers.LoadOrStore(tunAddrKey(addr), &tunPeer{addr: addr, user: h.user})
+	return v.(*tunPeer)
+}
+
+// Peers returns the peers currently known by the handler.
+func (h *tunHandler) Peers() []TunPeerInfo {
+	var peers []TunPeerInfo
+	index := make(map[string]int)
+	h.peers.Range(func(k, v interface{}) bool {
+		peer := v.(*tunPeer)
+		index[k.(string)] = len(peers)
+		peers = append(peers, TunPeerInfo{Addr: peer.addr, User: peer.user})
+		return true
+	})
+	h.routes.Range(func(k, v interface{}) bool {
+		if i, ok := index[tunAddrKey(v.(*tunRoute).addr)]; ok {
+			key := k.(tunRouteKey)
+			peers[i].IPs = append(peers[i].IPs, key.IP())
+		}
+		return true
+	})
+	return peers
+}
+
+// peerSeen marks the peer of addr as alive, it returns nil if the peer is unknown.
+func (h *tunHandler) peerSeen(addr net.Addr) *tunPeer {
+	v, ok := h.peers.Load(tunAddrKey(addr))
+	if !ok {
+		return nil
+	}
+	peer := v.(*tunPeer)
+	atomic.StoreInt32(&peer.miss, 0)
+	return peer
+}
+
+// learnRoute records the route of the inner address ip to the peer addr,
+// it reports false if the route is rejected as the peer limit is reached.
+func (h *tunHandler) learnRoute(ip net.IP, addr net.Addr) bool {
+	rkey := ipToTunRouteKey(ip)
+	var old net.Addr
+	if v, ok := h.routes.Load(rkey); ok {
+		route := v.(*tunRoute)
+		if old = route.addr; tunAddrKey(old) == tunAddrKey(addr) {
+			atomic.StoreInt64(&route.seen, time.Now().UnixNano())
+			h.peerFor(addr)
+			return true
+		}
+	}
+	if h.options.TunConfig.DuplicateIPPolicy != "" && !h.checkDuplicateIP(ip, rkey, old, addr) {
+		return false
+	}
+
+	h.routeMu.Lock()
+	if v, ok := h.routes.Load(rkey); ok {
+		if old := v.(*tunRoute).addr; tunAddrKey(old) != tunAddrKey(addr) {
+			h.logf("update route: %s -> %s (old %s)", ip, addr, old)
+			h.routes.Store(rkey, newTunRoute(addr))
+		}
+	} else {
+		if max := h.options.TunConfig.MaxPeers; max > 0 && atomic.LoadInt32(&h.nroutes) >= int32(max) {
+			h.routeMu.Unlock()
+			h.stats.incr(&h.stats.peerRejected, 1)
+			if atomic.CompareAndSwapInt32(&h.limited, 0, 1) {
+				h.logf("max peers %d reached, reject new peers", max)
+			}
+			return false
+		}
+		h.routes.Store(rkey, newTunRoute(addr))
+		atomic.AddInt32(&h.nroutes, 1)
+		if user := h.peerFor(addr).user; user != "" {
+			h.logf("new route: %s -> %s (user: %s)", ip, addr, user)
+		} else {
+			h.logf("new route: %s -> %s", ip, addr)
+		}
+	}
+	h.routeMu.Unlock()
+
+	h.peerFor(addr)
+	return true
+}
+
+// tunPointToPointPeer is the remote of the point-to-point server in h.p2pPeer, addr is nil when it is not pinned.
+type tunPointToPointPeer struct {
+	addr net.Addr
+}
+
+// pointToPointPeer returns the remote of the point-to-point server.
+func (h *tunHandler) pointToPointPeer() net.Addr {
+	p, _ := h.p2pPeer.Load().(tunPointToPointPeer)
+	return p.addr
+}
+
+// setPointToPointPeer pins the remote of the point-to-point server to addr which the first packet is received from,
+// so the remote is not taken over by the datagrams from the other addresses. It reports whether addr is the remote.
+// The remote is replaced only after it is removed, e.g. declared dead by dead peer detection.
+func (h *tunHandler) setPointToPointPeer(addr net.Addr) bool {
+	if old := h.pointToPointPeer(); old != nil {
+		return tunAddrKey(old) == tunAddrKey(addr)
+	}
+
+	h.routeMu.Lock()
+	defer h.routeMu.Unlock()
+	if old := h.pointToPointPeer(); old != nil {
+		return tunAddrKey(old) == tunAddrKey(addr)
+	}
+	h.p2pPeer.Store(tunPointToPointPeer{addr: addr})
+	h.peerFor(addr)
+	h.logf("new peer: %s", addr)
+	return true
+}
+
+// removePeer removes the peer of addr and all the routes to it,
+// the inner addresses of the removed routes are returned.
+func (h *tunHandler) removePeer(addr net.Addr) (ips []net.IP) {
+	h.peers.Delete(tunAddrKey(addr))
+	h.routeMu.Lock()
+	if p := h.pointToPointPeer(); p != nil && tunAddrKey(p) == tunAddrKey(addr) {
+		h.p2pPeer.Store(tunPointToPointPeer{})
+	}
+	h.routes.Range(func(k, v interface{}) bool {
+		if tunAddrKey(v.(*tunRoute).addr) == tunAddrKey(addr) {
+			key := k.(tunRouteKey)
+			ips = append(ips, key.IP())
+			h.routes.Delete(k)
+			atomic.AddInt32(&h.nroutes, -1)
+		}
+		return true
+	})
+	h.routeMu.Unlock()
+	if len(ips) > 0 {
+		atomic.StoreInt32(&h.limited, 0)
+	}
+	return
+}
+
+// removeRoute removes the learned route of rkey if it is route, or any route if route is nil.
+// It reports whether the route is removed by this call, so the concurrent removals count it once.
+func (h *tunHandler) removeRoute(rkey tunRouteKey, route *tunRoute) bool {
+	h.routeMu.Lock()
+	defer h.routeMu.Unlock()
+
+	v, ok := h.routes.Load(rkey)
+	if !ok || (route != nil && v.(*tunRoute) != route) {
+		return false
+	}
+	h.routes.Delete(rkey)
+	atomic.AddInt32(&h.nroutes, -1)
+	return true
+}
+
+func (h *tunHandler) peerEvent(ev TunPeerEvent) {
+	if cb := h.options.TunConfig.OnPeerChange; cb != nil {
+		cb(ev)
+	}
+}
+
+// handleControl handles the control message b received from the peer addr.
+func (h *tunHandler) handleControl(conn net.PacketConn, b []byte, addr net.Addr) {
+	switch b[1] {
+	case tunCtrlKeepAlive:
+		b[1] = tunCtrlKeepAliveReply
+		if _, err := h.writeDatagram(conn, b, addr); err != nil {
+			h.logf("%s: keepalive reply to %s: %v", conn.LocalAddr(), addr, err)
+		}
+	case tunCtrlAnnounce:
+		// learned by learnAnnounce on server side.
+	case tunCtrlData:
+		// the datagrams of TunPacketConn are not forwarded to the tun device.
+	case tunCtrlAnnounceAck:
+		if atomic.CompareAndSwapInt32(&h.announced, 0, 1) && Debug {
+			h.logf("%s: announcement is acknowledged by %s", conn.LocalAddr(), addr)
+		}
+	case tunCtrlKeepAliveReply:
+		// the peer is marked as alive already, the payload is the send time of the keepalive
+		// echoed by the peer if the latency is measured.
+		if h.options.TunConfig.MeasureLatency && len(b) >= 2+8 {
+			rtt := time.Duration(time.Now().UnixNano() - int64(binary.BigEndian.Uint64(b[2:])))
+			if rtt < 0 || rtt > h.options.TunConfig.DPDInterval*time.Duration(h.dpdMaxMiss()+1) {
+				return
+			}
+			h.stats.observeRTT(rtt)
+			if v, ok := h.peers.Load(tunAddrKey(addr)); ok {
+				atomic.StoreInt64(&v.(*tunPeer).rtt, int64(rtt))
+			}
+		}
+	default:
+		if Debug {
+			h.logf("%s: unknown control message %#x from %s", conn.LocalAddr(), b[1], addr)
+		}
+	}
+}
+
+// tunAnnounce returns the announcement of the inner addresses ips.
+func tunAnnounce(ips []net.IP) []byte {
+	b := []byte{0x00, tunCtrlAnnounce}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		b = append(b, byte(len(ip)))
+		b = append(b, ip...)
+	}
+	return b
+}
+
+// parseTunAnnounce returns the inner addresses in the payload of the announcement b,
+// it stops at the first malformed address.
+func parseTunAnnounce(b []byte) (ips []net.IP) {
+	for len(b) > 0 {
+		n := int(b[0])
+		if (n != net.IPv4len && n != net.IPv6len) || len(b) < 1+n {
+			break
+		}
+		ips = append(ips, net.IP(append([]byte(nil), b[1:1+n]...)))
+		b = b[1+n:]
+	}
+	return
+}
+
+// announce sends the inner address of the device to the server when the client session starts,
+// so the server learns the route to the client before the client has any packet to send.
+func (h *tunHandler) announce(conn net.PacketConn, raddr net.Addr) {
+	if h.ip == nil {
+		return
+	}
+	if _, err := h.writeDatagram(conn, tunAnnounce([]net.IP{h.ip}), raddr); err != nil {
+		h.logf("%s: announce to %s: %v", conn.LocalAddr(), raddr, err)
+	}
+}
+
+// announceRetry announces the inner address of the device to the server until it is acknowledged,
+// TunConfig.AnnounceTimeout passes or done is closed, as the first datagrams may be lost before
+// the server is ready. The delay between the attempts starts at tunAnnounceRetryDelay and doubles.
+func (h *tunHandler) announceRetry(conn net.PacketConn, raddr net.Addr, done <-chan struct{}) {
+	if h.ip == nil {
+		return
+	}
+	atomic.StoreInt32(&h.announced, 0)
+	deadline := time.Now().Add(h.options.TunConfig.AnnounceTimeout)
+	delay := tunAnnounceRetryDelay
+	for n := 1; ; n++ {
+		h.logf("%s: announce %s to %s, attempt %d", conn.LocalAddr(), h.ip, raddr, n)
+		h.announce(conn, raddr)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+		if atomic.LoadInt32(&h.announced) == 1 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			h.logf("%s: announcement is not acknowledged by %s in %s",
+				conn.LocalAddr(), raddr, h.options.TunConfig.AnnounceTimeout)
+			return
+		}
+		if delay *= 2; delay > tunAnnounceRetryMaxDelay {
+			delay = tunAnnounceRetryMaxDelay
+		}
+	}
+}
+
+// learnAnnounce learns the routes from the announcement b of the peer addr on server side,
+// in the same way as the source addresses of the packets from the peer.
+func (h *tunHandler) learnAnnounce(conn net.PacketConn, b []byte, addr net.Addr) {
+	if h.staticPeer != nil {
+		return
+	}
+	ips := parseTunAnnounce(b[2:])
+	if Debug {
+		h.logf("announce from %s: %v", addr, ips)
+	}
+	if len(ips) > 0 {
+		if _, err := h.writeDatagram(conn, []byte{0x00, tunCtrlAnnounceAck}, addr); err != nil {
+			h.logf("%s: announcement ack to %s: %v", conn.LocalAddr(), addr, err)
+		}
+	}
+	if len(ips) > 0 && h.options.TunConfig.Peer != "" {
+		if !h.setPointToPointPeer(addr) {
+			h.unknownPeer(addr)
+		}
+		return
+	}
+	for _, ip := range ips {
+		if !h.learnRoute(ip, addr) {
+			return
+		}
+		if h.pending != nil {
+			if err := h.flushPending(conn, ip, addr); err != nil {
+				h.logf("%s: %v", addr, err)
+			}
+		}
+	}
+}
+
+func (h *tunHandler) dpdMaxMiss() int {
+	if n := h.options.TunConfig.DPDMaxMiss; n > 0 {
+		return n
+	}
+	return defaultDPDMaxMiss
+}
+
+// dpd runs the dead peer detection until done is closed. Each peer is sent a keepalive every interval,
+// a peer missed more than DPDMaxMiss keepalives in a row is considered dead.
+// On client side the dead server ends the session by sending an error to errc.
+func (h *tunHandler) dpd(conn net.PacketConn, raddr net.Addr, errc chan<- error, done <-chan struct{}) {
+	cfg := &h.options.TunConfig
+	maxMiss := h.dpdMaxMiss()
+
+	ticker := time.NewTicker(cfg.DPDInterval)
+	defer ticker.Stop()
+
+	keepalive := []byte{0x00, tunCtrlKeepAlive}
+	if cfg.MeasureLatency {
+		keepalive = append(keepalive, make([]byte, 8)...)
+	}
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		if cfg.MeasureLatency {
+			binary.BigEndian.PutUint64(keepalive[2:], uint64(time.Now().UnixNano()))
+		}
+
+		h.peers.Range(func(k, v interface{}) bool {
+			peer := v.(*tunPeer)
+			if atomic.AddInt32(&peer.miss, 1) <= int32(maxMiss) {
+				if _, err := h.writeDatagram(conn, keepalive, peer.addr); err != nil {
+					h.logf("%s: keepalive to %s: %v", conn.LocalAddr(), peer.addr, err)
+				}
+				return true
+			}
+
+			ips := h.removePeer(peer.addr)
+			h.logf("%s: peer %s is dead, remove routes: %v", conn.LocalAddr(), peer.addr, ips)
+			h.peerEvent(TunPeerEvent{Type: TunPeerDead, Addr: peer.addr, IPs: ips})
+
+			if raddr != nil {
+				select {
+				case errc <- errTunPeerDead:
+				default:
+				}
+			}
+			return true
+		})
+	}
+}
+
+// reapIdleRoutes removes the learned routes idle longer than TunConfig.PeerIdleTimeout until done is closed,
+// the routes are checked every quarter of the timeout. The peers left without routes are removed,
+// and OnPeerChange is called with the removed routes of each peer.
+func (h *tunHandler) reapIdleRoutes(conn net.PacketConn, done <-chan struct{}) {
+	timeout := h.options.TunConfig.PeerIdleTimeout
+	interval := timeout / 4
+	if interval <= 0 {
+		interval = timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		deadline := time.Now().Add(-timeout).UnixNano()
+		var events []*TunPeerEvent
+		idle := make(map[string]*TunPeerEvent)
+		h.routes.Range(func(k, v interface{}) bool {
+			route := v.(*tunRoute)
+			if atomic.LoadInt64(&route.seen) >= deadline {
+				return true
+			}
+			key := k.(tunRouteKey)
+			if !h.removeRoute(key, route) {
+				return true
+			}
+			h.stats.incr(&h.stats.idleRoutes, 1)
+			h.logf("%s: route %s -> %s is idle, remove it", conn.LocalAddr(), key.IP(), route.addr)
+
+			ev := idle[tunAddrKey(route.addr)]
+			if ev == nil {
+				ev = &TunPeerEvent{Type: TunPeerIdle, Addr: route.addr}
+				idle[tunAddrKey(route.addr)] = ev
+				events = append(events, ev)
+			}
+			ev.IPs = append(ev.IPs, key.IP())
+			return true
+		})
+		if len(events) == 0 {
+			continue
+		}
+		atomic.StoreInt32(&h.limited, 0)
+
+		h.routes.Range(func(k, v interface{}) bool {
+			delete(idle, tunAddrKey(v.(*tunRoute).addr))
+			return true
+		})
+		for key, ev := range idle {
+			h.peers.Delete(key)
+			h.logf("%s: peer %s is idle, remove it", conn.LocalAddr(), ev.Addr)
+		}
+		for _, ev := range events {
+			h.peerEvent(*ev)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package gost
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultTunPendingTimeout = time.Second
+
+// tunPending holds the packets from the tun device to the destinations without route,
+// until the routes are learned, see TunConfig.PendingBuffer.
+// The expired packets are freed lazily, the buffer is bounded by max packets anyway.
+type tunPending struct {
+	max     int
+	timeout time.Duration
+	mem     *tunMemBudget // the held packets are of low priority
+	mu      sync.Mutex
+	n       int // the packets held
+	pkts    map[tunRouteKey][]tunPendingPacket
+}
+
+type tunPendingPacket struct {
+	b []byte
+	t time.Time
+}
+
+func newTunPending(max int, timeout time.Duration, mem *tunMemBudget) *tunPending {
+	if timeout <= 0 {
+		timeout = defaultTunPendingTimeout
+	}
+	return &tunPending{
+		max:     max,
+		timeout: timeout,
+		mem:     mem,
+		pkts:    make(map[tunRouteKey][]tunPendingPacket),
+	}
+}
+
+// hold holds a copy of the packet b to dst, it reports false if the buffer is full,
+// or the memory budget of the low priority packets is exhausted, then full is false.
+// The number of the expired packets freed is returned.
+func (p *tunPending) hold(dst net.IP, b []byte) (ok, full bool, expired int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.n >= p.max {
+		expired = p.expire(now)
+	}
+	if p.n >= p.max {
+		return false, true, expired
+	}
+	if !p.mem.reserve(len(b), true) {
+		return false, false, expired
+	}
+	key := ipToTunRouteKey(dst)
+	p.pkts[key] = append(p.pkts[key], tunPendingPacket{b: append([]byte(nil), b...), t: now})
+	p.n++
+	return true, false, expired
+}
+
+// take removes the packets held for ip, and returns those not expired.
+// The number of the expired packets is returned too.
+func (p *tunPending) take(ip net.IP) (pkts [][]byte, expired int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := ipToTunRouteKey(ip)
+	held := p.pkts[key]
+	if len(held) == 0 {
+		return nil, 0
+	}
+	delete(p.pkts, key)
+	p.n -= len(held)
+
+	now := time.Now()
+	for _, pkt := range held {
+		p.mem.release(len(pkt.b))
+		if now.Sub(pkt.t) > p.timeout {
+			expired++
+			continue
+		}
+		pkts = append(pkts, pkt.b)
+	}
+	return
+}
+
+// expire frees the expired packets, it returns the number of them.
+func (p *tunPending) expire(now time.Time) (n int) {
+	for key, held := range p.pkts {
+		i := 0
+		for i < len(held) && now.Sub(held[i].t) > p.timeout {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+		n += i
+		for _, pkt := range held[:i] {
+			p.mem.release(len(pkt.b))
+		}
+		if i == len(held) {
+			delete(p.pkts, key)
+		} else {
+			p.pkts[key] = held[i:]
+		}
+	}
+	p.n -= n
+	return
+}
+
+// holdPending holds the packet b to dst without route, it reports false if the packet is not held.
+func (h *tunHandler) holdPending(b []byte, dst net.IP) bool {
+	ok, full, expired := h.pending.hold(dst, b)
+	h.stats.incr(&h.stats.pendingDropped, uint64(expired))
+	if !ok {
+		h.stats.incr(&h.stats.pendingDropped, 1)
+		if !full {
+			h.memDropped()
+		}
+	}
+	return ok
+}
+
+// flushPending sends the packets held for ip to the peer addr, once the route is learned.
+func (h *tunHandler) flushPending(conn net.PacketConn, ip net.IP, addr net.Addr) error {
+	pkts, expired := h.pending.take(ip)
+	h.stats.incr(&h.stats.pendingDropped, uint64(expired))
+	for _, b := range pkts {
+		if err := h.writeTo(conn, b, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errMemClosed  = errors.New("use of closed connection")
+	errMemTimeout = errors.New("i/o timeout")
+)
+
+const memQueueSize = 128
+
+// TunPipe is an in-memory tun device for testing the tun handler without a real device.
+// The handler reads the packets sent by Inject, and the packets written by the handler
+// are returned by Receive. It implements net.Conn with packet semantics.
+type TunPipe struct {
+	addr   net.Addr
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+	mtu    int32 // the MTU set by the handler
+}
+
+// NewTunPipe creates a TunPipe with the device address ip.
+func NewTunPipe(ip net.IP) *TunPipe {
+	return &TunPipe{
+		addr:   &net.IPAddr{IP: ip},
+		in:     make(chan []byte, memQueueSize),
+		out:    make(chan []byte, memQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// Inject delivers the packet b to the handler, as if it was routed to the device by the system.
+func (p *TunPipe) Inject(b []byte) error {
+	select {
+	case <-p.closed:
+		return errMemClosed
+	default:
+	}
+
+	b = append([]byte(nil), b...)
+	select {
+	case p.in <- b:
+		return nil
+	case <-p.closed:
+		return errMemClosed
+	}
+}
+
+// Receive returns the next packet written to the device by the handler,
+// it returns an error if no packet is written within the timeout.
+func (p *TunPipe) Receive(timeout time.Duration) ([]byte, error) {
+	return memReceive(p.out, p.closed, timeout)
+}
+
+func (p *TunPipe) Read(b []byte) (n int, err error) {
+	select {
+	case pkt := <-p.in:
+		return copy(b, pkt), nil
+	case <-p.closed:
+		return 0, errMemClosed
+	}
+}
+
+func (p *TunPipe) Write(b []byte) (n int, err error) {
+	select {
+	case <-p.closed:
+		return 0, errMemClosed
+	default:
+	}
+
+	select {
+	case p.out <- append([]byte(nil), b...):
+	default:
+		// the device queue is full, the packet is dropped.
+	}
+	return len(b), nil
+}
+
+// Close closes the device, the pending Read is unblocked.
+func (p *TunPipe) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+// SetMTU records the MTU of the device changed by the handler.
+func (p *TunPipe) SetMTU(mtu int) error {
+	atomic.StoreInt32(&p.mtu, int32(mtu))
+	return nil
+}
+
+// MTU returns the MTU last set by the handler, 0 means it is not set.
+func (p *TunPipe) MTU() int {
+	return int(atomic.LoadInt32(&p.mtu))
+}
+
+func (p *TunPipe) LocalAddr() net.Addr {
+	return p.addr
+}
+
+func (p *TunPipe) RemoteAddr() net.Addr {
+	return &net.IPAddr{}
+}
+
+func (p *TunPipe) SetDeadline(t time.Time) error {
+	return &net.OpError{Op: "set", Net: "tuntap", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
+}
+
+func (p *TunPipe) SetReadDeadline(t time.Time) error {
+	return &net.OpError{Op: "set", Net: "tuntap", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
+}
+
+func (p *TunPipe) SetWriteDeadline(t time.Time) error {
+	return &net.OpError{Op: "set", Net: "tuntap", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+type memPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// MemPacketNetwork is an in-memory datagram network for testing,
+// the packet connections created on it exchange datagrams by the address they are bound to.
+// Like UDP, the datagrams to an unknown address or to a full receive queue are dropped.
+// It implements TunTransporter, so it can be used as the carrier of tun tunnel.
+type MemPacketNetwork struct {
+	mu    sync.Mutex
+	conns map[string]*memPacketConn
+}
+
+// NewMemPacketNetwork creates an empty in-memory datagram network.
+func NewMemPacketNetwork() *MemPacketNetwork {
+	return &MemPacketNetwork{
+		conns: make(map[string]*memPacketConn),
+	}
+}
+
+// ListenPacket creates a packet connection bound to the address addr.
+func (n *MemPacketNetwork) ListenPacket(addr string) (net.PacketConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.conns[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: memAddr(addr), Err: errors.New("address already in use")}
+	}
+	c := &memPacketConn{
+		network: n,
+		addr:    memAddr(addr),
+		in:      make(chan memPacket, memQueueSize),
+		closed:  make(chan struct{}),
+	}
+	n.conns[addr] = c
+	return c, nil
+}
+
+// PacketConn implements TunTransporter.
+func (n *MemPacketNetwork) PacketConn(laddr, raddr string) (net.PacketConn, error) {
+	return n.ListenPacket(laddr)
+}
+
+func (n *MemPacketNetwork) deliver(b []byte, from, to net.Addr) {
+	n.mu.Lock()
+	c := n.conns[to.String()]
+	n.mu.Unlock()
+	if c == nil {
+		return
+	}
+
+	select {
+	case c.in <- memPacket{b: append([]byte(nil), b...), addr: from}:
+	default:
+	}
+}
+
+func (n *MemPacketNetwork) remove(c *memPacketConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+}
+
+type memPacketConn struct {
+	network *MemPacketNetwork
+	addr    net.Addr
+	in      chan memPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *memPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(b, pkt.b), pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, errMemClosed
+	}
+}
+
+func (c *memPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, errMemClosed
+	default:
+	}
+	c.network.deliver(b, c.addr, addr)
+	return len(b), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+	})
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Receive returns the next datagram received by the packet connection pc created by MemPacketNetwork,
+// it returns an error if no datagram is received within the timeout.
+func (n *MemPacketNetwork) Receive(pc net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	c, ok := pc.(*memPacketConn)
+	if !ok {
+		return nil, nil, errors.New("not a memory packet connection")
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case pkt := <-c.in:
+		return pkt.b, pkt.addr, nil
+	case <-c.closed:
+		return nil, nil, errMemClosed
+	case <-timer.C:
+		return nil, nil, errMemTimeout
+	}
+}
+
+func memReceive(ch chan []byte, closed chan struct{}, timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b := <-ch:
+		return b, nil
+	case <-closed:
+		return nil, errMemClosed
+	case <-timer.C:
+		return nil, errMemTimeout
+	}
+}
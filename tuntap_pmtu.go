@@ -0,0 +1,358 @@
+package gost
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	tunMinPMTU4 = 68
+	tunMinPMTU6 = 1280
+	// tunPathMTUExpiry is the time the path MTU of a destination learned from the ICMP message
+	// of a host other than the server is kept.
+	tunPathMTUExpiry = 10 * time.Minute
+	// tunMaxPathMTUs is the maximum number of the destinations of which the path MTU is kept.
+	tunMaxPathMTUs = 1024
+)
+
+// icmpPacketTooBig returns the next-hop MTU of the ICMP fragmentation needed message
+// (or ICMPv6 packet too big message) b, it returns 0 if b is not such a message.
+func icmpPacketTooBig(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return 0
+		}
+		hl := ipv4HeaderLen(b)
+		if b[9] != 1 || len(b) < hl+8 || ipv4FragOffset(b) != 0 {
+			return 0
+		}
+		// destination unreachable, fragmentation needed and DF set
+		if b[hl] != 3 || b[hl+1] != 4 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(b[hl+6:]))
+	case 6:
+		if len(b) < 40+8 || b[6] != 58 || b[40] != 2 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint32(b[44:]))
+	}
+	return 0
+}
+
+// clampTCPMSS lowers the MSS option of the TCP SYN packet b to mss, it reports whether b is changed.
+func clampTCPMSS(b []byte, mss int) bool {
+	var hl, proto, plen int
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 || ipv4FragOffset(b) != 0 {
+			return false
+		}
+		hl, proto = ipv4HeaderLen(b), int(b[9])
+		plen = len(b) - hl
+	case 6:
+		// the packets with extension headers are not clamped.
+		if len(b) < 40 {
+			return false
+		}
+		hl, proto = 40, int(b[6])
+		plen = len(b) - hl
+	default:
+		return false
+	}
+	if proto != 6 || plen < 20 {
+		return false
+	}
+
+	tcp := b[hl:]
+	// SYN flag
+	if tcp[13]&0x02 == 0 {
+		return false
+	}
+	off := int(tcp[12]>>4) << 2
+	if off < 20 || off > len(tcp) {
+		return false
+	}
+	for opts := tcp[20:off]; len(opts) > 0; {
+		kind := opts[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if kind == 2 && opts[1] == 4 {
+			if int(binary.BigEndian.Uint16(opts[2:])) <= mss {
+				return false
+			}
+			i := len(tcp) - len(opts) + 2
+			old := []byte{tcp[i], tcp[i+1]}
+			binary.BigEndian.PutUint16(tcp[i:], uint16(mss))
+			// the option is 2-byte aligned as the TCP header, so the checksum is updated incrementally.
+			if i%2 == 0 {
+				sum := checksumUpdate(binary.BigEndian.Uint16(tcp[16:]), old, tcp[i:i+2])
+				binary.BigEndian.PutUint16(tcp[16:], sum)
+			} else {
+				sum := checksumUpdate(binary.BigEndian.Uint16(tcp[16:]),
+					[]byte{tcp[i-1], old[0], old[1], tcp[i+2]}, tcp[i-1:i+3])
+				binary.BigEndian.PutUint16(tcp[16:], sum)
+			}
+			return true
+		}
+		opts = opts[opts[1]:]
+	}
+	return false
+}
+
+// pathMTU returns the path MTU learned from the ICMP messages, 0 means it is unknown.
+func (h *tunHandler) pathMTU() int {
+	return int(atomic.LoadInt32(&h.pmtu))
+}
+
+// learnPathMTU records the reduced path MTU of the ICMP fragmentation needed message b
+// received from the server on client side. The message from the inner address of the server, see serverIP,
+// lowers the path MTU of the tunnel, the messages of the other hosts only lower the path MTU of
+// the destination of the original packet, until it expires.
+func (h *tunHandler) learnPathMTU(b []byte) {
+	mtu := icmpPacketTooBig(b)
+	if mtu == 0 {
+		return
+	}
+	min := tunMinPMTU4
+	if b[0]>>4 == 6 {
+		min = tunMinPMTU6
+	}
+	if mtu < min || mtu >= h.mtu() {
+		return
+	}
+
+	if server := h.serverIP(); server == nil || !server.Equal(ipSource(b)) {
+		if dst := icmpOriginalDestination(b); dst != nil && h.dstPMTU.learn(dst, mtu, time.Now()) && Debug {
+			h.logf("path MTU to %s is reduced to %d by %s", dst, mtu, ipSource(b))
+		}
+		return
+	}
+
+	h.mtuEvent(mtu, "ICMP fragmentation needed")
+	for {
+		old := atomic.LoadInt32(&h.pmtu)
+		if old != 0 && int(old) <= mtu {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&h.pmtu, old, int32(mtu)) {
+			h.logf("path MTU is reduced to %d, clamp TCP MSS", mtu)
+			return
+		}
+	}
+}
+
+// serverIP returns the inner address of the server on client side, which is the peer of the point-to-point device
+// or the gateway, nil means it is unknown.
+func (h *tunHandler) serverIP() net.IP {
+	if ip := net.ParseIP(h.options.TunConfig.Peer); ip != nil {
+		return ip
+	}
+	return net.ParseIP(h.options.TunConfig.Gateway)
+}
+
+// ipSource returns the source address of the IP packet b.
+func ipSource(b []byte) net.IP {
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		return net.IP(b[12:16])
+	case len(b) >= 40 && b[0]>>4 == 6:
+		return net.IP(b[8:24])
+	}
+	return nil
+}
+
+// ipDestination returns the destination address of the IP packet b.
+func ipDestination(b []byte) net.IP {
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		return net.IP(b[16:20])
+	case len(b) >= 40 && b[0]>>4 == 6:
+		return net.IP(b[24:40])
+	}
+	return nil
+}
+
+// icmpOriginalDestination returns the destination of the original packet quoted in the ICMP error message b.
+func icmpOriginalDestination(b []byte) net.IP {
+	switch b[0] >> 4 {
+	case 4:
+		hl := ipv4HeaderLen(b)
+		if len(b) < hl+8+20 {
+			return nil
+		}
+		return net.IP(append([]byte(nil), b[hl+8+16:hl+8+20]...))
+	case 6:
+		if len(b) < 48+40 {
+			return nil
+		}
+		return net.IP(append([]byte(nil), b[48+24:48+40]...))
+	}
+	return nil
+}
+
+// tunPathMTUs is the path MTUs of the destinations learned on client side.
+type tunPathMTUs struct {
+	mu   sync.RWMutex
+	mtus map[tunRouteKey]tunPathMTU
+	n    int32 // the number of the destinations, accessed atomically
+}
+
+type tunPathMTU struct {
+	mtu     int
+	expires time.Time
+}
+
+// learn records the path MTU mtu of dst, which expires after tunPathMTUExpiry. It reports whether the path MTU
+// is lowered. The expired ones are removed when tunMaxPathMTUs destinations are recorded.
+func (p *tunPathMTUs) learn(dst net.IP, mtu int, now time.Time) bool {
+	key := ipToTunRouteKey(dst)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.mtus[key]
+	if ok && now.Before(e.expires) && e.mtu <= mtu {
+		return false
+	}
+	if !ok && len(p.mtus) >= tunMaxPathMTUs {
+		for k, e := range p.mtus {
+			if !now.Before(e.expires) {
+				delete(p.mtus, k)
+			}
+		}
+		if len(p.mtus) >= tunMaxPathMTUs {
+			return false
+		}
+	}
+	if p.mtus == nil {
+		p.mtus = make(map[tunRouteKey]tunPathMTU)
+	}
+	p.mtus[key] = tunPathMTU{mtu: mtu, expires: now.Add(tunPathMTUExpiry)}
+	atomic.StoreInt32(&p.n, int32(len(p.mtus)))
+	return true
+}
+
+// get returns the path MTU of dst, 0 means it is unknown or expired.
+func (p *tunPathMTUs) get(dst net.IP) int {
+	if atomic.LoadInt32(&p.n) == 0 {
+		return 0
+	}
+	p.mu.RLock()
+	e, ok := p.mtus[ipToTunRouteKey(dst)]
+	p.mu.RUnlock()
+	if !ok || !time.Now().Before(e.expires) {
+		return 0
+	}
+	return e.mtu
+}
+
+// familyMTU returns the MTU of the address family of the packet b, see TunConfig.MTU4 and TunConfig.MTU6.
+func (h *tunHandler) familyMTU(b []byte) int {
+	mtu := h.options.TunConfig.MTU4
+	if len(b) > 0 && b[0]>>4 == 6 {
+		mtu = h.options.TunConfig.MTU6
+	}
+	if mtu > 0 {
+		return mtu
+	}
+	return h.mtu()
+}
+
+// checkFamilyMTU checks the packet b from src to dst read from the tun device against the MTU of its address family,
+// it reports false if b is dropped as it is too big, then the ICMP packet too big is written to the tun device.
+func (h *tunHandler) checkFamilyMTU(tun net.Conn, b []byte, src, dst net.IP) bool {
+	mtu := h.familyMTU(b)
+	if len(b) <= mtu {
+		return true
+	}
+	// the IPv4 packets without DF are fragmented when they are sent.
+	if h.fragmentable(b) {
+		return true
+	}
+
+	h.stats.incr(&h.stats.mtuExceeded, 1)
+	if Debug {
+		h.logf("%s -> %s: packet size %d exceeds the MTU %d", src, dst, len(b), mtu)
+	}
+	// the address of the device as the source, or the destination if it is of the other family.
+	from := h.ip
+	if from == nil || (from.To4() == nil) != (b[0]>>4 == 6) {
+		from = dst
+	}
+	if pkt := icmpPacketTooBigError(from, b, mtu); pkt != nil {
+		if _, err := tun.Write(pkt); err != nil {
+			h.logf("%s: %v", tun.LocalAddr(), err)
+		}
+	}
+	return false
+}
+
+// fragmentable reports whether the packet b is an IPv4 packet can be fragmented, i.e. without DF
+// or TunConfig.IgnoreDF is set.
+func (h *tunHandler) fragmentable(b []byte) bool {
+	return len(b) >= ipv4.HeaderLen && b[0]>>4 == 4 && (b[6]&0x40 == 0 || h.options.TunConfig.IgnoreDF)
+}
+
+// sendFragments fragments the IPv4 packet b larger than the MTU of its address family,
+// and sends the fragments to the peer addr. It returns the total bytes of the fragments sent.
+func (h *tunHandler) sendFragments(conn net.PacketConn, b []byte, addr net.Addr) (n int, err error) {
+	frags := fragmentIPv4(b, h.familyMTU(b), h.options.TunConfig.IgnoreDF)
+	if frags == nil {
+		return h.sendDatagram(conn, b, addr)
+	}
+	h.stats.incr(&h.stats.fragmented, 1)
+	for _, f := range frags {
+		m, err := h.sendDatagram(conn, f, addr)
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// clampMSS clamps the MSS of the TCP SYN packet b from the tun device to fit in the MTU of its address family,
+// and the path MTUs of the tunnel and the destination learned on client side.
+func (h *tunHandler) clampMSS(b []byte) {
+	mtu := h.pathMTU()
+	if dst := ipDestination(b); dst != nil {
+		if m := h.dstPMTU.get(dst); m > 0 && (mtu == 0 || m < mtu) {
+			mtu = m
+		}
+	}
+	fm := h.options.TunConfig.MTU4
+	if b[0]>>4 == 6 {
+		fm = h.options.TunConfig.MTU6
+	}
+	if fm > 0 && (mtu == 0 || fm < mtu) {
+		mtu = fm
+	}
+	if mtu == 0 {
+		return
+	}
+	// IP and TCP headers without options
+	mss := mtu - 40
+	if b[0]>>4 == 6 {
+		mss = mtu - 60
+	}
+	if clampTCPMSS(b, mss) && Debug {
+		h.logf("clamp TCP MSS to %d", mss)
+	}
+}
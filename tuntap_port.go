@@ -0,0 +1,31 @@
+package gost
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+)
+
+// listenSourcePort binds the client socket of tr to a port in TunConfig.SourcePortRange on the host of laddr.
+// The ports are tried in turn from a random one, so the clients sharing the range do not contend for the same port,
+// until a port is bound.
+func (h *tunHandler) listenSourcePort(tr TunTransporter, laddr, raddr string) (net.PacketConn, error) {
+	ports, err := ParsePortRange(h.options.TunConfig.SourcePortRange)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(laddr)
+
+	n := ports.Max - ports.Min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := ports.Min + (start+i)%n
+		pc, er := tr.PacketConn(net.JoinHostPort(host, strconv.Itoa(port)), raddr)
+		if er == nil {
+			return pc, nil
+		}
+		err = er
+	}
+	return nil, fmt.Errorf("no source port available in %s: %v", h.options.TunConfig.SourcePortRange, err)
+}
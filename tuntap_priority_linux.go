@@ -0,0 +1,18 @@
+package gost
+
+import "golang.org/x/sys/unix"
+
+// setThreadPriority sets the niceness (-20 to 19, lower is higher priority) of the calling thread,
+// raising the priority (negative niceness) requires CAP_SYS_NICE.
+func setThreadPriority(prio int) error {
+	return unix.Setpriority(unix.PRIO_PROCESS, unix.Gettid(), prio)
+}
+
+// setThreadAffinity binds the calling thread to the CPUs cpus.
+func setThreadAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
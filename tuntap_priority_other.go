@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package gost
+
+import "errors"
+
+func setThreadPriority(prio int) error {
+	return errors.New("thread priority is not supported on this platform")
+}
+
+func setThreadAffinity(cpus []int) error {
+	return errors.New("CPU affinity is not supported on this platform")
+}
@@ -0,0 +1,110 @@
+package gost
+
+import (
+	"net"
+	"sync"
+)
+
+// tunFairQueue is the queues of the packets from the peers to the tun device, one for each peer,
+// the packets are dequeued from the peers with queued packets in round-robin,
+// so a fast peer can not monopolize the device. It is used when TunConfig.PerPeerQueue is set.
+type tunFairQueue struct {
+	depth  int
+	mu     sync.Mutex
+	queues map[string]*tunPeerQueue
+	active []*tunPeerQueue // the queues not empty in the order of service
+	ready  chan struct{}
+}
+
+type tunPeerQueue struct {
+	key  string
+	pkts [][]byte
+}
+
+func newTunFairQueue(depth int) *tunFairQueue {
+	return &tunFairQueue{
+		depth:  depth,
+		queues: make(map[string]*tunPeerQueue),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push adds the packet b to the queue of the peer key,
+// it reports false if the queue of the peer is full, then b is not queued.
+func (q *tunFairQueue) push(key string, b []byte) bool {
+	q.mu.Lock()
+	pq := q.queues[key]
+	if pq == nil {
+		pq = &tunPeerQueue{key: key}
+		q.queues[key] = pq
+	}
+	if len(pq.pkts) >= q.depth {
+		q.mu.Unlock()
+		return false
+	}
+	pq.pkts = append(pq.pkts, b)
+	if len(pq.pkts) == 1 {
+		q.active = append(q.active, pq)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop removes the first packet of the next peer in turn, it returns nil if all the queues are empty.
+func (q *tunFairQueue) pop() []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.active) == 0 {
+		return nil
+	}
+	pq := q.active[0]
+	q.active[0] = nil
+	q.active = q.active[1:]
+
+	b := pq.pkts[0]
+	pq.pkts[0] = nil
+	pq.pkts = pq.pkts[1:]
+	if len(pq.pkts) > 0 {
+		q.active = append(q.active, pq)
+	} else {
+		delete(q.queues, pq.key)
+	}
+	return b
+}
+
+// writeFairQueue writes the packets in queue to the tun device until done or the handler is closed,
+// the packets are returned to pool after written.
+func (h *tunHandler) writeFairQueue(tun net.Conn, queue *tunFairQueue, pool *bufferPool, done <-chan struct{}) error {
+	// release the packets left when the writer stops.
+	defer func() {
+		for b := queue.pop(); b != nil; b = queue.pop() {
+			h.mem.release(cap(b))
+			pool.Put(b[:cap(b)])
+		}
+	}()
+	for {
+		b := queue.pop()
+		if b == nil {
+			select {
+			case <-queue.ready:
+				continue
+			case <-done:
+				return nil
+			case <-h.closed:
+				return nil
+			}
+		}
+		_, err := tun.Write(b)
+		h.mem.release(cap(b))
+		pool.Put(b[:cap(b)])
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package gost
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+var errTunNoDevice = errors.New("tun device is not running")
+
+// AddRoute adds the system route of the network cidr via the tun device at runtime,
+// e.g. to change the networks sent through the tunnel. The route is removed when the device is closed.
+func (h *tunHandler) AddRoute(cidr string) error {
+	_, dest, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	c, err := h.device()
+	if err != nil {
+		return err
+	}
+	return c.addRoute(dest)
+}
+
+// RemoveRoute removes the system route of the network cidr added by AddRoute.
+func (h *tunHandler) RemoveRoute(cidr string) error {
+	_, dest, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	c, err := h.device()
+	if err != nil {
+		return err
+	}
+	return c.removeRoute(dest)
+}
+
+// device returns the tun device of the running transport.
+func (h *tunHandler) device() (*tunTapConn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c, ok := h.tun.(*tunTapConn); ok && !h.isClosed() {
+		return c, nil
+	}
+	return nil, errTunNoDevice
+}
+
+// addRoute adds the route to dest via the device, and tracks it to be removed on close.
+func (c *tunTapConn) addRoute(dest *net.IPNet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := dest.String()
+	if _, ok := c.routes[key]; ok {
+		return fmt.Errorf("route %s exists", key)
+	}
+	if err := addTunRoute(c.ifce.Name(), IPRoute{Dest: dest}); err != nil {
+		return err
+	}
+	if c.routes == nil {
+		c.routes = make(map[string]*net.IPNet)
+		// c.mu is held, so the cleanup is added in place.
+		c.cleanups = append(c.cleanups, c.removeRoutes)
+	}
+	c.routes[key] = dest
+	return nil
+}
+
+// removeRoute removes the route to dest added by addRoute.
+func (c *tunTapConn) removeRoute(dest *net.IPNet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := dest.String()
+	if _, ok := c.routes[key]; !ok {
+		return fmt.Errorf("route %s is not added at runtime", key)
+	}
+	if err := deleteTunRoute(c.ifce.Name(), IPRoute{Dest: dest}); err != nil {
+		return err
+	}
+	delete(c.routes, key)
+	return nil
+}
+
+// removeRoutes removes the routes added by addRoute when the device is closed.
+func (c *tunTapConn) removeRoutes() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, dest := range c.routes {
+		if err := deleteTunRoute(c.ifce.Name(), IPRoute{Dest: dest}); err != nil {
+			log.Logf("[tun] %v", err)
+		}
+		delete(c.routes, key)
+	}
+}
+
+const (
+	tunRoutePersistRetry    = time.Second
+	tunRoutePersistMaxRetry = 30 * time.Second
+)
+
+// persistRoutes re-installs the routes of the device removed externally until done is closed,
+// see TunConfig.RoutePersist. The routes are checked on the changes of the device notified by the system,
+// and the failed installation, e.g. while the device is down, is retried with backoff.
+func (h *tunHandler) persistRoutes(done <-chan struct{}) {
+	c, err := h.device()
+	if err != nil {
+		h.logf("route persist: %v", err)
+		return
+	}
+	ifName := c.ifce.Name()
+	itf, err := net.InterfaceByName(ifName)
+	if err != nil {
+		h.logf("route persist: %v", err)
+		return
+	}
+	events, err := watchTunRoutes(itf.Index, done)
+	if err != nil {
+		h.logf("route persist %s: %v", ifName, err)
+		return
+	}
+
+	// the routes may be removed before the handler runs, e.g. while the client reconnects.
+	retry := time.After(0)
+	delay := tunRoutePersistRetry
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				if !h.isClosed() {
+					h.logf("route persist %s: watch stopped", ifName)
+				}
+				return
+			}
+		case <-retry:
+		case <-done:
+			return
+		}
+
+		if err := c.restoreRoutes(h.options.TunConfig.Routes); err != nil {
+			h.logf("route persist %s: %v, retry in %s", ifName, err, delay)
+			retry = time.After(delay)
+			if delay *= 2; delay > tunRoutePersistMaxRetry {
+				delay = tunRoutePersistMaxRetry
+			}
+			continue
+		}
+		retry, delay = nil, tunRoutePersistRetry
+	}
+}
+
+// restoreRoutes installs the missing routes of routes and the routes added by addRoute,
+// it returns the first error after trying all the routes.
+func (c *tunTapConn) restoreRoutes(routes []IPRoute) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dests := make([]*net.IPNet, 0, len(routes)+len(c.routes))
+	for _, route := range routes {
+		if route.Dest != nil {
+			dests = append(dests, route.Dest)
+		}
+	}
+	for _, dest := range c.routes {
+		dests = append(dests, dest)
+	}
+	for _, dest := range dests {
+		added, er := ensureTunRoute(c.ifce.Name(), dest)
+		if er != nil {
+			if err == nil {
+				err = fmt.Errorf("route %s: %v", dest, er)
+			}
+			continue
+		}
+		if added {
+			log.Logf("[tun] ip route add %s dev %s: the removed route is re-installed", dest, c.ifce.Name())
+		}
+	}
+	return
+}
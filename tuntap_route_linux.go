@@ -0,0 +1,104 @@
+package gost
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/docker/libcontainer/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// watchTunRoutes subscribes to the changes of the links, addresses and routes of the system by netlink,
+// a value is sent on the returned channel for the changes of the device ifIndex, e.g. a route of it
+// is removed, or it is up again. The channel is closed when done is closed or the subscription fails.
+func watchTunRoutes(ifIndex int, done <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	for _, group := range []uint32{unix.RTNLGRP_LINK, unix.RTNLGRP_IPV4_IFADDR, unix.RTNLGRP_IPV6_IFADDR,
+		unix.RTNLGRP_IPV4_ROUTE, unix.RTNLGRP_IPV6_ROUTE} {
+		sa.Groups |= 1 << (group - 1)
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// the non-blocking socket is read through the runtime poller, so closing the file stops the read.
+	f := os.NewFile(uintptr(fd), "netlink")
+
+	events := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		<-done
+		f.Close()
+	}()
+	go func() {
+		defer close(events)
+		b := make([]byte, os.Getpagesize()*8)
+		for {
+			n, err := f.Read(b)
+			if err != nil {
+				if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOBUFS {
+					// the events are lost as the socket buffer overflows.
+					notify()
+					continue
+				}
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(b[:n])
+			if err != nil {
+				continue
+			}
+			for i := range msgs {
+				if tunNetlinkIndex(&msgs[i]) == ifIndex {
+					notify()
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// tunNetlinkIndex returns the index of the interface of the netlink message m, or 0 if it is not
+// a change of interest: a link is changed, an address is changed, or a route is removed.
+func tunNetlinkIndex(m *syscall.NetlinkMessage) int {
+	switch m.Header.Type {
+	case syscall.RTM_NEWLINK:
+		if len(m.Data) >= syscall.SizeofIfInfomsg {
+			return int((*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0])).Index)
+		}
+	case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		if len(m.Data) >= syscall.SizeofIfAddrmsg {
+			return int((*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0])).Index)
+		}
+	case syscall.RTM_DELROUTE:
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return 0
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.RTA_OIF && len(a.Value) >= 4 {
+				return int(*(*uint32)(unsafe.Pointer(&a.Value[0])))
+			}
+		}
+	}
+	return 0
+}
+
+// ensureTunRoute installs the route to dest via the device ifName, added is false if the route exists.
+func ensureTunRoute(ifName string, dest *net.IPNet) (added bool, err error) {
+	err = netlink.AddRoute(dest.String(), "", "", ifName)
+	if err == syscall.EEXIST {
+		return false, nil
+	}
+	return err == nil, err
+}
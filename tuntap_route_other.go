@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package gost
+
+import (
+	"errors"
+	"net"
+)
+
+var errTunRoutePersist = errors.New("route persistence is not supported on this platform")
+
+func watchTunRoutes(ifIndex int, done <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errTunRoutePersist
+}
+
+func ensureTunRoute(ifName string, dest *net.IPNet) (added bool, err error) {
+	return false, errTunRoutePersist
+}
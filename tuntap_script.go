@@ -0,0 +1,62 @@
+package gost
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-log/log"
+)
+
+// runTunScript runs the script for the tun device ifce with the name of the device as
+// the only argument. The environment of the script has the variables of the device:
+// TUN_IFACE (the name), TUN_ADDR (the address in CIDR notation) and TUN_MTU.
+// The output of the script is logged.
+func runTunScript(script string, ifce *net.Interface, cfg TunConfig) error {
+	cmd := exec.Command(script, ifce.Name)
+	cmd.Env = append(os.Environ(),
+		"TUN_IFACE="+ifce.Name,
+		"TUN_ADDR="+cfg.Addr,
+		fmt.Sprintf("TUN_MTU=%d", ifce.MTU),
+	)
+
+	log.Logf("[tun] %s: run %s", ifce.Name, script)
+	out, err := cmd.CombinedOutput()
+	if s := strings.TrimSpace(string(out)); s != "" {
+		for _, line := range strings.Split(s, "\n") {
+			log.Logf("[tun] %s: %s: %s", ifce.Name, script, line)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", script, err)
+	}
+	return nil
+}
+
+// runTunUpScript runs the UpScript after the device is up, and registers the DownScript
+// to run before the device is closed.
+func runTunUpScript(conn net.Conn, ifce *net.Interface, cfg TunConfig) error {
+	if cfg.UpScript != "" {
+		if err := runTunScript(cfg.UpScript, ifce, cfg); err != nil {
+			if !cfg.IgnoreUpScriptError {
+				return err
+			}
+			log.Logf("[tun] %s: %v", ifce.Name, err)
+		}
+	}
+
+	if cfg.DownScript != "" {
+		c, ok := conn.(*tunTapConn)
+		if !ok {
+			return nil
+		}
+		c.addCleanup(func() {
+			if err := runTunScript(cfg.DownScript, ifce, cfg); err != nil {
+				log.Logf("[tun] %s: %v", ifce.Name, err)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package gost
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The session ID is prepended to each datagram before it is encrypted when TunConfig.SessionID is set,
+// so the server maps the datagrams to the peer by the ID instead of the outer address.
+//
+//	+------------+----------------------+
+//	| SESSION ID |      IP PACKET       |
+//	+------------+----------------------+
+//	      8
+//
+// SESSION ID is the random ID of the client, the server replies with the ID of the client. It is zero for
+// the datagrams of the server to the peers not mapped by the ID, e.g. of the static routes.
+const tunSessionIDLen = 8
+
+// tunSessionIdle is the time after which the session not seen is forgotten by the server.
+const tunSessionIdle = 10 * time.Minute
+
+var (
+	errTunSessionShort = errors.New("session ID: short datagram")
+	errTunSessionID    = errors.New("session ID: mismatch")
+)
+
+// newTunClientID returns a random non-zero session ID of the client.
+func newTunClientID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// tunSessionAddr is the address of a peer mapped by the session ID on server side. The handler keeps
+// the address in its peers and routes, and the datagrams to it are sent to the last outer address it sent from,
+// so the peer is kept when its outer address changes, e.g. by a NAT rebinding or a migration to another network.
+type tunSessionAddr struct {
+	id   uint64
+	addr atomic.Value // net.Addr, the last outer address
+	seen int64        // the time in Unix nanoseconds it is last seen, accessed atomically
+}
+
+func (a *tunSessionAddr) outer() net.Addr {
+	return a.addr.Load().(net.Addr)
+}
+
+func (a *tunSessionAddr) Network() string {
+	return a.outer().Network()
+}
+
+// String returns the session ID, which is stable as the outer address changes.
+func (a *tunSessionAddr) String() string {
+	return fmt.Sprintf("session-%016x", a.id)
+}
+
+// tunSessionConn adds the session ID to the datagrams written, and removes it from the datagrams read,
+// see TunConfig.SessionID.
+type tunSessionConn struct {
+	net.PacketConn
+	id       uint64 // the ID of the client, zero on server side
+	mu       sync.Mutex
+	sessions map[uint64]*tunSessionAddr
+	pruned   time.Time
+	wmu      sync.Mutex
+	buf      []byte
+}
+
+// newTunSessionConn creates the session ID framing of pc, id is the ID of the client, or zero on server side.
+func newTunSessionConn(pc net.PacketConn, id uint64) *tunSessionConn {
+	return &tunSessionConn{
+		PacketConn: pc,
+		id:         id,
+		sessions:   make(map[uint64]*tunSessionAddr),
+		pruned:     time.Now(),
+	}
+}
+
+// ReadFrom returns the address of the session on server side, and the datagrams of other sessions
+// are rejected on client side.
+func (c *tunSessionConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return
+	}
+	if n < tunSessionIDLen {
+		return 0, addr, &tunDecryptError{err: errTunSessionShort}
+	}
+	id := binary.BigEndian.Uint64(b)
+	n = copy(b, b[tunSessionIDLen:n])
+	if c.id != 0 {
+		if id != c.id && id != 0 {
+			return 0, addr, &tunDecryptError{err: errTunSessionID}
+		}
+		return n, addr, nil
+	}
+	if id == 0 || addr == nil {
+		return n, addr, nil
+	}
+	return n, c.session(id, addr), nil
+}
+
+// session returns the address of the session id, which is updated to the outer address addr.
+func (c *tunSessionConn) session(id uint64, addr net.Addr) *tunSessionAddr {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.sessions[id]
+	if s == nil {
+		if now.Sub(c.pruned) > tunSessionIdle {
+			c.pruned = now
+			for k, v := range c.sessions {
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&v.seen))) > tunSessionIdle {
+					delete(c.sessions, k)
+				}
+			}
+		}
+		s = &tunSessionAddr{id: id}
+		c.sessions[id] = s
+	}
+	if old, _ := s.addr.Load().(net.Addr); old == nil || tunAddrKey(old) != tunAddrKey(addr) {
+		s.addr.Store(addr)
+	}
+	atomic.StoreInt64(&s.seen, now.UnixNano())
+	return s
+}
+
+// WriteTo sends b to the last outer address of the session addr on server side.
+func (c *tunSessionConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	id := c.id
+	if s, ok := addr.(*tunSessionAddr); ok {
+		id, addr = s.id, s.outer()
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if n := tunSessionIDLen + len(b); cap(c.buf) < n {
+		c.buf = make([]byte, n)
+	}
+	buf := c.buf[:tunSessionIDLen+len(b)]
+	binary.BigEndian.PutUint64(buf, id)
+	copy(buf[tunSessionIDLen:], b)
+
+	n, err := c.PacketConn.WriteTo(buf, addr)
+	if n -= tunSessionIDLen; n < 0 {
+		n = 0
+	}
+	return n, err
+}
@@ -0,0 +1,109 @@
+package gost
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// tunExit exits the process, it is replaced in tests.
+var tunExit = os.Exit
+
+// TunShutdownReason is the reason why a session of tun tunnel stops,
+// a supervisor can decide whether to reconnect by it instead of matching the error string.
+type TunShutdownReason string
+
+const (
+	// TunShutdownEOF means the tunnel connection reached EOF.
+	TunShutdownEOF TunShutdownReason = "eof"
+	// TunShutdownDeviceClosed means the tun device can not be read or written, e.g. it is closed or removed.
+	TunShutdownDeviceClosed TunShutdownReason = "device-closed"
+	// TunShutdownCancelled means the handler is closed by Close.
+	TunShutdownCancelled TunShutdownReason = "cancelled"
+	// TunShutdownIdleTimeout means the peer missed too many keepalives, see TunConfig.DPDInterval.
+	TunShutdownIdleTimeout TunShutdownReason = "idle-timeout"
+	// TunShutdownFatalIO means the tunnel connection failed.
+	TunShutdownFatalIO TunShutdownReason = "fatal-io"
+	// TunShutdownDecryptFlood means too many datagrams can not be decrypted, see TunConfig.DecryptFloodTeardown.
+	TunShutdownDecryptFlood TunShutdownReason = "decrypt-flood"
+	// TunShutdownParseErrors means too many packets can not be parsed, see TunConfig.ParseErrorTeardown.
+	TunShutdownParseErrors TunShutdownReason = "parse-errors"
+)
+
+// TunShutdownError is the error of a session of tun tunnel stopped by a failure.
+type TunShutdownError struct {
+	Reason TunShutdownReason
+	Err    error
+	socket bool // Err is the error of reading or writing the tunnel connection
+}
+
+func (e *TunShutdownError) Error() string {
+	return string(e.Reason) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TunShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// tunDeviceError reports the error of reading or writing the tun device.
+func tunDeviceError(err error) error {
+	return &TunShutdownError{Reason: TunShutdownDeviceClosed, Err: err}
+}
+
+// tunSocketError reports the error of reading or writing the tunnel connection.
+func tunSocketError(err error) error {
+	if err == io.EOF {
+		return err
+	}
+	return &TunShutdownError{Reason: TunShutdownFatalIO, Err: err, socket: true}
+}
+
+// isTunFatalError reports whether err is the failure of the tun device or the non-temporary failure
+// of the tunnel connection, which is reported to the listener, see errorReporter.
+// The session errors, e.g. the dead peer or the decryption flood, are retried by the handler instead.
+func isTunFatalError(err error) bool {
+	e, ok := err.(*TunShutdownError)
+	if !ok {
+		return false
+	}
+	switch e.Reason {
+	case TunShutdownDeviceClosed:
+		return true
+	case TunShutdownFatalIO:
+		if !e.socket {
+			return false
+		}
+		ne, ok := e.Err.(net.Error)
+		return !ok || !ne.Temporary()
+	}
+	return false
+}
+
+// tunShutdown maps the error stopping the session to its reason.
+func tunShutdown(err error) *TunShutdownError {
+	if e, ok := err.(*TunShutdownError); ok {
+		return e
+	}
+
+	reason := TunShutdownFatalIO
+	switch err {
+	case nil, io.EOF:
+		reason, err = TunShutdownEOF, io.EOF
+	case errTunPeerDead:
+		reason = TunShutdownIdleTimeout
+	case errTunDecryptFlood:
+		reason = TunShutdownDecryptFlood
+	case errTunParseErrors:
+		reason = TunShutdownParseErrors
+	}
+	return &TunShutdownError{Reason: reason, Err: err}
+}
+
+// shutdown reports the reason of the stopped session to TunConfig.OnShutdown,
+// err is nil when the handler is closed.
+func (h *tunHandler) shutdown(reason TunShutdownReason, err error) {
+	if cb := h.options.TunConfig.OnShutdown; cb != nil {
+		cb(reason, err)
+	}
+}
@@ -0,0 +1,106 @@
+package gost
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/go-log/log"
+)
+
+var tunSignals struct {
+	mu        sync.Mutex
+	handlers  map[io.Closer]struct{}
+	installed bool
+}
+
+// HandleTunSignals closes the tun handler h (see TunHandler) when SIGINT or SIGTERM is received,
+// so the tun device is torn down cleanly before the process exits: the device is closed
+// and removed by the system along with its routes, and the NAT rules and DownScript are run.
+// The persistent device (see TunConfig.Persist) is deleted as well, unlike on a plain Close.
+// All the registered handlers are torn down, then the process exits with status 0,
+// or 1 if any of the teardowns fails. It takes over SIGINT and SIGTERM for the whole process,
+// so it is opt-in, e.g. by the signal_teardown option of the tun node. The returned function unregisters h.
+func HandleTunSignals(h io.Closer) (unregister func()) {
+	tunSignals.mu.Lock()
+	defer tunSignals.mu.Unlock()
+
+	if tunSignals.handlers == nil {
+		tunSignals.handlers = make(map[io.Closer]struct{})
+	}
+	tunSignals.handlers[h] = struct{}{}
+
+	if !tunSignals.installed {
+		tunSignals.installed = true
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-ch
+			log.Logf("[tun] %s received, tear down the tun devices", sig)
+			code := 0
+			if err := closeTunHandlers(); err != nil {
+				code = 1
+			}
+			tunExit(code)
+		}()
+	}
+
+	return func() {
+		tunSignals.mu.Lock()
+		defer tunSignals.mu.Unlock()
+		delete(tunSignals.handlers, h)
+	}
+}
+
+// closeTunHandlers tears down all the handlers registered by HandleTunSignals,
+// it returns the first error of the teardowns.
+func closeTunHandlers() error {
+	tunSignals.mu.Lock()
+	handlers := tunSignals.handlers
+	tunSignals.handlers = nil
+	tunSignals.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	for h := range handlers {
+		wg.Add(1)
+		go func(h io.Closer) {
+			defer wg.Done()
+			var err error
+			if t, ok := h.(interface{ teardown() error }); ok {
+				err = t.teardown()
+			} else {
+				err = h.Close()
+			}
+			if err != nil {
+				log.Logf("[tun] close: %v", err)
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(h)
+	}
+	wg.Wait()
+	return first
+}
+
+// teardown closes the handler, then deletes the persistent device of the last transport,
+// which is kept by the close, see HandleTunSignals.
+func (h *tunHandler) teardown() error {
+	h.mu.Lock()
+	tun := h.tun
+	h.mu.Unlock()
+
+	err := h.Close()
+	if c, ok := tun.(*tunTapConn); ok && c.persist {
+		if er := c.deleteDevice(); er != nil && err == nil {
+			err = er
+		}
+	}
+	return err
+}
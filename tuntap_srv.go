@@ -0,0 +1,112 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+const defaultTunSRVInterval = 5 * time.Minute
+
+// tunLookupSRV is the SRV resolver, it is replaced in tests.
+var tunLookupSRV = net.LookupSRV
+
+// tunSRVRemotes is the list of the server candidates resolved from the SRV record of TunConfig.RemoteSRV.
+// The candidates are tried in the order of priority, and the next one is picked when
+// the current one fails. The record is resolved again when the interval is elapsed
+// or all the candidates have failed, the current server is kept if it is still in the record.
+type tunSRVRemotes struct {
+	name     string
+	interval time.Duration
+	mu       sync.Mutex
+	addrs    []*net.UDPAddr
+	next     int
+	resolved time.Time
+}
+
+func newTunSRVRemotes(name string, interval time.Duration) *tunSRVRemotes {
+	if interval <= 0 {
+		interval = defaultTunSRVInterval
+	}
+	return &tunSRVRemotes{name: name, interval: interval}
+}
+
+// remote returns the current server candidate.
+func (r *tunSRVRemotes) remote() (net.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(r.addrs) || time.Since(r.resolved) >= r.interval {
+		if err := r.resolve(); err != nil {
+			if len(r.addrs) == 0 {
+				return nil, err
+			}
+			// keep using the candidates of the last resolution.
+			log.Logf("[tun] resolve SRV %s: %v", r.name, err)
+			r.resolved = time.Now()
+		}
+		if r.next >= len(r.addrs) {
+			r.next = 0
+		}
+	}
+	return r.addrs[r.next], nil
+}
+
+// failed marks the candidate addr as failed, so the next one is picked.
+func (r *tunSRVRemotes) failed(addr net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next < len(r.addrs) && tunAddrKey(r.addrs[r.next]) == tunAddrKey(addr) {
+		r.next++
+	}
+}
+
+func (r *tunSRVRemotes) resolve() error {
+	_, srvs, err := tunLookupSRV("", "", r.name)
+	if err != nil {
+		return err
+	}
+	// the records of the same priority are already ordered by weight randomly by the resolver.
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+
+	var addrs []*net.UDPAddr
+	for _, srv := range srvs {
+		// a single "." target means the service is not available.
+		if srv.Target == "." {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
+		if err != nil {
+			log.Logf("[tun] resolve SRV %s: %v", r.name, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return errors.New("no server in SRV record " + r.name)
+	}
+
+	next := 0
+	if r.next < len(r.addrs) {
+		cur := tunAddrKey(r.addrs[r.next])
+		for i, addr := range addrs {
+			if tunAddrKey(addr) == cur {
+				next = i
+				break
+			}
+		}
+	}
+	if Debug {
+		log.Logf("[tun] resolve SRV %s: %v", r.name, addrs)
+	}
+	r.addrs, r.next, r.resolved = addrs, next, time.Now()
+	return nil
+}
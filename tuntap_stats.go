@@ -0,0 +1,443 @@
+package gost
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunStats is a snapshot of the counters of tun tunnel.
+type TunStats struct {
+	// RxPackets and RxBytes count the packets received from the peers.
+	RxPackets uint64
+	RxBytes   uint64
+	// TxPackets and TxBytes count the packets sent to the peers.
+	TxPackets uint64
+	TxBytes   uint64
+	// MTUExceeded counts the received packets larger than the device MTU.
+	MTUExceeded uint64
+	// PeerRejected counts the packets dropped as the peer limit is reached.
+	PeerRejected uint64
+	// DecryptFailed counts the received datagrams that can not be decrypted.
+	DecryptFailed uint64
+	// Malformed counts the IPv4 packets received from the peers with inconsistent lengths.
+	Malformed uint64
+	// QueueDropped counts the packets from the peers dropped as the write queue of the device, or the queue of the peer, is full.
+	QueueDropped uint64
+	// ProtocolDropped counts the packets from the tun device dropped as the protocol is not allowed.
+	ProtocolDropped uint64
+	// UnknownPeer counts the datagrams dropped as they are not from the static peer
+	// or the remote of the point-to-point server, see TunConfig.Peer.
+	UnknownPeer uint64
+	// Truncated counts the packets dropped as they may be truncated by the packet buffer, see TunConfig.BufferSize.
+	Truncated uint64
+	// Misrouted counts the packets dropped as their forwarding would violate the learned routes, see TunConfig.StrictRouting.
+	Misrouted uint64
+	// PendingDropped counts the packets not held or expired in the pending buffer, see TunConfig.PendingBuffer.
+	PendingDropped uint64
+	// SendDropped counts the packets to the peers dropped as the send buffer of the tunnel connection is full, see TunConfig.SendRetry,
+	// or the send queue is full, see TunConfig.Upstream.
+	SendDropped uint64
+	// MemoryDropped counts the packets dropped as the memory budget is exhausted, see TunConfig.MaxMemory.
+	MemoryDropped uint64
+	// DuplicateIP counts the packets dropped by the conflicts of the duplicate inner addresses, see TunConfig.DuplicateIPPolicy.
+	DuplicateIP uint64
+	// RouterDropped counts the packets from the tun device dropped by TunConfig.Router.
+	RouterDropped uint64
+	// NoRouteDropped, NoRouteICMP, NoRouteGateway and NoRouteFlooded count the packets from the tun device
+	// without route by the action taken, see TunConfig.NoRouteAction. The packets to the unavailable default peer are dropped.
+	NoRouteDropped uint64
+	NoRouteICMP    uint64
+	NoRouteGateway uint64
+	NoRouteFlooded uint64
+	// IdleRoutes counts the learned routes removed as idle, see TunConfig.PeerIdleTimeout.
+	IdleRoutes uint64
+	// TTLExpired counts the packets from the tun device dropped as their TTL is expired, see TunConfig.DecrementTTL.
+	TTLExpired uint64
+	// Runts counts the packets from the tun device and the peers dropped as they are shorter than
+	// TunConfig.MinPacketSize.
+	Runts uint64
+	// Fragmented counts the IPv4 packets fragmented as they are larger than the MTU, see TunConfig.IgnoreDF.
+	Fragmented uint64
+	// ChecksumFixed counts the packets from the tun device whose checksums are completed, see TunConfig.CompleteChecksums.
+	ChecksumFixed uint64
+	// Looped counts the packets from the peers dropped as they are sent to the peers, see TunConfig.LoopDetect.
+	Looped uint64
+	// MemoryUsed is the current bytes of the buffered packets accounted by the memory budget, it is not reset.
+	MemoryUsed int64
+	// Latency is the histogram of the round-trip time of the keepalives, see TunConfig.MeasureLatency.
+	Latency TunLatencyStats
+	// Peers are the counters of each peer.
+	Peers []TunPeerStats
+}
+
+// TunPeerStats is a snapshot of the counters of a tun tunnel peer.
+type TunPeerStats struct {
+	Addr      net.Addr
+	RxPackets uint64
+	RxBytes   uint64
+	TxPackets uint64
+	TxBytes   uint64
+	// RTT is the last round-trip time of the keepalives, zero means it is not measured.
+	RTT time.Duration
+}
+
+// TunLatencyBuckets are the upper bounds of the buckets of TunLatencyStats.
+var TunLatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// TunLatencyStats is the histogram of the round-trip times.
+type TunLatencyStats struct {
+	Count uint64
+	Sum   time.Duration
+	// Buckets are the counts of the round-trip times not greater than the bound of TunLatencyBuckets
+	// of the same index (not cumulative), the last one counts those greater than all the bounds.
+	Buckets []uint64
+}
+
+// Mean returns the mean of the round-trip times.
+func (st TunLatencyStats) Mean() time.Duration {
+	if st.Count == 0 {
+		return 0
+	}
+	return st.Sum / time.Duration(st.Count)
+}
+
+type tunCounters struct {
+	rxPackets uint64
+	rxBytes   uint64
+	txPackets uint64
+	txBytes   uint64
+}
+
+// tunStats holds the counters of tun tunnel.
+// The counters are updated atomically while holding the read lock of mu,
+// so that snapshot and reset holding the write lock see all the counters consistently.
+type tunStats struct {
+	tunCounters
+	mtuExceeded     uint64
+	peerRejected    uint64
+	decryptFailed   uint64
+	protocolDropped uint64
+	malformed       uint64
+	queueDropped    uint64
+	unknownPeer     uint64
+	truncated       uint64
+	misrouted       uint64
+	pendingDropped  uint64
+	sendDropped     uint64
+	memoryDropped   uint64
+	duplicateIP     uint64
+	routerDropped   uint64
+	noRouteDropped  uint64
+	noRouteICMP     uint64
+	noRouteGateway  uint64
+	noRouteFlooded  uint64
+	idleRoutes      uint64
+	ttlExpired      uint64
+	runts           uint64
+	fragmented      uint64
+	checksumFixed   uint64
+	looped          uint64
+	rttCount        uint64
+	rttSum          uint64 // nanoseconds
+	rttBuckets      [len(TunLatencyBuckets) + 1]uint64
+	mu              sync.RWMutex
+}
+
+func (s *tunStats) incr(p *uint64, n uint64) {
+	s.mu.RLock()
+	atomic.AddUint64(p, n)
+	s.mu.RUnlock()
+}
+
+// observeRTT adds the round-trip time rtt to the histogram.
+func (s *tunStats) observeRTT(rtt time.Duration) {
+	i := sort.Search(len(TunLatencyBuckets), func(i int) bool {
+		return rtt <= TunLatencyBuckets[i]
+	})
+	s.mu.RLock()
+	atomic.AddUint64(&s.rttCount, 1)
+	atomic.AddUint64(&s.rttSum, uint64(rtt))
+	atomic.AddUint64(&s.rttBuckets[i], 1)
+	s.mu.RUnlock()
+}
+
+func (s *tunStats) count(c *tunCounters, rx bool, n int) {
+	s.mu.RLock()
+	if rx {
+		atomic.AddUint64(&s.rxPackets, 1)
+		atomic.AddUint64(&s.rxBytes, uint64(n))
+		if c != nil {
+			atomic.AddUint64(&c.rxPackets, 1)
+			atomic.AddUint64(&c.rxBytes, uint64(n))
+		}
+	} else {
+		atomic.AddUint64(&s.txPackets, 1)
+		atomic.AddUint64(&s.txBytes, uint64(n))
+		if c != nil {
+			atomic.AddUint64(&c.txPackets, 1)
+			atomic.AddUint64(&c.txBytes, uint64(n))
+		}
+	}
+	s.mu.RUnlock()
+}
+
+// countRx counts the packet of n bytes received from the peer.
+func (h *tunHandler) countRx(peer *tunPeer, n int) {
+	var c *tunCounters
+	if peer != nil {
+		c = &peer.tunCounters
+	}
+	h.stats.count(c, true, n)
+}
+
+// countTx counts the packet of n bytes sent to the peer addr.
+func (h *tunHandler) countTx(addr net.Addr, n int) {
+	var c *tunCounters
+	if v, ok := h.peers.Load(tunAddrKey(addr)); ok {
+		c = &v.(*tunPeer).tunCounters
+	}
+	h.stats.count(c, false, n)
+}
+
+// Stats returns a consistent snapshot of the counters of the handler and its peers.
+func (h *tunHandler) Stats() TunStats {
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+
+	st := TunStats{
+		RxPackets:       h.stats.rxPackets,
+		RxBytes:         h.stats.rxBytes,
+		TxPackets:       h.stats.txPackets,
+		TxBytes:         h.stats.txBytes,
+		MTUExceeded:     h.stats.mtuExceeded,
+		PeerRejected:    h.stats.peerRejected,
+		DecryptFailed:   h.stats.decryptFailed,
+		ProtocolDropped: h.stats.protocolDropped,
+		Malformed:       h.stats.malformed,
+		QueueDropped:    h.stats.queueDropped,
+		UnknownPeer:     h.stats.unknownPeer,
+		Truncated:       h.stats.truncated,
+		Misrouted:       h.stats.misrouted,
+		PendingDropped:  h.stats.pendingDropped,
+		SendDropped:     h.stats.sendDropped,
+		MemoryDropped:   h.stats.memoryDropped,
+		DuplicateIP:     h.stats.duplicateIP,
+		RouterDropped:   h.stats.routerDropped,
+		NoRouteDropped:  h.stats.noRouteDropped,
+		NoRouteICMP:     h.stats.noRouteICMP,
+		NoRouteGateway:  h.stats.noRouteGateway,
+		NoRouteFlooded:  h.stats.noRouteFlooded,
+		IdleRoutes:      h.stats.idleRoutes,
+		TTLExpired:      h.stats.ttlExpired,
+		Runts:           h.stats.runts,
+		Fragmented:      h.stats.fragmented,
+		ChecksumFixed:   h.stats.checksumFixed,
+		Looped:          h.stats.looped,
+		MemoryUsed:      h.mem.usage(),
+		Latency: TunLatencyStats{
+			Count:   h.stats.rttCount,
+			Sum:     time.Duration(h.stats.rttSum),
+			Buckets: append([]uint64(nil), h.stats.rttBuckets[:]...),
+		},
+	}
+	h.peers.Range(func(k, v interface{}) bool {
+		peer := v.(*tunPeer)
+		st.Peers = append(st.Peers, TunPeerStats{
+			Addr:      peer.addr,
+			RxPackets: peer.rxPackets,
+			RxBytes:   peer.rxBytes,
+			TxPackets: peer.txPackets,
+			TxBytes:   peer.txBytes,
+			RTT:       time.Duration(atomic.LoadInt64(&peer.rtt)),
+		})
+		return true
+	})
+	return st
+}
+
+// ResetStats resets all the counters of the handler and its peers to zero,
+// it is safe to call concurrently with active forwarding.
+func (h *tunHandler) ResetStats() {
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+
+	h.stats.tunCounters = tunCounters{}
+	h.stats.mtuExceeded = 0
+	h.stats.peerRejected = 0
+	h.stats.decryptFailed = 0
+	h.stats.protocolDropped = 0
+	h.stats.malformed = 0
+	h.stats.queueDropped = 0
+	h.stats.unknownPeer = 0
+	h.stats.truncated = 0
+	h.stats.misrouted = 0
+	h.stats.pendingDropped = 0
+	h.stats.sendDropped = 0
+	h.stats.memoryDropped = 0
+	h.stats.duplicateIP = 0
+	h.stats.routerDropped = 0
+	h.stats.noRouteDropped = 0
+	h.stats.noRouteICMP = 0
+	h.stats.noRouteGateway = 0
+	h.stats.noRouteFlooded = 0
+	h.stats.idleRoutes = 0
+	h.stats.ttlExpired = 0
+	h.stats.runts = 0
+	h.stats.fragmented = 0
+	h.stats.checksumFixed = 0
+	h.stats.looped = 0
+	h.stats.rttCount = 0
+	h.stats.rttSum = 0
+	h.stats.rttBuckets = [len(h.stats.rttBuckets)]uint64{}
+	h.peers.Range(func(k, v interface{}) bool {
+		v.(*tunPeer).tunCounters = tunCounters{}
+		return true
+	})
+}
+
+const defaultTunStatsInterval = 60 * time.Second
+
+// String returns the compact line of the counters sent to the stats endpoint, e.g.
+//
+//	peers=2 rx_packets=10 rx_bytes=840 tx_packets=8 tx_bytes=672 mtu_exceeded=0 ...
+func (st TunStats) String() string {
+	return fmt.Sprintf("peers=%d rx_packets=%d rx_bytes=%d tx_packets=%d tx_bytes=%d "+
+		"mtu_exceeded=%d peer_rejected=%d decrypt_failed=%d malformed=%d "+
+		"queue_dropped=%d protocol_dropped=%d unknown_peer=%d truncated=%d misrouted=%d pending_dropped=%d send_dropped=%d "+
+		"memory_dropped=%d memory_used=%d duplicate_ip=%d router_dropped=%d "+
+		"noroute_dropped=%d noroute_icmp=%d noroute_gateway=%d noroute_flooded=%d idle_routes=%d ttl_expired=%d runts=%d fragmented=%d checksum_fixed=%d looped=%d",
+		len(st.Peers), st.RxPackets, st.RxBytes, st.TxPackets, st.TxBytes,
+		st.MTUExceeded, st.PeerRejected, st.DecryptFailed, st.Malformed,
+		st.QueueDropped, st.ProtocolDropped, st.UnknownPeer, st.Truncated, st.Misrouted, st.PendingDropped, st.SendDropped,
+		st.MemoryDropped, st.MemoryUsed, st.DuplicateIP, st.RouterDropped,
+		st.NoRouteDropped, st.NoRouteICMP, st.NoRouteGateway, st.NoRouteFlooded, st.IdleRoutes, st.TTLExpired, st.Runts, st.Fragmented, st.ChecksumFixed, st.Looped)
+}
+
+// reportStats sends the stats line to TunConfig.StatsEndpoint every StatsInterval until done is closed.
+// The endpoint is either a UDP address, which receives the bare lines,
+// or a UDP address prefixed by "syslog://", which receives the lines as RFC 3164 syslog messages.
+// The failures are logged and the reporting goes on.
+func (h *tunHandler) reportStats(done <-chan struct{}) {
+	cfg := &h.options.TunConfig
+	interval := cfg.StatsInterval
+	if interval <= 0 {
+		interval = defaultTunStatsInterval
+	}
+	addr := cfg.StatsEndpoint
+	syslog := strings.HasPrefix(addr, "syslog://")
+	addr = strings.TrimPrefix(addr, "syslog://")
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		if conn == nil {
+			c, err := net.Dial("udp", addr)
+			if err != nil {
+				h.logf("stats %s: %v", addr, err)
+				continue
+			}
+			conn = c
+		}
+
+		line := h.Stats().String()
+		if syslog {
+			// facility daemon (3), severity informational (6)
+			line = fmt.Sprintf("<%d>%s %s gost-tun: %s",
+				3*8+6, time.Now().Format(time.Stamp), hostname, line)
+		}
+		if _, err := conn.Write([]byte(line)); err != nil {
+			h.logf("stats %s: %v", addr, err)
+		}
+	}
+}
+
+// tunDelta returns the increment of a counter from prev to cur, the counter may be reset in between.
+func tunDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// tunSummary returns the summary lines of the traffic from the snapshot prev to cur in the interval d,
+// the first line is the aggregate of all the peers, followed by a line for each peer with traffic.
+func tunSummary(prev, cur TunStats, d time.Duration) []string {
+	lines := []string{fmt.Sprintf("summary %s: peers %d, rx %d packets %d bytes, tx %d packets %d bytes",
+		d, len(cur.Peers),
+		tunDelta(prev.RxPackets, cur.RxPackets), tunDelta(prev.RxBytes, cur.RxBytes),
+		tunDelta(prev.TxPackets, cur.TxPackets), tunDelta(prev.TxBytes, cur.TxBytes))}
+
+	last := make(map[string]TunPeerStats, len(prev.Peers))
+	for _, peer := range prev.Peers {
+		last[tunAddrKey(peer.Addr)] = peer
+	}
+	sort.Slice(cur.Peers, func(i, j int) bool {
+		return tunAddrKey(cur.Peers[i].Addr) < tunAddrKey(cur.Peers[j].Addr)
+	})
+	for _, peer := range cur.Peers {
+		p := last[tunAddrKey(peer.Addr)]
+		rxPackets, txPackets := tunDelta(p.RxPackets, peer.RxPackets), tunDelta(p.TxPackets, peer.TxPackets)
+		if rxPackets == 0 && txPackets == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("summary %s: rx %d packets %d bytes, tx %d packets %d bytes",
+			peer.Addr, rxPackets, tunDelta(p.RxBytes, peer.RxBytes), txPackets, tunDelta(p.TxBytes, peer.TxBytes)))
+	}
+	return lines
+}
+
+// logSummary logs the summary of the traffic every TunConfig.SummaryInterval until done is closed.
+func (h *tunHandler) logSummary(done <-chan struct{}) {
+	interval := h.options.TunConfig.SummaryInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := h.Stats()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		cur := h.Stats()
+		for _, line := range tunSummary(prev, cur, interval) {
+			h.logf("%s", line)
+		}
+		prev = cur
+	}
+}
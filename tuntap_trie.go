@@ -0,0 +1,148 @@
+package gost
+
+import (
+	"net"
+)
+
+// tunPrefixTrie is a path-compressed binary trie of the IP prefixes for the longest prefix match,
+// the IPv4 and IPv6 prefixes are kept in separate trees. A lookup visits at most one node
+// per stored prefix length on the path, regardless of the address length.
+// It is not safe for concurrent modification, it is built once and looked up concurrently afterwards.
+type tunPrefixTrie struct {
+	v4, v6 *tunTrieNode
+}
+
+// tunTrieNode is the node of the prefix of the leading ones bits of key,
+// value is nil for the nodes only branching the longer prefixes.
+type tunTrieNode struct {
+	key      []byte
+	ones     int
+	value    interface{}
+	children [2]*tunTrieNode
+}
+
+// tunPrefixBits returns the address bytes of ip and whether it is an IPv4 address.
+func tunPrefixBits(ip net.IP) ([]byte, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, true
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16, false
+	}
+	return nil, false
+}
+
+// tunBit returns the i-th bit of b.
+func tunBit(b []byte, i int) int {
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// tunCommonBits returns the length of the common prefix of a and b, up to max bits.
+func tunCommonBits(a, b []byte, max int) int {
+	n := 0
+	for i := 0; n < max; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			break
+		}
+		n += 8
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+func (t *tunPrefixTrie) root(v4 bool) **tunTrieNode {
+	if v4 {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert adds the prefix ipNet with the value, it replaces the value of the same prefix.
+func (t *tunPrefixTrie) insert(ipNet *net.IPNet, value interface{}) {
+	bits, v4 := tunPrefixBits(ipNet.IP)
+	if bits == nil {
+		return
+	}
+	ones, size := ipNet.Mask.Size()
+	if size != len(bits)*8 {
+		return
+	}
+	key := make([]byte, len(bits))
+	for i := range key {
+		key[i] = bits[i] & ipNet.Mask[i]
+	}
+
+	p := t.root(v4)
+	for {
+		n := *p
+		if n == nil {
+			*p = &tunTrieNode{key: key, ones: ones, value: value}
+			return
+		}
+		max := ones
+		if n.ones < max {
+			max = n.ones
+		}
+		common := tunCommonBits(key, n.key, max)
+		if common < n.ones {
+			// split the node at the common prefix.
+			parent := &tunTrieNode{key: key, ones: common}
+			parent.children[tunBit(n.key, common)] = n
+			if common == ones {
+				parent.value = value
+			} else {
+				parent.children[tunBit(key, common)] = &tunTrieNode{key: key, ones: ones, value: value}
+			}
+			*p = parent
+			return
+		}
+		if ones == n.ones {
+			n.value = value
+			return
+		}
+		p = &n.children[tunBit(key, n.ones)]
+	}
+}
+
+// matches returns the values of all the prefixes containing ip, the longest prefix first.
+func (t *tunPrefixTrie) matches(ip net.IP) []interface{} {
+	var values []interface{}
+	t.walk(ip, func(value interface{}) {
+		values = append([]interface{}{value}, values...)
+	})
+	return values
+}
+
+// lookup returns the value of the longest prefix containing ip, or nil if there is none.
+func (t *tunPrefixTrie) lookup(ip net.IP) (value interface{}) {
+	t.walk(ip, func(v interface{}) {
+		value = v
+	})
+	return
+}
+
+// walk calls f with the values of the prefixes containing ip, the shortest prefix first.
+func (t *tunPrefixTrie) walk(ip net.IP, f func(value interface{})) {
+	bits, v4 := tunPrefixBits(ip)
+	if bits == nil {
+		return
+	}
+
+	for n := *t.root(v4); n != nil; n = n.children[tunBit(bits, n.ones)] {
+		if tunCommonBits(bits, n.key, n.ones) < n.ones {
+			return
+		}
+		if n.value != nil {
+			f(n.value)
+		}
+		if n.ones == len(bits)*8 {
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package gost
+
+import (
+	"errors"
+	"sync"
+)
+
+// tunTunnelListen creates the listener of the tun device, it is replaced in tests.
+var tunTunnelListen = TunListener
+
+var errTunTunnelClosed = errors.New("tun: tunnel is closed")
+
+// TunTunnel is a running tun tunnel created by NewTunServer or NewTunClient,
+// which owns the tun device and the handler forwarding the packets between the device and the peers.
+type TunTunnel struct {
+	laddr string
+	raddr string
+	opts  []HandlerOption
+	mu    sync.Mutex
+	ln    Listener
+	h     *tunHandler
+	done  chan struct{} // closed when the handler stops
+}
+
+// NewTunServer creates the tun device of cfg and starts the server of tun tunnel on the local address laddr,
+// e.g. ":8421". The options are applied to the handler, e.g. UsersHandlerOption to encrypt the tunnel.
+func NewTunServer(laddr string, cfg TunConfig, opts ...HandlerOption) (*TunTunnel, error) {
+	return newTunTunnel(laddr, "", cfg, opts)
+}
+
+// NewTunClient creates the tun device of cfg and starts the client of tun tunnel to the server raddr,
+// in the same way as NewTunServer. The options may specify a chain by ChainHandlerOption to reach the server.
+func NewTunClient(raddr string, cfg TunConfig, opts ...HandlerOption) (*TunTunnel, error) {
+	if raddr == "" && cfg.RemoteSRV == "" {
+		return nil, errors.New("tun: client requires the address of the server")
+	}
+	return newTunTunnel("", raddr, cfg, opts)
+}
+
+func newTunTunnel(laddr, raddr string, cfg TunConfig, opts []HandlerOption) (*TunTunnel, error) {
+	t := &TunTunnel{
+		laddr: laddr,
+		raddr: raddr,
+		opts:  opts,
+	}
+	if err := t.start(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// start creates the device of cfg and runs the handler on it, it is called with mu held.
+func (t *TunTunnel) start(cfg TunConfig) error {
+	ln, err := tunTunnelListen(cfg)
+	if err != nil {
+		return err
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	opts := append([]HandlerOption{}, t.opts...)
+	opts = append(opts,
+		func(opts *HandlerOptions) {
+			opts.Node.Addr, opts.Node.Remote = t.laddr, t.raddr
+		},
+		IPRoutesHandlerOption(cfg.Routes...),
+		TunConfigHandlerOption(cfg),
+	)
+	h := TunHandler(opts...).(*tunHandler)
+	h.embedded = true
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(conn)
+	}()
+	t.ln, t.h, t.done = ln, h, done
+	return nil
+}
+
+// stop closes the handler and the device, and waits for the handler to stop. It is called with mu held.
+func (t *TunTunnel) stop() {
+	t.h.Close()
+	t.ln.Close()
+	<-t.done
+}
+
+// Close stops the tunnel and closes the tun device.
+func (t *TunTunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.h == nil {
+		return errTunTunnelClosed
+	}
+	t.stop()
+	t.h = nil
+	return nil
+}
+
+// Done returns a channel that is closed when the tunnel stops, either by Close or by a fatal error
+// of the device, see TunConfig.OnShutdown for the reason.
+func (t *TunTunnel) Done() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// Stats returns the stats of the tunnel, the counters start from zero once the tunnel is reconfigured,
+// and they are all zero once the tunnel is closed.
+func (t *TunTunnel) Stats() TunStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.h == nil {
+		return TunStats{}
+	}
+	return t.h.Stats()
+}
+
+// Reconfigure restarts the tunnel with the config cfg, the device is recreated with the new settings.
+// The config is validated first, so the running tunnel is kept if cfg is invalid. The peers are learned again
+// after the restart. It requires the privileges to create the device, so it fails after TunConfig.RunAsUser.
+func (t *TunTunnel) Reconfigure(cfg TunConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.h == nil {
+		return errTunTunnelClosed
+	}
+	t.stop()
+	if err := t.start(cfg); err != nil {
+		t.h = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package gost
+
+import (
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setUser switches the process to the user of name (or ID) and its primary group.
+func setUser(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, e := strconv.Atoi(name); e != nil {
+			return err
+		}
+		if u, err = user.LookupId(name); err != nil {
+			return err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	// the group must be changed first, as it is not permitted after the user is changed.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
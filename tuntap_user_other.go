@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package gost
+
+import "errors"
+
+func setUser(name string) error {
+	return errors.New("running as another user is not supported on this platform")
+}
@@ -1,6 +1,7 @@
 package gost
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
@@ -11,6 +12,27 @@ import (
 )
 
 func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
+	if cfg.ReuseExisting {
+		err = errors.New("reusing an existing device is not supported on windows")
+		return
+	}
+	if cfg.Owner != "" || cfg.Group != "" || cfg.Persist || cfg.MultiQueue || cfg.GroupAccess {
+		err = errors.New("owner, group, group access, persist and multi-queue of device are not supported on windows")
+		return
+	}
+	if cfg.AutoNAT {
+		err = errors.New("auto NAT is not supported on windows")
+		return
+	}
+	if cfg.EnableIPForward {
+		err = errors.New("IP forwarding management is not supported on windows")
+		return
+	}
+	if cfg.Alias != "" {
+		err = errors.New("alias of device is not supported on windows")
+		return
+	}
+
 	ip, ipNet, err := net.ParseCIDR(cfg.Addr)
 	if err != nil {
 		return
@@ -27,6 +49,11 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			ifce.Close()
+		}
+	}()
 
 	cmd := fmt.Sprintf("netsh interface ip set address name=%s "+
 		"source=static addr=%s mask=%s gateway=none",
@@ -55,6 +82,11 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 }
 
 func createTap(cfg TapConfig) (conn net.Conn, itf *net.Interface, err error) {
+	if cfg.Bridge != "" {
+		err = errors.New("attaching tap to a bridge is not supported on this platform")
+		return
+	}
+
 	ip, ipNet, _ := net.ParseCIDR(cfg.Addr)
 
 	ifce, err := water.New(water.Config{
@@ -151,3 +183,26 @@ func deleteRoute(ifName string, route string) error {
 func ipMask(mask net.IPMask) string {
 	return fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
 }
+
+func addTunRoute(ifName string, route IPRoute) error {
+	var gw string
+	if route.Gateway != nil {
+		gw = route.Gateway.String()
+	}
+	return addTunRoutes(ifName, gw, route)
+}
+
+func deleteTunRoute(ifName string, route IPRoute) error {
+	if err := deleteRoute(ifName, route.Dest.String()); err != nil {
+		return fmt.Errorf("delete route %s: %v", route.Dest, err)
+	}
+	return nil
+}
+
+func deleteTunDevice(ifName string) error {
+	return errors.New("deleting the device is not supported on windows")
+}
+
+func setTunMTU(ifName string, mtu int) error {
+	return errors.New("changing the MTU of device is not supported on windows")
+}